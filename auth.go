@@ -0,0 +1,397 @@
+package pgsnap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/jackc/pgproto3/v2"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// AuthMethod is the authentication the fake postgres asks from the client
+type AuthMethod int
+
+const (
+	// AuthTrust accepts every connection without asking for a password
+	AuthTrust AuthMethod = iota
+	// AuthSCRAM asks the client to authenticate with SCRAM-SHA-256
+	AuthSCRAM
+	// AuthMD5 asks the client to authenticate with md5 hashed password
+	AuthMD5
+	// AuthCleartext asks the client to send the password as it is, like
+	// postgres with password or LDAP authentication
+	AuthCleartext
+)
+
+const (
+	scramMechanism     = "SCRAM-SHA-256"
+	scramPlusMechanism = "SCRAM-SHA-256-PLUS"
+	scramIterations    = 4096
+
+	// channelBindingType is the only channel binding supported by postgres
+	channelBindingType = "tls-server-end-point"
+)
+
+// scramAuthStep plays the server side of SCRAM-SHA-256 as described in
+// https://www.postgresql.org/docs/current/sasl-authentication.html
+type scramAuthStep struct {
+	password string
+	params   scramParams
+}
+
+// scramHandshake is the state of one SCRAM authentication. endPoint is the
+// channel binding data of the TLS connection, SCRAM-SHA-256-PLUS is only
+// offered when it's set.
+type scramHandshake struct {
+	endPoint []byte
+
+	// plus is set when the client chose SCRAM-SHA-256-PLUS, and gs2Header
+	// is the header of its client-first-message
+	plus      bool
+	gs2Header string
+}
+
+// scramParams is the salt, iteration count and server nonce sent to the
+// client, random salt and nonce are used when they are empty
+type scramParams struct {
+	salt       []byte
+	iterations int
+	nonce      string
+}
+
+func (a *scramAuthStep) Step(be *pgproto3.Backend) error {
+	return a.run(be, &scramHandshake{})
+}
+
+func (a *scramAuthStep) stepSession(sess *session) error {
+	return a.run(sess.be, &scramHandshake{endPoint: sess.tlsEndPoint})
+}
+
+func (a *scramAuthStep) run(be *pgproto3.Backend, h *scramHandshake) error {
+	mechanisms := []string{scramMechanism}
+	if h.endPoint != nil {
+		mechanisms = []string{scramPlusMechanism, scramMechanism}
+	}
+
+	err := be.Send(&pgproto3.AuthenticationSASL{AuthMechanisms: mechanisms})
+	if err != nil {
+		return err
+	}
+	_ = be.SetAuthType(pgproto3.AuthTypeSASL)
+
+	msg, err := be.Receive()
+	if err != nil {
+		return err
+	}
+
+	initial, ok := msg.(*pgproto3.SASLInitialResponse)
+	if !ok {
+		return fmt.Errorf("scram: expect SASLInitialResponse got %#v", msg)
+	}
+
+	switch {
+	case initial.AuthMechanism == scramPlusMechanism && h.endPoint != nil:
+		h.plus = true
+	case initial.AuthMechanism != scramMechanism:
+		return fail(be, fmt.Errorf("scram: unsupported mechanism %s", initial.AuthMechanism))
+	}
+
+	clientFirstBare, clientNonce, err := h.parseClientFirst(initial.Data)
+	if err != nil {
+		return fail(be, err)
+	}
+
+	salt, serverNonce, err := a.random()
+	if err != nil {
+		return err
+	}
+	iterations := a.params.iterations
+	if iterations <= 0 {
+		iterations = scramIterations
+	}
+
+	nonce := clientNonce + serverNonce
+	serverFirst := fmt.Sprintf("r=%s,s=%s,i=%d", nonce, base64.StdEncoding.EncodeToString(salt), iterations)
+
+	err = be.Send(&pgproto3.AuthenticationSASLContinue{Data: []byte(serverFirst)})
+	if err != nil {
+		return err
+	}
+	_ = be.SetAuthType(pgproto3.AuthTypeSASLContinue)
+
+	msg, err = be.Receive()
+	if err != nil {
+		return err
+	}
+
+	resp, ok := msg.(*pgproto3.SASLResponse)
+	if !ok {
+		return fmt.Errorf("scram: expect SASLResponse got %#v", msg)
+	}
+
+	clientFinalWithoutProof, proof, err := h.parseClientFinal(resp.Data, nonce)
+	if err != nil {
+		return fail(be, err)
+	}
+
+	saltedPassword := pbkdf2.Key([]byte(a.password), salt, iterations, sha256.Size, sha256.New)
+	authMessage := []byte(clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof)
+
+	clientKey := computeHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := computeHMAC(storedKey[:], authMessage)
+
+	expected := make([]byte, len(clientKey))
+	for i := range clientKey {
+		expected[i] = clientKey[i] ^ clientSignature[i]
+	}
+
+	if !hmac.Equal(expected, proof) {
+		return fail(be, errors.New("scram: invalid client proof, wrong password?"))
+	}
+
+	serverKey := computeHMAC(saltedPassword, []byte("Server Key"))
+	serverSignature := computeHMAC(serverKey, authMessage)
+
+	return be.Send(&pgproto3.AuthenticationSASLFinal{
+		Data: []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)),
+	})
+}
+
+// parseClientFirst parse "n,,n=user,r=nonce" and return the bare
+// message (without gs2 header) and the client nonce. The gs2 header is
+// "p=tls-server-end-point,," for SCRAM-SHA-256-PLUS.
+func (h *scramHandshake) parseClientFirst(data []byte) (string, string, error) {
+	parts := bytes.SplitN(data, []byte(","), 3)
+	if len(parts) != 3 {
+		return "", "", fmt.Errorf("scram: invalid client-first-message %q", data)
+	}
+
+	if err := h.checkChannelBinding(string(parts[0])); err != nil {
+		return "", "", err
+	}
+	h.gs2Header = string(parts[0]) + "," + string(parts[1]) + ","
+
+	bare := parts[2]
+	for _, attr := range bytes.Split(bare, []byte(",")) {
+		if bytes.HasPrefix(attr, []byte("r=")) {
+			return string(bare), string(attr[2:]), nil
+		}
+	}
+
+	return "", "", fmt.Errorf("scram: no nonce in client-first-message %q", data)
+}
+
+// checkChannelBinding check the channel binding flag of the gs2 header,
+// which must be "p=" with SCRAM-SHA-256-PLUS and only then. "y" is the
+// client supporting channel binding when the server doesn't, which is a
+// downgrade when SCRAM-SHA-256-PLUS is offered.
+func (h *scramHandshake) checkChannelBinding(flag string) error {
+	switch {
+	case h.plus && flag == "p="+channelBindingType:
+		return nil
+	case h.plus:
+		return fmt.Errorf("scram: SCRAM-SHA-256-PLUS without channel binding %q", flag)
+	case flag == "n":
+		return nil
+	case flag == "y" && h.endPoint == nil:
+		return nil
+	case flag == "y":
+		return errors.New("scram: the client supports channel binding, but didn't use it")
+	}
+	return fmt.Errorf("scram: unsupported channel binding %q", flag)
+}
+
+// parseClientFinal parse "c=biws,r=nonce,p=proof" and return the message
+// without proof and the decoded proof. c is the gs2 header, followed by
+// the channel binding data with SCRAM-SHA-256-PLUS.
+func (h *scramHandshake) parseClientFinal(data []byte, nonce string) (string, []byte, error) {
+	idx := bytes.LastIndex(data, []byte(",p="))
+	if idx < 0 {
+		return "", nil, fmt.Errorf("scram: no proof in client-final-message %q", data)
+	}
+
+	withoutProof := data[:idx]
+	if !bytes.Contains(withoutProof, []byte("r="+nonce)) {
+		return "", nil, fmt.Errorf("scram: nonce mismatch in client-final-message %q", data)
+	}
+
+	cbind := []byte(h.gs2Header)
+	if h.plus {
+		cbind = append(cbind, h.endPoint...)
+	}
+	if !bytes.HasPrefix(withoutProof, []byte("c="+base64.StdEncoding.EncodeToString(cbind)+",")) {
+		return "", nil, fmt.Errorf("scram: channel binding mismatch in client-final-message %q", data)
+	}
+
+	proof, err := base64.StdEncoding.DecodeString(string(data[idx+3:]))
+	if err != nil {
+		return "", nil, fmt.Errorf("scram: invalid proof: %w", err)
+	}
+
+	return string(withoutProof), proof, nil
+}
+
+// tlsServerEndPoint return the channel binding data of tls-server-end-point
+// for the certificate of cfg: its hash with the hash of its signature,
+// SHA-256 for MD5 and SHA-1, as in RFC 5929. It's nil when the certificate
+// can't be known or hashed.
+func tlsServerEndPoint(cfg *tls.Config) []byte {
+	if cfg == nil || len(cfg.Certificates) == 0 || len(cfg.Certificates[0].Certificate) == 0 {
+		return nil
+	}
+
+	cert, err := x509.ParseCertificate(cfg.Certificates[0].Certificate[0])
+	if err != nil {
+		return nil
+	}
+
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.MD5WithRSA, x509.SHA1WithRSA, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.SHA256WithRSAPSS, x509.ECDSAWithSHA256:
+		h = sha256.New()
+	case x509.SHA384WithRSA, x509.SHA384WithRSAPSS, x509.ECDSAWithSHA384:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.SHA512WithRSAPSS, x509.ECDSAWithSHA512:
+		h = sha512.New()
+	default:
+		return nil
+	}
+
+	h.Write(cert.Raw)
+	return h.Sum(nil)
+}
+
+// random return the salt and server nonce, set by WithSCRAMParams or
+// random
+func (a *scramAuthStep) random() ([]byte, string, error) {
+	salt := a.params.salt
+	if len(salt) == 0 {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if a.params.nonce != "" {
+		return salt, a.params.nonce, nil
+	}
+
+	nonce := make([]byte, 18)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, "", err
+	}
+
+	return salt, base64.RawStdEncoding.EncodeToString(nonce), nil
+}
+
+// md5AuthStep ask the client for md5(md5(password+user)+salt), the user
+// is taken from the StartupMessage received by startup
+type md5AuthStep struct {
+	startup  *startupStep
+	password string
+	salt     [4]byte
+}
+
+func (a *md5AuthStep) Step(be *pgproto3.Backend) error {
+	err := be.Send(&pgproto3.AuthenticationMD5Password{Salt: a.salt})
+	if err != nil {
+		return err
+	}
+	_ = be.SetAuthType(pgproto3.AuthTypeMD5Password)
+
+	msg, err := be.Receive()
+	if err != nil {
+		return err
+	}
+
+	pass, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return fmt.Errorf("md5: expect PasswordMessage got %#v", msg)
+	}
+
+	want := md5Password(a.password, a.startup.user(), a.salt)
+	if pass.Password != want {
+		return failPassword(be, a.startup.user(), fmt.Errorf("md5: password mismatch:\n  got:  %s\n  want: %s", pass.Password, want))
+	}
+
+	return nil
+}
+
+// cleartextAuthStep ask the client for the password as it is
+type cleartextAuthStep struct {
+	startup  *startupStep
+	password string
+}
+
+func (a *cleartextAuthStep) Step(be *pgproto3.Backend) error {
+	err := be.Send(&pgproto3.AuthenticationCleartextPassword{})
+	if err != nil {
+		return err
+	}
+	_ = be.SetAuthType(pgproto3.AuthTypeCleartextPassword)
+
+	msg, err := be.Receive()
+	if err != nil {
+		return err
+	}
+
+	pass, ok := msg.(*pgproto3.PasswordMessage)
+	if !ok {
+		return fmt.Errorf("cleartext: expect PasswordMessage got %#v", msg)
+	}
+
+	if pass.Password != a.password {
+		return failPassword(be, a.startup.user(), fmt.Errorf("cleartext: password mismatch:\n  got:  %s\n  want: %s", pass.Password, a.password))
+	}
+
+	return nil
+}
+
+func md5Password(password, user string, salt [4]byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt[:]...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// fail tells the client that the authentication is failed and return err
+func fail(be *pgproto3.Backend, err error) error {
+	_ = be.Send(&pgproto3.ErrorResponse{
+		Severity:            "FATAL",
+		SeverityUnlocalized: "FATAL",
+		Code:                "28P01",
+		Message:             err.Error(),
+	})
+	return err
+}
+
+// failPassword is fail for the wrong password, which is only in err: the
+// client gets the message of postgres, without the password of the
+// snapshot
+func failPassword(be *pgproto3.Backend, user string, err error) error {
+	_ = be.Send(&pgproto3.ErrorResponse{
+		Severity:            "FATAL",
+		SeverityUnlocalized: "FATAL",
+		Code:                "28P01",
+		Message:             fmt.Sprintf("password authentication failed for user %q", user),
+	})
+	return err
+}
+
+func computeHMAC(key, msg []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(msg)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,335 @@
+package pgsnap
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestSnap_withAuthSCRAM(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthSCRAM, "secret"))
+	defer s.Finish()
+
+	db, err := connectWithPassword(s.DSN(), "secret")
+	require.NoError(t, err)
+
+	err = db.Ping(context.TODO())
+	require.NoError(t, err)
+}
+
+func TestSnap_withAuthSCRAMWrongPassword(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthSCRAM, "secret"))
+
+	_, err := connectWithPassword(s.DSN(), "not-secret")
+	assert.Error(t, err)
+
+	assert.Error(t, s.Wait())
+}
+
+func TestSnap_withSCRAMParams(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthSCRAM, "secret"), WithSCRAMParams([]byte("0123456789abcdef"), 1000, "server-nonce"))
+	defer s.Finish()
+
+	db, err := connectWithPassword(s.DSN(), "secret")
+	require.NoError(t, err)
+
+	err = db.Ping(context.TODO())
+	require.NoError(t, err)
+}
+
+func Test_scramAuthStepParams(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	a := &scramAuthStep{password: "secret", params: scramParams{salt: []byte("salt"), iterations: 1000, nonce: "server-nonce"}}
+	go a.Step(pgproto3.NewBackend(pgproto3.NewChunkReader(server), server))
+
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(client), client)
+	msg, err := fe.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationSASL{}, msg)
+
+	require.NoError(t, fe.Send(&pgproto3.SASLInitialResponse{AuthMechanism: scramMechanism, Data: []byte("n,,n=,r=client-nonce")}))
+	msg, err = fe.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationSASLContinue{}, msg)
+	assert.Equal(t, "r=client-nonceserver-nonce,s=c2FsdA==,i=1000", string(msg.(*pgproto3.AuthenticationSASLContinue).Data))
+}
+
+func TestSnap_withAuthMD5(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthMD5, "secret"), WithMD5Salt([4]byte{1, 2, 3, 4}))
+	defer s.Finish()
+
+	db, err := connectWithPassword(s.DSN(), "secret")
+	require.NoError(t, err)
+
+	err = db.Ping(context.TODO())
+	require.NoError(t, err)
+}
+
+func TestSnap_withAuthMD5WrongPassword(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthMD5, "secret"))
+
+	_, err := connectWithPassword(s.DSN(), "not-secret")
+	require.Error(t, err)
+	// the client doesn't get the hash of the snapshot
+	assert.Contains(t, err.Error(), `password authentication failed for user "user"`)
+	assert.NotContains(t, err.Error(), "md5")
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "md5: password mismatch")
+}
+
+func TestSnap_withAuthCleartext(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthCleartext, "secret"))
+	defer s.Finish()
+
+	db, err := connectWithPassword(s.DSN(), "secret")
+	require.NoError(t, err)
+
+	err = db.Ping(context.TODO())
+	require.NoError(t, err)
+}
+
+func TestSnap_withAuthCleartextWrongPassword(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthCleartext, "secret"))
+
+	_, err := connectWithPassword(s.DSN(), "not-secret")
+	require.Error(t, err)
+	// the client doesn't get the password of the snapshot
+	assert.Contains(t, err.Error(), `password authentication failed for user "user"`)
+	assert.NotContains(t, err.Error(), "secret")
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cleartext: password mismatch:\n  got:  not-secret\n  want: secret")
+}
+
+func Test_md5Password(t *testing.T) {
+	assert.Equal(t, "md5fccef98e4f1cf6cbe96b743fad4e8bd0", md5Password("secret", "user", [4]byte{1, 2, 3, 4}))
+}
+
+func connectWithPassword(addr, password string) (*pgx.Conn, error) {
+	config, err := pgx.ParseConfig(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	config.Password = password
+
+	return pgx.ConnectConfig(context.TODO(), config)
+}
+
+func TestSnap_DSNWithAuth(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthSCRAM, "p@ss word"))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+
+	err = db.Ping(context.TODO())
+	require.NoError(t, err)
+}
+
+func TestSnap_withAuthSCRAMTLS(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthSCRAM, "secret"), WithTLS(nil))
+	defer s.Finish()
+
+	// pgx v4 doesn't support channel binding, it chooses SCRAM-SHA-256
+	db, err := connectWithPassword(s.DSN(), "secret")
+	require.NoError(t, err)
+
+	err = db.Ping(context.TODO())
+	require.NoError(t, err)
+}
+
+func TestSnap_withAuthSCRAMPlus(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthSCRAM, "secret"), WithTLS(nil))
+	defer s.Finish()
+
+	c := dialSCRAM(t, s)
+	defer c.conn.Close()
+	assert.Equal(t, []string{scramPlusMechanism, scramMechanism}, c.mechanisms)
+
+	require.NoError(t, c.authenticate(scramPlusMechanism, "p=tls-server-end-point", "secret"))
+
+	require.NoError(t, c.fe.Send(&pgproto3.Query{String: ";"}))
+	receiveTypes(t, c.fe, &pgproto3.EmptyQueryResponse{}, &pgproto3.ReadyForQuery{})
+	require.NoError(t, c.fe.Send(&pgproto3.Terminate{}))
+}
+
+func TestSnap_withAuthSCRAMPlusMismatch(t *testing.T) {
+	tests := map[string]struct {
+		mechanism, flag string
+		endPoint        []byte
+		err             string
+	}{
+		"downgrade": {
+			mechanism: scramMechanism,
+			flag:      "y",
+			err:       "scram: the client supports channel binding, but didn't use it",
+		},
+		"other certificate": {
+			mechanism: scramPlusMechanism,
+			flag:      "p=tls-server-end-point",
+			endPoint:  []byte("other"),
+			err:       "scram: channel binding mismatch in client-final-message",
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot), WithAuth(AuthSCRAM, "secret"), WithTLS(nil))
+
+			c := dialSCRAM(t, s)
+			defer c.conn.Close()
+			if tt.endPoint != nil {
+				c.endPoint = tt.endPoint
+			}
+
+			assert.Error(t, c.authenticate(tt.mechanism, tt.flag, "secret"))
+
+			err := s.Wait()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.err)
+		})
+	}
+}
+
+// scramClient is the client side of SCRAM over TLS, which pgx v4 can't do
+// with channel binding
+type scramClient struct {
+	conn       *tls.Conn
+	fe         *pgproto3.Frontend
+	mechanisms []string
+
+	// endPoint is the tls-server-end-point of the certificate of s
+	endPoint []byte
+}
+
+// dialSCRAM connect to s with TLS, and return the client once it's asked
+// to authenticate with SASL
+func dialSCRAM(t *testing.T, s *Snap) *scramClient {
+	t.Helper()
+
+	raw, err := net.Dial("tcp", s.Addr())
+	require.NoError(t, err)
+
+	_, err = raw.Write(sslRequest)
+	require.NoError(t, err)
+	b := make([]byte, 1)
+	_, err = io.ReadFull(raw, b)
+	require.NoError(t, err)
+	require.Equal(t, "S", string(b))
+
+	conn := tls.Client(raw, &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, conn.Handshake())
+
+	cert := conn.ConnectionState().PeerCertificates[0]
+	endPoint := sha256.Sum256(cert.Raw)
+
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	require.NoError(t, fe.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "user"},
+	}))
+
+	msg, err := fe.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.AuthenticationSASL{}, msg)
+
+	return &scramClient{
+		conn:       conn,
+		fe:         fe,
+		mechanisms: msg.(*pgproto3.AuthenticationSASL).AuthMechanisms,
+		endPoint:   endPoint[:],
+	}
+}
+
+// authenticate do SCRAM with mechanism and the channel binding flag of the
+// gs2 header, until ReadyForQuery
+func (c *scramClient) authenticate(mechanism, flag, password string) error {
+	gs2Header := flag + ",,"
+	clientFirstBare := "n=,r=client-nonce"
+	err := c.fe.Send(&pgproto3.SASLInitialResponse{AuthMechanism: mechanism, Data: []byte(gs2Header + clientFirstBare)})
+	if err != nil {
+		return err
+	}
+
+	msg, err := c.fe.Receive()
+	if err != nil {
+		return err
+	}
+	cont, ok := msg.(*pgproto3.AuthenticationSASLContinue)
+	if !ok {
+		return fmt.Errorf("got %#v", msg)
+	}
+
+	serverFirst := string(cont.Data)
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch {
+		case strings.HasPrefix(attr, "r="):
+			nonce = attr[2:]
+		case strings.HasPrefix(attr, "s="):
+			salt = attr[2:]
+		case strings.HasPrefix(attr, "i="):
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	rawSalt, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return err
+	}
+
+	cbind := []byte(gs2Header)
+	if strings.HasPrefix(flag, "p=") {
+		cbind = append(cbind, c.endPoint...)
+	}
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(cbind) + ",r=" + nonce
+
+	saltedPassword := pbkdf2.Key([]byte(password), rawSalt, iterations, sha256.Size, sha256.New)
+	clientKey := computeHMAC(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	signature := computeHMAC(storedKey[:], []byte(clientFirstBare+","+serverFirst+","+withoutProof))
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+
+	err = c.fe.Send(&pgproto3.SASLResponse{Data: []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))})
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := c.fe.Receive()
+		if err != nil {
+			return err
+		}
+		switch m := msg.(type) {
+		case *pgproto3.ErrorResponse:
+			return errors.New(m.Message)
+		case *pgproto3.ReadyForQuery:
+			return nil
+		}
+	}
+}
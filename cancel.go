@@ -0,0 +1,184 @@
+package pgsnap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+)
+
+// cancelRequestCode is the code of CancelRequest, sent by the client on a
+// new connection to cancel the query running in another connection
+var cancelRequestCode = []byte{0, 0, 0, 16, 0x04, 0xd2, 0x16, 0x2e}
+
+const queryCanceled = "57014"
+
+// cancelListener accept connections in the background, so CancelRequest
+// is handled even when every connection in the script is busy. Other
+// connections are returned by Accept in the order they come.
+type cancelListener struct {
+	net.Listener
+	s     *Snap
+	conns chan net.Conn
+	err   chan error
+}
+
+func (s *Snap) newCancelListener(l net.Listener) *cancelListener {
+	cl := &cancelListener{
+		Listener: l,
+		s:        s,
+		conns:    make(chan net.Conn, 100),
+		err:      make(chan error, 1),
+	}
+
+	s.start(cl.run)
+
+	return cl
+}
+
+func (cl *cancelListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-cl.conns:
+		return conn, nil
+	case err := <-cl.err:
+		cl.err <- err
+		return nil, err
+	}
+}
+
+func (cl *cancelListener) run() {
+	for {
+		conn, err := cl.Listener.Accept()
+		if err != nil {
+			cl.err <- err
+			return
+		}
+
+		conn, cancel, err := cl.peekCancel(conn)
+		if err != nil {
+			conn.Close()
+			continue
+		}
+
+		if cancel != nil {
+			conn.Close()
+			cl.s.handleCancel(cancel)
+			continue
+		}
+
+		cl.conns <- conn
+	}
+}
+
+// peekCancel read the CancelRequest when it's the first message sent by
+// the client, otherwise return conn with the peeked bytes kept
+func (cl *cancelListener) peekCancel(conn net.Conn) (net.Conn, *pgproto3.CancelRequest, error) {
+	if cl.s.cfg.timeout > 0 {
+		_ = conn.SetReadDeadline(time.Now().Add(cl.s.cfg.timeout))
+	}
+
+	r := bufio.NewReader(conn)
+	buffered := &bufferedConn{Conn: conn, r: r}
+
+	b, err := r.Peek(len(cancelRequestCode))
+	if err != nil || !bytes.Equal(b, cancelRequestCode) {
+		return buffered, nil, nil
+	}
+
+	b = make([]byte, 16)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return conn, nil, err
+	}
+
+	cancel := &pgproto3.CancelRequest{}
+	if err := cancel.Decode(b[4:]); err != nil {
+		return conn, nil, err
+	}
+
+	return conn, cancel, nil
+}
+
+// handleCancel check the key of cancel against BackendKeyData sent to the
+// clients, and cancel the running query
+func (s *Snap) handleCancel(cancel *pgproto3.CancelRequest) {
+	if cancel.ProcessID != s.cfg.backendPID || cancel.SecretKey != s.cfg.backendSecret {
+		s.report(fmt.Errorf("pgsnap: CancelRequest with unknown key: pid %d, secret %d", cancel.ProcessID, cancel.SecretKey))
+		return
+	}
+
+	if s.writeMode {
+		s.cancelUpstream()
+		return
+	}
+
+	select {
+	case s.cancels <- struct{}{}:
+	default:
+	}
+}
+
+// isCancel tell whether msg is the error sent by postgres when the query
+// is canceled by CancelRequest (and not by statement_timeout)
+func isCancel(msg pgproto3.BackendMessage) bool {
+	e, ok := msg.(*pgproto3.ErrorResponse)
+	return ok && e.Code == queryCanceled && strings.Contains(e.Message, "user request")
+}
+
+// cancelStep wait for the client to cancel the query before sending the
+// error recorded when the query was canceled
+type cancelStep struct {
+	s   *Snap
+	msg *pgproto3.ErrorResponse
+}
+
+func (c *cancelStep) Step(be *pgproto3.Backend) error {
+	var timeout <-chan time.Time
+	if c.s.cfg.timeout > 0 {
+		timeout = time.After(c.s.cfg.timeout)
+	}
+
+	select {
+	case <-c.s.cancels:
+	case <-c.s.closed:
+		return ErrClosed
+	case <-timeout:
+		return errors.New("pgsnap: the query is not canceled by the client")
+	}
+
+	return be.Send(c.msg)
+}
+
+// cancelUpstream cancel the query running in every connection to the real
+// postgres while recording
+func (s *Snap) cancelUpstream() {
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+
+	for db := range s.upstreams {
+		if err := db.PgConn().CancelRequest(context.TODO()); err != nil {
+			s.report(err)
+		}
+	}
+}
+
+func (s *Snap) addUpstream(db *pgx.Conn) {
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+
+	s.upstreams[db] = struct{}{}
+}
+
+func (s *Snap) removeUpstream(db *pgx.Conn) {
+	s.upstreamsMu.Lock()
+	defer s.upstreamsMu.Unlock()
+
+	delete(s.upstreams, db)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/egon12/pgsnap"
+	_ "github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const addr = "postgres://postgres@127.0.0.1:15432/?sslmode=disable"
+
+// TestHelperProcess is the command run by record, it's skipped when it's
+// not run by record
+func TestHelperProcess(t *testing.T) {
+	url := os.Getenv("DATABASE_URL")
+	if url == "" {
+		t.Skip("run by TestRun_record")
+	}
+
+	db, err := sql.Open("postgres", url)
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Ping())
+
+	var one int
+	require.NoError(t, db.QueryRow("select 1").Scan(&one))
+}
+
+func TestRun_record(t *testing.T) {
+	// the replay of TestRun_record.txt act as the real postgres
+	upstream := pgsnap.NewSnap(t, addr)
+	defer upstream.Finish()
+
+	out := filepath.Join(t.TempDir(), "snapshot.txt")
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"record", "--dsn", upstream.DSN(), "--out", out, "--format", "text", "--", os.Args[0], "-test.run=TestHelperProcess"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stderr.String())
+	assert.Contains(t, stderr.String(), "pgsnap: recorded "+out)
+
+	recorded, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Contains(t, string(recorded), "V1 auth=trust\n")
+	assert.Contains(t, string(recorded), ">>> select 1\n")
+	assert.Contains(t, string(recorded), "| 1 |\n")
+
+	// the recording is replayed by the library
+	f, err := os.Open(out)
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Empty(t, pgsnap.Lint(f))
+}
+
+func TestRun_recordOut(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"record", "--dsn", addr, "--out", "snapshot.json"}, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "pgsnap: --out must end with .txt, .yaml or .pgsnap.gz: snapshot.json\n", stderr.String())
+}
+
+func TestRun_print(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"print", "TestRun_record.txt"}, &stdout, &stderr)
+	require.Equal(t, 0, code, stderr.String())
+	assert.Equal(t, `>>> ;
+B {"Type":"EmptyQueryResponse"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+>>> select 1
+B {"Type":"RowDescription","Fields":[{"Name":"?column?","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+| 1 |
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`, stdout.String())
+}
+
+func TestRun_lint(t *testing.T) {
+	bad := filepath.Join(t.TempDir(), "bad.txt")
+	require.NoError(t, os.WriteFile(bad, []byte(`F {"Type":"Parse","Name":"","Query":"select 1","ParameterOIDs":null}
+X
+`), 0644))
+
+	var stdout, stderr bytes.Buffer
+	code := run([]string{"lint", "TestRun_record.txt", bad}, &stdout, &stderr)
+	assert.Equal(t, 1, code)
+	assert.Equal(t, bad+":2: unknown line: X\n", stdout.String())
+	assert.Equal(t, "pgsnap: found 1 problems\n", stderr.String())
+}
+
+func TestSession(t *testing.T) {
+	var stderr bytes.Buffer
+	code, cleaned := -1, 0
+	s := &session{name: "snapshot", stderr: &stderr, exit: func(c int) { code = c }}
+	s.Cleanup(func() { cleaned++ })
+
+	s.Logf("pgsnap: %s", "logged")
+	assert.Equal(t, -1, code)
+
+	s.Fatalf("pgsnap: %s", "failed")
+	assert.Equal(t, 1, code)
+	assert.Equal(t, "pgsnap: logged\npgsnap: failed\n", stderr.String())
+
+	// the cleanup isn't called again when the command returns
+	s.cleanup()
+	assert.Equal(t, 1, cleaned)
+
+	code = -1
+	s.Skipf("pgsnap: %s", "skipped")
+	assert.Equal(t, 1, code)
+}
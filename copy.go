@@ -0,0 +1,138 @@
+package pgsnap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// unmarshalCopyData decode CopyData written by pgproto3, which marshal
+// Data as hex but doesn't decode it back
+func unmarshalCopyData(src []byte) (*pgproto3.CopyData, error) {
+	var msg struct {
+		Data string
+	}
+	if err := json.Unmarshal(src, &msg); err != nil {
+		return nil, err
+	}
+
+	data, err := hex.DecodeString(msg.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pgproto3.CopyData{Data: data}, nil
+}
+
+// unmarshalCopyInResponse decode CopyInResponse written by pgproto3, which
+// doesn't marshal OverallFormat. When it's missing, the format is taken
+// from the column formats.
+func unmarshalCopyInResponse(src []byte) (*pgproto3.CopyInResponse, error) {
+	format, codes, err := unmarshalCopyFormat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pgproto3.CopyInResponse{OverallFormat: format, ColumnFormatCodes: codes}, nil
+}
+
+// unmarshalCopyOutResponse is like unmarshalCopyInResponse for COPY TO
+func unmarshalCopyOutResponse(src []byte) (*pgproto3.CopyOutResponse, error) {
+	format, codes, err := unmarshalCopyFormat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pgproto3.CopyOutResponse{OverallFormat: format, ColumnFormatCodes: codes}, nil
+}
+
+func unmarshalCopyFormat(src []byte) (byte, []uint16, error) {
+	var msg struct {
+		OverallFormat     *string
+		ColumnFormatCodes []uint16
+	}
+	if err := json.Unmarshal(src, &msg); err != nil {
+		return 0, nil, err
+	}
+
+	var format byte
+	if msg.OverallFormat != nil && len(*msg.OverallFormat) == 1 {
+		format = (*msg.OverallFormat)[0]
+	} else {
+		for _, code := range msg.ColumnFormatCodes {
+			if code != 0 {
+				format = 1
+			}
+		}
+	}
+
+	return format, msg.ColumnFormatCodes, nil
+}
+
+// copyDataStep expect the client to send the data of COPY FROM STDIN as
+// one stream, no matter how the client split it into CopyData messages.
+// It's used for consecutive CopyData in the script with WithCopyDataStream.
+type copyDataStep struct {
+	want []byte
+	file string
+	line int
+}
+
+func (c *copyDataStep) Step(be *pgproto3.Backend) error {
+	return c.stepSession(newSession(be))
+}
+
+func (c *copyDataStep) stepSession(sess *session) error {
+	var got []byte
+
+	for len(got) < len(c.want) {
+		msg, err := sess.be.Receive()
+		if err != nil {
+			return err
+		}
+		sess.received(msg)
+
+		cd, ok := msg.(*pgproto3.CopyData)
+		if !ok {
+			return &MismatchError{File: c.file, Line: c.line, Want: &pgproto3.CopyData{Data: c.want}, Got: msg}
+		}
+
+		got = append(got, cd.Data...)
+	}
+
+	if !bytes.Equal(got, c.want) {
+		return &MismatchError{File: c.file, Line: c.line, Want: &pgproto3.CopyData{Data: c.want}, Got: &pgproto3.CopyData{Data: got}}
+	}
+
+	return nil
+}
+
+// appendStep add step to script. With WithCopyDataStream, CopyData
+// expected right after another CopyData is merged into one copyDataStep.
+func (s *Snap) appendStep(script *pgmock.Script, step pgmock.Step) {
+	e, ok := step.(*expectStep)
+	if !ok || !s.cfg.copyDataStream {
+		script.Steps = append(script.Steps, step)
+		return
+	}
+
+	cd, ok := e.want.(*pgproto3.CopyData)
+	if !ok {
+		script.Steps = append(script.Steps, step)
+		return
+	}
+
+	if last, ok := script.Steps[len(script.Steps)-1].(*copyDataStep); ok {
+		last.want = append(last.want, cd.Data...)
+		return
+	}
+
+	script.Steps = append(script.Steps, &copyDataStep{
+		want: append([]byte(nil), cd.Data...),
+		file: e.file,
+		line: e.line,
+	})
+}
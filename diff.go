@@ -0,0 +1,316 @@
+package pgsnap
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+const (
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorReset = "\x1b[0m"
+)
+
+// MismatchError is returned by Wait when the client send a message
+// different from the one in the snapshot. It's rendered as a diff of the
+// two messages.
+type MismatchError struct {
+	// File and Line of Want in the snapshot, Line is 0 for the startup
+	// done by pgsnap
+	File string
+	Line int
+
+	// Step is the number of the step of the connection (counted from 1,
+	// startup excluded), 0 for the startup
+	Step int
+
+	Want pgproto3.FrontendMessage
+	Got  pgproto3.FrontendMessage
+
+	// params is the typed parameters of want Bind, to show the parameters
+	// as typed values
+	params []bindParam
+}
+
+func (e *MismatchError) Error() string {
+	return e.format(useColor())
+}
+
+// format render the diff, with ANSI color when color is true
+func (e *MismatchError) format(color bool) string {
+	var b strings.Builder
+
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "pgsnap: %s:%d: ", e.File, e.Line)
+	} else {
+		// the startup done by pgsnap has no line in the snapshot
+		fmt.Fprintf(&b, "pgsnap: %s: ", e.File)
+	}
+
+	wantType, gotType := messageType(e.Want), messageType(e.Got)
+	if wantType != gotType {
+		fmt.Fprintf(&b, "want %s, got %s\n", wantType, gotType)
+		writeDiffLine(&b, color, "-", "", marshalMessage(e.Want))
+		writeDiffLine(&b, color, "+", "", marshalMessage(e.Got))
+		return strings.TrimSuffix(b.String(), "\n")
+	}
+
+	fmt.Fprintf(&b, "%s doesn't match the snapshot\n", wantType)
+	b.WriteString("--- want (snapshot)\n+++ got (client)\n")
+
+	for _, d := range diffValue("", reflect.ValueOf(e.Want), reflect.ValueOf(e.Got)) {
+		d = e.typedParam(d)
+		if d.offset > 0 {
+			// the offset is only worth showing after a common prefix
+			fmt.Fprintf(&b, "  %s (byte %d):\n", d.path, d.offset)
+		} else {
+			fmt.Fprintf(&b, "  %s:\n", d.path)
+		}
+		writeDiffLine(&b, color, "-", "  ", d.want)
+		writeDiffLine(&b, color, "+", "  ", d.got)
+	}
+
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// Diverge return the first field that differs, like "Parameters[3]", and
+// the offset of its first byte that differs, as shown by Error. The offset
+// is -1 when the field isn't bytes, or it's a typed parameter of Bind.
+func (e *MismatchError) Diverge() (field string, offset int) {
+	if messageType(e.Want) != messageType(e.Got) {
+		return "", -1
+	}
+
+	diffs := diffValue("", reflect.ValueOf(e.Want), reflect.ValueOf(e.Got))
+	if len(diffs) == 0 {
+		return "", -1
+	}
+	d := e.typedParam(diffs[0])
+	return d.path, d.offset
+}
+
+// typedParam show the diff of parameter of Bind as typed values, when the
+// parameter is typed in the snapshot
+func (e *MismatchError) typedParam(d fieldDiff) fieldDiff {
+	var i int
+	if _, err := fmt.Sscanf(d.path, "Parameters[%d]", &i); err != nil || i >= len(e.params) {
+		return d
+	}
+
+	want, ok1 := e.Want.(*pgproto3.Bind)
+	got, ok2 := e.Got.(*pgproto3.Bind)
+	if !ok1 || !ok2 {
+		return d
+	}
+
+	p := e.params[i]
+	if v, ok := p.decode(want.Parameters[i], paramFormat(want.ParameterFormatCodes, i)); ok {
+		d.want = v
+		// the offset is in the bytes, not in the typed value
+		d.offset = -1
+	}
+	if v, ok := p.decode(got.Parameters[i], paramFormat(got.ParameterFormatCodes, i)); ok {
+		d.got = v
+	}
+	return d
+}
+
+func writeDiffLine(b *strings.Builder, color bool, sign, indent, value string) {
+	if color {
+		c := colorRed
+		if sign == "+" {
+			c = colorGreen
+		}
+		fmt.Fprintf(b, "%s%s %s%s%s\n", c, sign, indent, value, colorReset)
+		return
+	}
+
+	fmt.Fprintf(b, "%s %s%s\n", sign, indent, value)
+}
+
+// fieldDiff is one field that differ between want and got
+type fieldDiff struct {
+	path string
+	want string
+	got  string
+
+	// offset is the first byte that differs when the field is bytes, -1
+	// otherwise
+	offset int
+}
+
+// diffWindow is the bytes shown around the offset of a long value, so a
+// big CopyData or parameter isn't printed whole
+const diffWindow = 32
+
+// newFieldDiff return the diff of the field at path, with the values
+// around the first byte that differs when they're long
+func newFieldDiff(path string, want, got reflect.Value) fieldDiff {
+	d := fieldDiff{path: path, offset: diffOffset(want, got)}
+	d.want, d.got = formatValueAt(want, d.offset), formatValueAt(got, d.offset)
+	return d
+}
+
+// diffOffset return the offset of the first byte that differs in want and
+// got when they're both bytes, or -1
+func diffOffset(want, got reflect.Value) int {
+	a, ok1 := rawBytes(want)
+	b, ok2 := rawBytes(got)
+	if !ok1 || !ok2 {
+		return -1
+	}
+
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// rawBytes return the bytes of v when it's []byte that isn't null
+func rawBytes(v reflect.Value) ([]byte, bool) {
+	if !v.IsValid() || v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Uint8 || v.IsNil() {
+		return nil, false
+	}
+	return v.Bytes(), true
+}
+
+// formatValueAt is formatValue, with only diffWindow bytes around offset
+// when v is longer than twice diffWindow
+func formatValueAt(v reflect.Value, offset int) string {
+	b, ok := rawBytes(v)
+	if !ok || offset < 0 || len(b) <= 2*diffWindow {
+		return formatValue(v)
+	}
+
+	start, end := offset-diffWindow, offset+diffWindow
+	if start < 0 {
+		start = 0
+	}
+	if end > len(b) {
+		end = len(b)
+	}
+
+	var w strings.Builder
+	if start > 0 {
+		w.WriteString("...")
+	}
+	fmt.Fprintf(&w, "%q", b[start:end])
+	if end < len(b) {
+		w.WriteString("...")
+	}
+	return w.String()
+}
+
+// diffValue list the fields of want and got that don't match, using the
+// same rule as match
+func diffValue(path string, want, got reflect.Value) []fieldDiff {
+	if matchValue(want, got) {
+		return nil
+	}
+
+	if !want.IsValid() || !got.IsValid() || want.Type() != got.Type() {
+		return []fieldDiff{newFieldDiff(path, want, got)}
+	}
+
+	switch want.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if !want.IsNil() && !got.IsNil() {
+			return diffValue(path, want.Elem(), got.Elem())
+		}
+
+	case reflect.Struct:
+		var diffs []fieldDiff
+		for i := 0; i < want.NumField(); i++ {
+			name := want.Type().Field(i).Name
+			if path != "" {
+				name = path + "." + name
+			}
+			diffs = append(diffs, diffValue(name, want.Field(i), got.Field(i))...)
+		}
+		return diffs
+
+	case reflect.Map:
+		keys := map[string]reflect.Value{}
+		for _, k := range append(want.MapKeys(), got.MapKeys()...) {
+			keys[fmt.Sprint(k.Interface())] = k
+		}
+		names := make([]string, 0, len(keys))
+		for name := range keys {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var diffs []fieldDiff
+		for _, name := range names {
+			k := keys[name]
+			diffs = append(diffs, diffValue(path+"."+name, want.MapIndex(k), got.MapIndex(k))...)
+		}
+		return diffs
+
+	case reflect.Slice:
+		if want.Type().Elem().Kind() != reflect.Uint8 && want.Len() == got.Len() {
+			var diffs []fieldDiff
+			for i := 0; i < want.Len(); i++ {
+				diffs = append(diffs, diffValue(fmt.Sprintf("%s[%d]", path, i), want.Index(i), got.Index(i))...)
+			}
+			return diffs
+		}
+	}
+
+	return []fieldDiff{newFieldDiff(path, want, got)}
+}
+
+func formatValue(v reflect.Value) string {
+	if !v.IsValid() {
+		return "<nil>"
+	}
+
+	if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+		if v.IsNil() {
+			return "null"
+		}
+		return fmt.Sprintf("%q", v.Bytes())
+	}
+
+	// a byte field, like ObjectType of Describe, is a letter in the
+	// snapshot
+	if v.Kind() == reflect.Uint8 {
+		return fmt.Sprintf("%q", string(rune(v.Uint())))
+	}
+
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprintf("%#v", v.Interface())
+	}
+	return string(b)
+}
+
+func marshalMessage(msg pgproto3.Message) string {
+	b, err := marshalJSON(msg)
+	if err != nil {
+		return fmt.Sprintf("%#v", msg)
+	}
+	return string(b)
+}
+
+// useColor tell whether the diff is colored, which is when stdout is a
+// terminal and NO_COLOR is not set
+func useColor() bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	fi, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -3,10 +3,14 @@ module github.com/egon12/pgsnap
 go 1.16
 
 require (
+	github.com/jackc/pgconn v1.10.0
 	github.com/jackc/pgmock v0.0.0-20210724152146-4ad1a8207f65
-	github.com/jackc/pgproto3/v2 v2.1.1
+	github.com/jackc/pgproto3/v2 v2.2.0
 	github.com/jackc/pgx/v4 v4.13.0
 	github.com/lib/pq v1.10.4
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/stretchr/testify v1.7.0
+	go.uber.org/goleak v1.1.12
+	golang.org/x/crypto v0.0.0-20210711020723-a769d52b0f97
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -0,0 +1,54 @@
+package pgsnap
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+)
+
+// gzipExt is the extension of compressed snapshot, see WithGzip
+const gzipExt = ".pgsnap.gz"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// gunzip decompress b when it's compressed with gzip, otherwise return b
+// as it is
+func gunzip(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, gzipMagic) {
+		return b, nil
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+// gunzipReader return r uncompressed, when it's compressed with gzip
+func gunzipReader(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(len(gzipMagic)); !bytes.Equal(magic, gzipMagic) {
+		return br, nil
+	}
+	return gzip.NewReader(br)
+}
+
+// gzipBytes compress b. The header has no name nor time, so the same
+// snapshot is always compressed to the same bytes.
+func gzipBytes(b []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(b); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,88 @@
+package pgsnap
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// scriptVersion is the first line of recorded snapshot, e.g. "V1 auth=md5".
+// Snapshot with the header has the startup of every connection written
+// in it, snapshot without it get the startup done by the options.
+const scriptVersion = "V1"
+
+// authNames is the name of AuthMethod in the header
+var authNames = map[AuthMethod]string{
+	AuthTrust:     "trust",
+	AuthSCRAM:     "scram",
+	AuthMD5:       "md5",
+	AuthCleartext: "cleartext",
+}
+
+func (m AuthMethod) String() string {
+	if name, ok := authNames[m]; ok {
+		return name
+	}
+	return fmt.Sprintf("AuthMethod(%d)", int(m))
+}
+
+// header is the first line of V1 snapshot
+type header struct {
+	auth AuthMethod
+}
+
+func isHeader(b []byte) bool {
+	return bytes.Equal(b, []byte(scriptVersion)) || bytes.HasPrefix(b, []byte(scriptVersion+" "))
+}
+
+func parseHeader(b []byte) (header, error) {
+	h := header{}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 || fields[0] != scriptVersion {
+		return h, fmt.Errorf("unknown version")
+	}
+
+	for _, field := range fields[1:] {
+		eq := strings.IndexByte(field, '=')
+		if eq < 0 {
+			return h, fmt.Errorf("invalid header field %q", field)
+		}
+
+		name, value := field[:eq], field[eq+1:]
+		switch name {
+		case "auth":
+			auth, ok := authByName(value)
+			if !ok {
+				return h, fmt.Errorf("unknown auth %q", value)
+			}
+			h.auth = auth
+		default:
+			return h, fmt.Errorf("unknown header field %q", name)
+		}
+	}
+
+	return h, nil
+}
+
+func (h header) String() string {
+	return scriptVersion + " auth=" + h.auth.String()
+}
+
+func authByName(name string) (AuthMethod, bool) {
+	for m, n := range authNames {
+		if n == name {
+			return m, true
+		}
+	}
+	return 0, false
+}
+
+// checkHeader make sure the snapshot can be replayed with the options,
+// i.e. WithAuth is set to the authentication it's recorded with
+func (s *Snap) checkHeader(h header) error {
+	if h.auth != s.cfg.auth {
+		return fmt.Errorf("snapshot is recorded with %s authentication, but WithAuth is set to %s", h.auth, s.cfg.auth)
+	}
+	return nil
+}
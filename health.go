@@ -0,0 +1,136 @@
+package pgsnap
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// DefaultHealthChecks is the queries answered by WithIgnoreHealthChecks
+// when it's used without patterns: the ping of lib/pq, the usual health
+// check of the pools and the ping of pgx
+var DefaultHealthChecks = []string{";", "SELECT 1", "-- ping"}
+
+// DefaultResetQueries is the queries answered by WithIgnoreResetQueries
+// when it's used without patterns, sent by the pools to reset the
+// connection before it's used again
+var DefaultResetQueries = []string{"DISCARD ALL", "RESET ALL", "UNLISTEN *", "DEALLOCATE ALL"}
+
+// healthCheck is query sent by the pool to check the connection, which
+// is answered without running the steps, see WithIgnoreHealthChecks
+type healthCheck struct {
+	// pattern match the SQL, or sql is compared ignoring whitespace and
+	// case
+	pattern *regexp.Regexp
+	sql     string
+}
+
+// compileHealthChecks return the health checks of patterns, which are
+// written like the SQL of the snapshot, with QueryPatternPrefix for
+// regular expression
+func compileHealthChecks(patterns []string) ([]healthCheck, error) {
+	var checks []healthCheck
+	for _, p := range patterns {
+		re, err := queryPattern(&pgproto3.Query{String: p})
+		if err != nil {
+			return nil, err
+		}
+		checks = append(checks, healthCheck{pattern: re, sql: strings.ToLower(normalizeSQL(p))})
+	}
+	return checks, nil
+}
+
+// isHealthCheck tell whether msg is Query matching one of checks
+func isHealthCheck(checks []healthCheck, msg pgproto3.FrontendMessage) bool {
+	q, ok := msg.(*pgproto3.Query)
+	if !ok {
+		return false
+	}
+
+	sql := strings.ToLower(normalizeSQL(q.String))
+	for _, c := range checks {
+		if c.pattern != nil && c.pattern.MatchString(q.String) || c.pattern == nil && c.sql == sql {
+			return true
+		}
+	}
+	return false
+}
+
+// expects tell whether msg is the Query of the step, so the health check
+// recorded in the snapshot is still replayed
+func (e *expectStep) expects(msg pgproto3.FrontendMessage) bool {
+	_, ok := e.want.(*pgproto3.Query)
+	return ok && e.matchSQL(msg.(*pgproto3.Query).String)
+}
+
+// selectOne match SELECT 1, which is answered with its row
+var selectOne = regexp.MustCompile(`(?i)^select 1$`)
+
+// answerHealthCheck send the answer of postgres to health check q: no
+// result for the query without statement, the row of SELECT 1, or
+// CommandComplete for the other queries
+func (sess *session) answerHealthCheck(q *pgproto3.Query) error {
+	sql := normalizeSQL(q.String)
+
+	var msgs []pgproto3.BackendMessage
+	switch {
+	case isEmptySQL(q.String):
+		msgs = append(msgs, &pgproto3.EmptyQueryResponse{})
+	case selectOne.MatchString(sql):
+		msgs = append(msgs,
+			&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{
+				Name: []byte("?column?"), DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1,
+			}}},
+			&pgproto3.DataRow{Values: [][]byte{[]byte("1")}},
+			&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")},
+		)
+	default:
+		msgs = append(msgs, &pgproto3.CommandComplete{CommandTag: []byte(commandTag(q.String))})
+	}
+	msgs = append(msgs, &pgproto3.ReadyForQuery{TxStatus: sess.txStatus})
+
+	for _, msg := range msgs {
+		if err := sess.be.Send(msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// commandTag return the tag of CommandComplete sent by postgres for sql,
+// which has the first word of sql, and the kind of the DISCARD and of the
+// DEALLOCATE ALL
+func commandTag(sql string) string {
+	tag := strings.ToUpper(firstKeyword(sql))
+
+	words := strings.Fields(strings.ToUpper(normalizeSQL(sql)))
+	switch {
+	case tag == "SELECT":
+		return "SELECT 0"
+	case tag == "DISCARD" && len(words) > 1 && words[0] == tag:
+		return tag + " " + words[1]
+	case tag == "DEALLOCATE" && len(words) > 1 && words[0] == tag && words[len(words)-1] == "ALL":
+		return tag + " ALL"
+	}
+	return tag
+}
+
+// isEmptySQL tell whether sql has only semicolons and line comments, for
+// which postgres send EmptyQueryResponse
+func isEmptySQL(sql string) bool {
+	return firstKeyword(sql) == ""
+}
+
+// firstKeyword return the first word of sql that isn't in line comment
+func firstKeyword(sql string) string {
+	for _, line := range strings.Split(sql, "\n") {
+		if i := strings.Index(line, "--"); i >= 0 {
+			line = line[:i]
+		}
+		if f := strings.FieldsFunc(line, func(r rune) bool { return r == ';' || r <= ' ' }); len(f) > 0 {
+			return f[0]
+		}
+	}
+	return ""
+}
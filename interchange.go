@@ -0,0 +1,472 @@
+package pgsnap
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// interchange run the steps from i when the client send the query with the
+// other protocol than the snapshot, see WithAnyProtocol. It returns the
+// step to run next, or false when step i must be run as it is, with the
+// message received kept in the session.
+func (s *Snap) interchange(sess *session, steps []pgmock.Step, i int) (int, bool, error) {
+	e, ok := steps[i].(*expectStep)
+	if !ok || sess.pending != nil {
+		return i, false, nil
+	}
+
+	_, simple := e.want.(*pgproto3.Query)
+	if !simple && !startsExtended(e.want) {
+		return i, false, nil
+	}
+
+	msg, err := sess.be.Receive()
+	if err != nil {
+		return i, true, err
+	}
+
+	q, isQuery := msg.(*pgproto3.Query)
+	switch {
+	case simple && (startsExtended(msg) || isDescribeOrExecute(msg)):
+		next, err := s.extendedAsQuery(sess, steps, i, msg)
+		return next, true, err
+	case !simple && isQuery:
+		next, err := s.queryAsExtended(sess, steps, i, q)
+		return next, true, err
+	}
+
+	sess.pending = msg
+	return i, false, nil
+}
+
+func startsExtended(msg pgproto3.FrontendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.Parse, *pgproto3.Bind:
+		return true
+	}
+	return false
+}
+
+func isDescribeOrExecute(msg pgproto3.FrontendMessage) bool {
+	switch msg.(type) {
+	case *pgproto3.Describe, *pgproto3.Execute:
+		return true
+	}
+	return false
+}
+
+// matchSQL tell whether q is the SQL of Query or Parse want, compared like
+// stepSession does
+func (e *expectStep) matchSQL(q string) bool {
+	want, _ := queryOf(e.want)
+	switch {
+	case e.pattern != nil:
+		return e.pattern.MatchString(q)
+	case e.normalizeSQL:
+		return normalizeSQL(want) == normalizeSQL(q)
+	}
+	return want == q
+}
+
+// queryAsExtended answer Query q with the extended protocol messages
+// recorded from step i. The messages that only describe the statement,
+// sent by the client before executing it, are skipped.
+func (s *Snap) queryAsExtended(sess *session, steps []pgmock.Step, i int, q *pgproto3.Query) (int, error) {
+	sess.received(q)
+	if err := sess.runHook(q); err != nil {
+		return i, err
+	}
+
+	first := steps[i].(*expectStep)
+	mismatch := &MismatchError{File: first.file, Line: first.line, Want: first.want, Got: cloneMessage(q)}
+
+	for {
+		sync, end, ok := extendedExchange(steps, i)
+		if !ok {
+			return i, mismatch
+		}
+
+		parse, execute := scriptParse(steps, i, sync)
+		if parse == nil || !parse.matchSQL(q.String) {
+			return i, mismatch
+		}
+		if !execute {
+			i = end
+			continue
+		}
+
+		var rd *pgproto3.RowDescription
+		for _, step := range steps[sync+1 : end] {
+			if d, ok := step.(*delayStep); ok {
+				if err := sess.sleep(d.delay); err != nil {
+					return i, err
+				}
+				step = d.step
+			}
+
+			if r, ok := step.(*rowsStep); ok {
+				err := r.each(func(st *sendStep) error {
+					row, err := textDataRow(rd, st.msg.(*pgproto3.DataRow))
+					if err != nil {
+						return err
+					}
+					return (&sendStep{msg: row}).stepSession(sess)
+				})
+				if err != nil {
+					return i, err
+				}
+				continue
+			}
+
+			st, ok := step.(*sendStep)
+			if !ok {
+				if err := runStep(sess, step); err != nil {
+					return i, err
+				}
+				continue
+			}
+
+			var msg pgproto3.BackendMessage
+			var err error
+			switch m := st.msg.(type) {
+			case *pgproto3.ParseComplete, *pgproto3.BindComplete, *pgproto3.ParameterDescription, *pgproto3.NoData, *pgproto3.CloseComplete:
+				// not sent for Query
+				continue
+			case *pgproto3.PortalSuspended:
+				return i, fmt.Errorf("pgsnap: %s is executed with MaxRows, it can't be sent for Query", q.String)
+			case *pgproto3.RowDescription:
+				rd = m
+				msg = textRowDescription(m)
+			case *pgproto3.DataRow:
+				msg, err = textDataRow(rd, m)
+			default:
+				msg = m
+			}
+			if err != nil {
+				return i, err
+			}
+			if err := (&sendStep{msg: msg}).stepSession(sess); err != nil {
+				return i, err
+			}
+		}
+
+		return end, nil
+	}
+}
+
+// extendedExchange return the step of Sync of the messages sent by the
+// client from step i, and the step after ReadyForQuery that answer it
+func extendedExchange(steps []pgmock.Step, i int) (int, int, bool) {
+	sync := -1
+	for j := i; j < len(steps); j++ {
+		e, ok := steps[j].(*expectStep)
+		if !ok {
+			break
+		}
+		if _, ok := e.want.(*pgproto3.Sync); ok {
+			sync = j
+			break
+		}
+	}
+	if sync < 0 {
+		return 0, 0, false
+	}
+
+	for j := sync + 1; j < len(steps); j++ {
+		step := steps[j]
+		if d, ok := step.(*delayStep); ok {
+			step = d.step
+		}
+		switch step.(type) {
+		case *expectStep:
+			return 0, 0, false
+		case *readyForQueryStep:
+			return sync, j + 1, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// scriptParse return the Parse of the statement used by the messages from
+// step i to sync, which can be parsed before them, and whether they
+// execute it
+func scriptParse(steps []pgmock.Step, i, sync int) (*expectStep, bool) {
+	var parse *expectStep
+	var statement *string
+	execute := false
+
+	for _, step := range steps[i:sync] {
+		e := step.(*expectStep)
+		switch m := e.want.(type) {
+		case *pgproto3.Parse:
+			if parse == nil {
+				parse = e
+			}
+		case *pgproto3.Bind:
+			if statement == nil {
+				statement = &m.PreparedStatement
+			}
+		case *pgproto3.Execute:
+			execute = true
+		}
+	}
+
+	if parse != nil || statement == nil {
+		return parse, execute
+	}
+
+	for j := i - 1; j >= 0; j-- {
+		if e, ok := steps[j].(*expectStep); ok {
+			if p, ok := e.want.(*pgproto3.Parse); ok && p.Name == *statement {
+				return e, execute
+			}
+		}
+	}
+
+	return nil, execute
+}
+
+// extendedAsQuery answer the extended protocol messages of the client,
+// starting with msg, with the result of Query recorded in step i. The step
+// is kept when the client only describe the statement, as the client
+// execute it next.
+func (s *Snap) extendedAsQuery(sess *session, steps []pgmock.Step, i int, msg pgproto3.FrontendMessage) (int, error) {
+	var batch []pgproto3.FrontendMessage
+	for {
+		sess.received(msg)
+		if err := sess.runHook(msg); err != nil {
+			return i, err
+		}
+
+		batch = append(batch, cloneMessage(msg))
+		if _, ok := msg.(*pgproto3.Sync); ok {
+			break
+		}
+
+		var err error
+		if msg, err = sess.be.Receive(); err != nil {
+			return i, err
+		}
+	}
+
+	e := steps[i].(*expectStep)
+	mismatch := &MismatchError{File: e.file, Line: e.line, Want: e.want, Got: batch[0]}
+
+	q, ok := batchSQL(sess, batch)
+	if !ok || !e.matchSQL(q) {
+		return i, mismatch
+	}
+
+	end := -1
+	var rd pgproto3.BackendMessage = &pgproto3.NoData{}
+	var result []pgmock.Step
+	for j := i + 1; j < len(steps) && end < 0; j++ {
+		step := steps[j]
+		inner := step
+		if d, ok := step.(*delayStep); ok {
+			inner = d.step
+		}
+
+		switch st := inner.(type) {
+		case *expectStep:
+			return i, mismatch
+		case *readyForQueryStep:
+			end = j + 1
+		case *rowsStep:
+			// the rows are counted for MaxRows of Execute
+			rows, err := st.steps()
+			if err != nil {
+				return i, err
+			}
+			result = append(result, rows...)
+		case *sendStep:
+			if m, ok := st.msg.(*pgproto3.RowDescription); ok {
+				rd = m
+				continue
+			}
+			result = append(result, step)
+		default:
+			result = append(result, step)
+		}
+	}
+	if end < 0 {
+		return i, mismatch
+	}
+
+	send := func(msg pgproto3.BackendMessage) error {
+		return (&sendStep{msg: msg}).stepSession(sess)
+	}
+
+	executed := false
+	for _, m := range batch {
+		var err error
+		switch m := m.(type) {
+		case *pgproto3.Parse:
+			err = send(&pgproto3.ParseComplete{})
+		case *pgproto3.Bind:
+			err = send(&pgproto3.BindComplete{})
+		case *pgproto3.Describe:
+			if m.ObjectType == 'S' {
+				if err = send(&pgproto3.ParameterDescription{}); err != nil {
+					break
+				}
+			}
+			err = send(rd)
+		case *pgproto3.Execute:
+			executed = true
+			result, err = executeRows(sess, result, m.MaxRows)
+		case *pgproto3.Close:
+			err = send(&pgproto3.CloseComplete{})
+		case *pgproto3.Sync:
+			if executed {
+				err = runStep(sess, steps[end-1])
+			} else {
+				err = runStep(sess, &readyForQueryStep{msg: &pgproto3.ReadyForQuery{TxStatus: sess.txStatus}})
+			}
+		}
+		if err != nil {
+			return i, err
+		}
+	}
+
+	if executed {
+		return end, nil
+	}
+	return i, nil
+}
+
+// executeRows run the steps of result for Execute, and return the steps
+// left when the portal is suspended after maxRows DataRow, like postgres
+// does for Execute with MaxRows
+func executeRows(sess *session, result []pgmock.Step, maxRows uint32) ([]pgmock.Step, error) {
+	var rows uint32
+	for i, step := range result {
+		if maxRows > 0 && rows == maxRows {
+			return result[i:], (&sendStep{msg: &pgproto3.PortalSuspended{}}).stepSession(sess)
+		}
+
+		if err := runStep(sess, step); err != nil {
+			return nil, err
+		}
+		if d, ok := step.(*delayStep); ok {
+			step = d.step
+		}
+		if st, ok := step.(*sendStep); ok {
+			if _, ok := st.msg.(*pgproto3.DataRow); ok {
+				rows++
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// batchSQL return the SQL of the statement used by the batch, parsed in
+// the batch or before it
+func batchSQL(sess *session, batch []pgproto3.FrontendMessage) (string, bool) {
+	for _, m := range batch {
+		switch m := m.(type) {
+		case *pgproto3.Parse:
+			return m.Query, true
+		case *pgproto3.Bind:
+			q, ok := sess.prepared[m.PreparedStatement]
+			return q, ok
+		}
+	}
+	return "", false
+}
+
+// textRowDescription return rd with every field in the text format, as
+// sent for Query
+func textRowDescription(rd *pgproto3.RowDescription) *pgproto3.RowDescription {
+	n := &pgproto3.RowDescription{Fields: make([]pgproto3.FieldDescription, len(rd.Fields))}
+	copy(n.Fields, rd.Fields)
+	for i := range n.Fields {
+		n.Fields[i].Format = 0
+	}
+	return n
+}
+
+// textDataRow return row of rd with the binary values written as text
+func textDataRow(rd *pgproto3.RowDescription, row *pgproto3.DataRow) (*pgproto3.DataRow, error) {
+	if rd == nil {
+		return row, nil
+	}
+
+	n := &pgproto3.DataRow{Values: make([][]byte, len(row.Values))}
+	for i, v := range row.Values {
+		if i >= len(rd.Fields) || rd.Fields[i].Format == 0 {
+			n.Values[i] = v
+			continue
+		}
+
+		t, err := binaryText(rd.Fields[i].DataTypeOID, v)
+		if err != nil {
+			return nil, fmt.Errorf("pgsnap: %s: %w", rd.Fields[i].Name, err)
+		}
+		n.Values[i] = t
+	}
+
+	return n, nil
+}
+
+// binaryText return the text format of binary value b of type oid, for the
+// common types
+func binaryText(oid uint32, b []byte) ([]byte, error) {
+	if b == nil {
+		return nil, nil
+	}
+
+	invalid := fmt.Errorf("invalid binary value of type %d: %x", oid, b)
+
+	switch oid {
+	case 16: // bool
+		if len(b) != 1 {
+			return nil, invalid
+		}
+		return []byte(map[bool]string{true: "t", false: "f"}[b[0] != 0]), nil
+	case 20, 21, 23: // int8, int2, int4
+		size := map[uint32]int{20: 8, 21: 2, 23: 4}[oid]
+		if len(b) != size {
+			return nil, invalid
+		}
+		full := make([]byte, 8)
+		copy(full[8-size:], b)
+		n := int64(binary.BigEndian.Uint64(full)) << (64 - size*8) >> (64 - size*8)
+		return []byte(strconv.FormatInt(n, 10)), nil
+	case oidFloat4:
+		if len(b) != 4 {
+			return nil, invalid
+		}
+		return []byte(strconv.FormatFloat(float64(math.Float32frombits(binary.BigEndian.Uint32(b))), 'g', -1, 32)), nil
+	case oidFloat8:
+		if len(b) != 8 {
+			return nil, invalid
+		}
+		return []byte(strconv.FormatFloat(math.Float64frombits(binary.BigEndian.Uint64(b)), 'g', -1, 64)), nil
+	case 17: // bytea
+		return []byte(`\x` + hex.EncodeToString(b)), nil
+	case 19, 25, 114, 1042, 1043: // name, text, json, bpchar, varchar
+		return b, nil
+	case 3802: // jsonb, after its version
+		if len(b) == 0 || b[0] != 1 {
+			return nil, invalid
+		}
+		return b[1:], nil
+	case 2950: // uuid
+		if len(b) != 16 {
+			return nil, invalid
+		}
+		h := hex.EncodeToString(b)
+		return []byte(h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]), nil
+	}
+
+	return nil, fmt.Errorf("binary value of type %d can't be sent as text", oid)
+}
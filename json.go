@@ -0,0 +1,174 @@
+package pgsnap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"unicode/utf8"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// marshalJSON marshal msg like json.Marshal, for the messages that
+// pgproto3 doesn't give a JSON encoding that can be read back
+func marshalJSON(msg pgproto3.Message) ([]byte, error) {
+	switch m := msg.(type) {
+	case *pgproto3.NoticeResponse:
+		return marshalNoticeResponse(m)
+	case *pgproto3.FunctionCall:
+		return marshalFunctionCall(m)
+	case *pgproto3.DataRow:
+		return marshalDataRow(m)
+	case *pgproto3.FunctionCallResponse:
+		return marshalFunctionCallResponse(m)
+	}
+
+	return json.Marshal(msg)
+}
+
+// marshalNoticeResponse write NoticeResponse, which has the same fields as
+// ErrorResponse, as ErrorResponse with its own Type
+func marshalNoticeResponse(n *pgproto3.NoticeResponse) ([]byte, error) {
+	b, err := json.Marshal((*pgproto3.ErrorResponse)(n))
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.Replace(b, []byte(`"Type":"ErrorResponse"`), []byte(`"Type":"NoticeResponse"`), 1), nil
+}
+
+func unmarshalNoticeResponse(src []byte) (*pgproto3.NoticeResponse, error) {
+	var e pgproto3.ErrorResponse
+	if err := json.Unmarshal(src, &e); err != nil {
+		return nil, err
+	}
+
+	return (*pgproto3.NoticeResponse)(&e), nil
+}
+
+// marshalFunctionCall write the arguments of FunctionCall like the
+// parameters of Bind
+func marshalFunctionCall(fc *pgproto3.FunctionCall) ([]byte, error) {
+	args := make([]map[string]string, len(fc.Arguments))
+	for i, arg := range fc.Arguments {
+		if arg == nil {
+			continue
+		}
+
+		textFormat := true
+		if len(fc.ArgFormatCodes) == 1 {
+			textFormat = fc.ArgFormatCodes[0] == 0
+		} else if len(fc.ArgFormatCodes) > 1 {
+			textFormat = fc.ArgFormatCodes[i] == 0
+		}
+
+		if textFormat {
+			args[i] = map[string]string{"text": string(arg)}
+		} else {
+			args[i] = map[string]string{"binary": hex.EncodeToString(arg)}
+		}
+	}
+
+	return json.Marshal(struct {
+		Type             string
+		Function         uint32
+		ArgFormatCodes   []uint16
+		Arguments        []map[string]string
+		ResultFormatCode uint16
+	}{
+		Type:             "FunctionCall",
+		Function:         fc.Function,
+		ArgFormatCodes:   fc.ArgFormatCodes,
+		Arguments:        args,
+		ResultFormatCode: fc.ResultFormatCode,
+	})
+}
+
+func unmarshalFunctionCall(src []byte) (*pgproto3.FunctionCall, error) {
+	var msg struct {
+		Function         uint32
+		ArgFormatCodes   []uint16
+		Arguments        []map[string]string
+		ResultFormatCode uint16
+	}
+	if err := json.Unmarshal(src, &msg); err != nil {
+		return nil, err
+	}
+
+	fc := &pgproto3.FunctionCall{
+		Function:         msg.Function,
+		ArgFormatCodes:   msg.ArgFormatCodes,
+		ResultFormatCode: msg.ResultFormatCode,
+	}
+
+	for _, arg := range msg.Arguments {
+		b, err := valueFromJSON(arg)
+		if err != nil {
+			return nil, err
+		}
+		fc.Arguments = append(fc.Arguments, b)
+	}
+
+	return fc, nil
+}
+
+// marshalDataRow write DataRow like pgproto3, except that values that are
+// not valid UTF-8 are written as binary too, as JSON can't keep them
+func marshalDataRow(row *pgproto3.DataRow) ([]byte, error) {
+	values := make([]map[string]string, len(row.Values))
+	for i, v := range row.Values {
+		values[i] = valueToJSON(v)
+	}
+
+	return json.Marshal(struct {
+		Type   string
+		Values []map[string]string
+	}{
+		Type:   "DataRow",
+		Values: values,
+	})
+}
+
+func marshalFunctionCallResponse(fcr *pgproto3.FunctionCallResponse) ([]byte, error) {
+	return json.Marshal(struct {
+		Type   string
+		Result map[string]string
+	}{
+		Type:   "FunctionCallResponse",
+		Result: valueToJSON(fcr.Result),
+	})
+}
+
+// valueToJSON write v as {"text": "..."} when it's printable, otherwise
+// {"binary": "hex"}. NULL is written as null.
+func valueToJSON(v []byte) map[string]string {
+	if v == nil {
+		return nil
+	}
+
+	if !utf8.Valid(v) {
+		return map[string]string{"binary": hex.EncodeToString(v)}
+	}
+	for _, b := range v {
+		if b < 32 {
+			return map[string]string{"binary": hex.EncodeToString(v)}
+		}
+	}
+
+	return map[string]string{"text": string(v)}
+}
+
+// valueFromJSON decode {"text": "..."} or {"binary": "hex"}, null is NULL
+func valueFromJSON(v map[string]string) ([]byte, error) {
+	if v == nil {
+		return nil, nil
+	}
+	if text, ok := v["text"]; ok {
+		return []byte(text), nil
+	}
+	if binary, ok := v["binary"]; ok {
+		return hex.DecodeString(binary)
+	}
+	return nil, errors.New("unknown value representation")
+}
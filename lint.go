@@ -0,0 +1,243 @@
+package pgsnap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Lint check the snapshot read from r without replaying it, and return
+// every problem found, with its line: lines that can't be read, message
+// types that pgsnap doesn't support, and messages that can't come in that
+// order, like DataRow without RowDescription before it, Parse that is
+// never followed by Sync, or more DataRow than MaxRows of Execute. The
+// snapshot can be in JSON or text format, and compressed with gzip.
+func Lint(r io.Reader) []error {
+	src, lines, err := readLines(r)
+	if err != nil {
+		return []error{err}
+	}
+
+	s := &Snap{cfg: defaultConfig(), file: "snapshot"}
+
+	conns, errs := s.lintLines(lines)
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// the lines are fine, but the snapshot may not, e.g. startup without
+	// ReadyForQuery
+	if _, err := s.readScript(bytes.NewReader(src)); err != nil {
+		var le *lineError
+		if errors.As(err, &le) {
+			return []error{lintError(le.line, le.err, le.text)}
+		}
+		return []error{err}
+	}
+
+	for _, conn := range conns {
+		errs = append(errs, lintConn(conn)...)
+	}
+
+	return errs
+}
+
+// readLines read the snapshot from r, and return it uncompressed with its
+// lines
+func readLines(r io.Reader) ([]byte, []textLine, error) {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	src, err = gunzip(src)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lines, err := fromText(src)
+	if err != nil {
+		var te *textError
+		if errors.As(err, &te) {
+			return nil, nil, lintError(te.line, te.err, te.b)
+		}
+		return nil, nil, err
+	}
+
+	return src, lines, nil
+}
+
+func lintError(line int, err error, text []byte) error {
+	if len(text) == 0 {
+		return fmt.Errorf("line %d: %v", line, err)
+	}
+	return fmt.Errorf("line %d: %v: %s", line, err, text)
+}
+
+// lintMessage is message in the snapshot, with its line
+type lintMessage struct {
+	line int
+	msg  pgproto3.Message
+}
+
+// lintLines read every line, and return the messages of every connection
+func (s *Snap) lintLines(lines []textLine) ([][]lintMessage, []error) {
+	var errs []error
+	conns := [][]lintMessage{nil}
+
+	for _, l := range lines {
+		b := l.b
+
+		if len(b) == 0 || b[0] == '#' {
+			continue
+		}
+
+		if isHeader(b) {
+			h, err := parseHeader(b)
+			if err != nil {
+				errs = append(errs, lintError(l.line, err, b))
+			}
+			// replayed with the authentication it's recorded with
+			s.cfg.auth = h.auth
+			continue
+		}
+
+		if _, ok := parseSection(b); ok || b[0] == 'C' {
+			conns = append(conns, nil)
+			continue
+		}
+		if isWarmup(b) || bytes.Equal(b, unorderedLine) || bytes.Equal(b, unorderedEndLine) {
+			continue
+		}
+
+		var msg pgproto3.Message
+		var err error
+		switch b[0] {
+		case 'F':
+			msg, err = s.unmarshalF(b[1:])
+		case 'B':
+			if _, ok := parseCloseStep(b[1:]); ok {
+				// msg is nil for Close
+				break
+			}
+			msg, err = s.unmarshalB(b[1:])
+		default:
+			err = errors.New("unknown line")
+		}
+		if err != nil {
+			errs = append(errs, lintError(l.line, err, b))
+			continue
+		}
+
+		n := len(conns) - 1
+		conns[n] = append(conns[n], lintMessage{line: l.line, msg: msg})
+	}
+
+	return conns, errs
+}
+
+// lintConn check the order of the messages of one connection
+func lintConn(msgs []lintMessage) []error {
+	var errs []error
+
+	var (
+		// Query, Sync and FunctionCall not answered by ReadyForQuery yet
+		waiting []lintMessage
+
+		// the first message of extended protocol not followed by Sync
+		extended *lintMessage
+
+		// Execute not answered yet, with the DataRow sent for the first
+		executes []lintMessage
+		rows     uint32
+
+		startup bool
+		simple  bool
+		rd      *pgproto3.RowDescription
+	)
+
+	for i, m := range msgs {
+		if _, ok := m.msg.(*pgproto3.StartupMessage); ok {
+			startup = true
+			continue
+		}
+		if startup {
+			_, rfq := m.msg.(*pgproto3.ReadyForQuery)
+			startup = !rfq
+			continue
+		}
+
+		switch msg := m.msg.(type) {
+		case nil:
+			// closed by Close, nothing is answered anymore
+			waiting, extended, executes = nil, nil, nil
+		case *pgproto3.Query, *pgproto3.FunctionCall:
+			waiting = append(waiting, m)
+			simple = true
+			rd = nil
+		case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close:
+			if extended == nil {
+				extended = &msgs[i]
+			}
+			if _, ok := msg.(*pgproto3.Execute); ok {
+				executes = append(executes, m)
+			}
+			simple = false
+		case *pgproto3.Sync:
+			waiting = append(waiting, m)
+			extended = nil
+		case *pgproto3.ReadyForQuery:
+			if len(waiting) == 0 {
+				errs = append(errs, lintError(m.line, errors.New("ReadyForQuery without Query or Sync before it"), nil))
+				continue
+			}
+			waiting = waiting[1:]
+		case *pgproto3.PortalSuspended:
+			if len(executes) == 0 || executes[0].msg.(*pgproto3.Execute).MaxRows == 0 {
+				errs = append(errs, lintError(m.line, errors.New("PortalSuspended without Execute with MaxRows before it"), nil))
+				continue
+			}
+			executes, rows = executes[1:], 0
+		case *pgproto3.CommandComplete, *pgproto3.EmptyQueryResponse:
+			if !simple && len(executes) > 0 {
+				executes, rows = executes[1:], 0
+			}
+		case *pgproto3.ErrorResponse:
+			// the Execute left until Sync are skipped by postgres
+			executes, rows = nil, 0
+		case *pgproto3.RowDescription:
+			if simple {
+				rd = msg
+			}
+		case *pgproto3.DataRow:
+			// the app can execute a portal described before, so only the
+			// rows of Query must have RowDescription before them
+			if simple && rd == nil {
+				errs = append(errs, lintError(m.line, errors.New("DataRow without RowDescription before it"), nil))
+				continue
+			}
+			if simple && len(msg.Values) != len(rd.Fields) {
+				errs = append(errs, lintError(m.line, fmt.Errorf("DataRow has %d values, but RowDescription has %d fields", len(msg.Values), len(rd.Fields)), nil))
+			}
+			if simple || len(executes) == 0 {
+				continue
+			}
+			rows++
+			if max := executes[0].msg.(*pgproto3.Execute).MaxRows; max > 0 && rows == max+1 {
+				errs = append(errs, lintError(m.line, fmt.Errorf("Execute of line %d has MaxRows %d, but it's answered with more DataRow", executes[0].line, max), nil))
+			}
+		}
+	}
+
+	if extended != nil {
+		errs = append(errs, lintError(extended.line, fmt.Errorf("%s is never followed by Sync", messageType(extended.msg)), nil))
+	}
+	for _, m := range waiting {
+		errs = append(errs, lintError(m.line, fmt.Errorf("%s is never answered by ReadyForQuery", messageType(m.msg)), nil))
+	}
+
+	return errs
+}
@@ -0,0 +1,113 @@
+package pgsnap
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Logger is called for every message sent ('B') or received ('F') by the
+// fake postgres, see WithLogger. msg is only valid during the call.
+type Logger func(dir byte, msg pgproto3.Message)
+
+// TestLogger return Logger that write the messages to the test log, in
+// the same format as the snapshot file
+func TestLogger(t testing.TB) Logger {
+	return func(dir byte, msg pgproto3.Message) {
+		t.Logf("%c %s", dir, marshalMessage(msg))
+	}
+}
+
+// newBackend return Backend for conn. With WithLogger, every message that
+// goes through it is decoded again to be logged.
+func (s *Snap) newBackend(conn net.Conn) *pgproto3.Backend {
+	if s.cfg.logger == nil {
+		return pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	}
+
+	r := &logReader{cr: pgproto3.NewChunkReader(conn), log: s.cfg.logger}
+	r.shadow = pgproto3.NewBackend(pgproto3.NewChunkReader(&r.buf), nil)
+
+	w := &logWriter{w: conn, log: s.cfg.logger, reader: r}
+
+	return pgproto3.NewBackend(r, w)
+}
+
+// logReader log the messages read by Backend, by decoding the same bytes
+// with another Backend. The first message is the StartupMessage.
+type logReader struct {
+	cr  pgproto3.ChunkReader
+	log Logger
+
+	shadow  *pgproto3.Backend
+	buf     bytes.Buffer
+	started bool
+	header  bool
+}
+
+// Next return the chunk read by Backend, which is the header of message
+// followed by its body
+func (r *logReader) Next(n int) ([]byte, error) {
+	b, err := r.cr.Next(n)
+	if err != nil {
+		return b, err
+	}
+
+	r.buf.Write(b)
+
+	if !r.header {
+		r.header = true
+		return b, nil
+	}
+	r.header = false
+
+	var msg pgproto3.FrontendMessage
+	if r.started {
+		msg, err = r.shadow.Receive()
+	} else {
+		r.started = true
+		msg, err = r.shadow.ReceiveStartupMessage()
+	}
+	r.buf.Reset()
+
+	if err == nil {
+		r.log('F', msg)
+	}
+
+	return b, nil
+}
+
+// logWriter log the messages sent by Backend. Backend write one message at
+// a time, so every write is decoded on its own.
+type logWriter struct {
+	w      io.Writer
+	log    Logger
+	reader *logReader
+}
+
+func (w *logWriter) Write(b []byte) (int, error) {
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(bytes.NewReader(b)), nil)
+
+	for {
+		msg, err := fe.Receive()
+		if err != nil {
+			break
+		}
+
+		w.log('B', msg)
+
+		// the password message sent by client depends on the
+		// authentication asked, just like in the real Backend
+		switch msg.(type) {
+		case *pgproto3.AuthenticationSASL:
+			_ = w.reader.shadow.SetAuthType(pgproto3.AuthTypeSASL)
+		case *pgproto3.AuthenticationSASLContinue:
+			_ = w.reader.shadow.SetAuthType(pgproto3.AuthTypeSASLContinue)
+		}
+	}
+
+	return w.w.Write(b)
+}
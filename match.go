@@ -0,0 +1,80 @@
+package pgsnap
+
+import (
+	"bytes"
+	"reflect"
+)
+
+// match tell whether msg received from the client match want from the
+// script. It works like reflect.DeepEqual, except that string and []byte
+// in want that are redacted (see Redacted) match any value, and nil slice
+// match empty slice except for []byte.
+func match(want, msg interface{}) bool {
+	return matchValue(reflect.ValueOf(want), reflect.ValueOf(msg))
+}
+
+func matchValue(want, got reflect.Value) bool {
+	if !want.IsValid() || !got.IsValid() {
+		return want.IsValid() == got.IsValid()
+	}
+
+	if want.Type() != got.Type() {
+		return false
+	}
+
+	switch want.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if want.IsNil() || got.IsNil() {
+			return want.IsNil() == got.IsNil()
+		}
+		return matchValue(want.Elem(), got.Elem())
+
+	case reflect.Struct:
+		for i := 0; i < want.NumField(); i++ {
+			if !matchValue(want.Field(i), got.Field(i)) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.String:
+		return want.String() == Redacted || want.String() == got.String()
+
+	case reflect.Map:
+		// the order of the keys doesn't matter, e.g. the parameters of
+		// StartupMessage
+		if want.Len() != got.Len() {
+			return false
+		}
+		iter := want.MapRange()
+		for iter.Next() {
+			v := got.MapIndex(iter.Key())
+			if !v.IsValid() || !matchValue(iter.Value(), v) {
+				return false
+			}
+		}
+		return true
+
+	case reflect.Slice:
+		if want.Type().Elem().Kind() == reflect.Uint8 && bytes.Equal(want.Bytes(), []byte(Redacted)) {
+			return true
+		}
+
+		// nil []byte is NULL, but for other slices nil and empty are the
+		// same on the wire, and pgproto3 decode JSON null as empty slice
+		if want.Len() != got.Len() {
+			return false
+		}
+		if want.Type().Elem().Kind() == reflect.Uint8 && want.IsNil() != got.IsNil() {
+			return false
+		}
+		for i := 0; i < want.Len(); i++ {
+			if !matchValue(want.Index(i), got.Index(i)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return reflect.DeepEqual(want.Interface(), got.Interface())
+}
@@ -0,0 +1,30 @@
+package pgsnap
+
+import (
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_match(t *testing.T) {
+	bind := func(params ...string) *pgproto3.Bind {
+		b := &pgproto3.Bind{}
+		for _, p := range params {
+			b.Parameters = append(b.Parameters, []byte(p))
+		}
+		return b
+	}
+
+	assert.True(t, match(bind("1", "2"), bind("1", "2")))
+	assert.False(t, match(bind("1", "2"), bind("1", "3")))
+	assert.False(t, match(bind("1", "2"), bind("1")))
+	assert.True(t, match(bind("1", Redacted), bind("1", "3")))
+	assert.False(t, match(bind("1", Redacted), bind("2", "3")))
+
+	assert.True(t, match(&pgproto3.Query{String: Redacted}, &pgproto3.Query{String: "select 1"}))
+	assert.False(t, match(&pgproto3.Query{String: "select 1"}, &pgproto3.Parse{Query: "select 1"}))
+
+	assert.True(t, match(&pgproto3.Bind{Parameters: [][]byte{}}, &pgproto3.Bind{}))
+	assert.False(t, match(bind(""), &pgproto3.Bind{Parameters: [][]byte{nil}}))
+}
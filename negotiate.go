@@ -0,0 +1,136 @@
+package pgsnap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// pqOptionPrefix is the namespace of protocol options in StartupMessage
+const pqOptionPrefix = "_pq_."
+
+// negotiateProtocolVersion is NegotiateProtocolVersion message, sent when
+// the server doesn't support the protocol minor version or the _pq_.
+// options requested by the client. pgproto3 doesn't have it.
+type negotiateProtocolVersion struct {
+	NewestMinorProtocol uint32
+	UnrecognizedOptions []string
+}
+
+// Backend identifies this message as sendable by the PostgreSQL backend.
+func (*negotiateProtocolVersion) Backend() {}
+
+func (dst *negotiateProtocolVersion) Decode(src []byte) error {
+	if len(src) < 8 {
+		return errors.New("invalid NegotiateProtocolVersion")
+	}
+
+	dst.NewestMinorProtocol = binary.BigEndian.Uint32(src)
+	count := int(binary.BigEndian.Uint32(src[4:]))
+	src = src[8:]
+
+	dst.UnrecognizedOptions = nil
+	for i := 0; i < count; i++ {
+		idx := bytes.IndexByte(src, 0)
+		if idx < 0 {
+			return errors.New("invalid NegotiateProtocolVersion")
+		}
+		dst.UnrecognizedOptions = append(dst.UnrecognizedOptions, string(src[:idx]))
+		src = src[idx+1:]
+	}
+
+	return nil
+}
+
+func (src *negotiateProtocolVersion) Encode(dst []byte) []byte {
+	dst = append(dst, 'v')
+	sp := len(dst)
+	dst = append(dst, 0, 0, 0, 0)
+
+	dst = appendUint32(dst, src.NewestMinorProtocol)
+	dst = appendUint32(dst, uint32(len(src.UnrecognizedOptions)))
+	for _, opt := range src.UnrecognizedOptions {
+		dst = append(dst, opt...)
+		dst = append(dst, 0)
+	}
+
+	binary.BigEndian.PutUint32(dst[sp:], uint32(len(dst[sp:])))
+	return dst
+}
+
+func (src negotiateProtocolVersion) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type                string
+		NewestMinorProtocol uint32
+		UnrecognizedOptions []string
+	}{
+		Type:                "NegotiateProtocolVersion",
+		NewestMinorProtocol: src.NewestMinorProtocol,
+		UnrecognizedOptions: src.UnrecognizedOptions,
+	})
+}
+
+func appendUint32(dst []byte, n uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], n)
+	return append(dst, b[:]...)
+}
+
+// negotiateStep send NegotiateProtocolVersion after the StartupMessage.
+// When msg is nil, it's only sent if the client asks for _pq_. options,
+// which are all reported as unrecognized like postgres does.
+type negotiateStep struct {
+	startup *startupStep
+	msg     *negotiateProtocolVersion
+
+	// recorded is the message in V1 snapshot, which is still sent when it
+	// has no option, and gives the newest minor protocol version
+	recorded *negotiateProtocolVersion
+
+	// sent is the message sent, to be recorded
+	sent *negotiateProtocolVersion
+}
+
+func (n *negotiateStep) Step(be *pgproto3.Backend) error {
+	msg := n.msg
+	if msg == nil {
+		msg = n.unrecognized()
+	}
+	if msg == nil {
+		return nil
+	}
+
+	n.sent = msg
+	return be.Send(msg)
+}
+
+func (n *negotiateStep) unrecognized() *negotiateProtocolVersion {
+	if n.startup.msg == nil {
+		return nil
+	}
+
+	var options []string
+	for name := range n.startup.msg.Parameters {
+		if strings.HasPrefix(name, pqOptionPrefix) {
+			options = append(options, name)
+		}
+	}
+	if len(options) == 0 {
+		if n.recorded != nil && len(n.recorded.UnrecognizedOptions) == 0 {
+			return n.recorded
+		}
+		return nil
+	}
+
+	sort.Strings(options)
+	msg := &negotiateProtocolVersion{UnrecognizedOptions: options}
+	if n.recorded != nil {
+		msg.NewestMinorProtocol = n.recorded.NewestMinorProtocol
+	}
+	return msg
+}
@@ -0,0 +1,496 @@
+package pgsnap
+
+import (
+	"context"
+	"crypto/tls"
+	"time"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Option configures optional behaviour of Snap
+type Option func(*config)
+
+type config struct {
+	auth     AuthMethod
+	password string
+	md5Salt  [4]byte
+	scram    scramParams
+	ssl      bool
+	useTLS   bool
+	tls      *tls.Config
+	timeout  time.Duration
+	maxConns int
+	ctx      context.Context
+	redactor Redactor
+
+	startupDelay  time.Duration
+	acceptTimeout time.Duration
+
+	strictStartup        bool
+	strictStartupOptions bool
+
+	expectedStartupParameters map[string]string
+
+	ignoreColumns       []string
+	ignoreColumnIndexes []int
+
+	ignoreRowDescriptionFields []string
+
+	normalizeSQL bool
+
+	anyProtocol bool
+
+	healthChecks []string
+
+	copyDataStream bool
+
+	serverParameters map[string]string
+
+	negotiate *negotiateProtocolVersion
+
+	backendPID    uint32
+	backendSecret uint32
+
+	forceWrite bool
+
+	unixSocket    bool
+	unixSocketDir string
+
+	listenAddr string
+
+	sharedListener bool
+
+	logger Logger
+
+	stepHook StepHook
+
+	format Format
+	gzip   bool
+
+	snapshotDir string
+
+	unknownMessages UnknownMessagePolicy
+
+	onEmpty OnEmpty
+}
+
+// DefaultBackendPID and DefaultBackendSecret are sent in BackendKeyData
+// when WithBackendKeyData isn't used
+const (
+	DefaultBackendPID    uint32 = 4242
+	DefaultBackendSecret uint32 = 0x736e6170
+)
+
+func defaultConfig() config {
+	return config{
+		md5Salt:  [4]byte{'s', 'n', 'a', 'p'},
+		ssl:      true,
+		timeout:  time.Second,
+		maxConns: 1,
+
+		backendPID:    DefaultBackendPID,
+		backendSecret: DefaultBackendSecret,
+
+		serverParameters: map[string]string{
+			"server_version":              "13.0",
+			"server_encoding":             "UTF8",
+			"client_encoding":             "UTF8",
+			"DateStyle":                   "ISO, MDY",
+			"IntervalStyle":               "postgres",
+			"TimeZone":                    "UTC",
+			"integer_datetimes":           "on",
+			"standard_conforming_strings": "on",
+		},
+	}
+}
+
+// WithAuth makes the fake postgres ask the client to authenticate
+// using method with the given password before running the script
+func WithAuth(method AuthMethod, password string) Option {
+	return func(c *config) {
+		c.auth = method
+		c.password = password
+	}
+}
+
+// WithMD5Salt set the salt sent in AuthenticationMD5Password when
+// using WithAuth(AuthMD5, password)
+func WithMD5Salt(salt [4]byte) Option {
+	return func(c *config) {
+		c.md5Salt = salt
+	}
+}
+
+// WithSCRAMParams set the salt, iteration count and server nonce used by
+// WithAuth(AuthSCRAM, password), which are random by default, so the
+// messages of the authentication are the same on every run
+func WithSCRAMParams(salt []byte, iterations int, serverNonce string) Option {
+	return func(c *config) {
+		c.scram = scramParams{salt: salt, iterations: iterations, nonce: serverNonce}
+	}
+}
+
+// WithSSL set whether the fake postgres answer the SSLRequest sent by
+// client (sslmode=prefer). It is enabled by default, use WithSSL(false)
+// when the client always connect with sslmode=disable.
+func WithSSL(enabled bool) Option {
+	return func(c *config) {
+		c.ssl = enabled
+	}
+}
+
+// WithTLS makes the fake postgres accept only TLS connection using cfg.
+// When cfg is nil, a self-signed certificate is generated, which is
+// accepted by client with sslmode=require.
+func WithTLS(cfg *tls.Config) Option {
+	return func(c *config) {
+		c.useTLS = true
+		c.tls = cfg
+	}
+}
+
+// WithTimeout set how long a client connection may last before the fake
+// postgres gives up on it (default 1 second). Zero means no deadline.
+func WithTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.timeout = d
+	}
+}
+
+// WithAcceptTimeout makes the replay fail with "no client connected" when
+// no client connects within d after the snap is created, e.g. because the
+// code under test never dials, instead of waiting for the timeout of the
+// test. Unlike WithTimeout, it's only for the first connection. Zero (the
+// default) means waiting forever.
+func WithAcceptTimeout(d time.Duration) Option {
+	return func(c *config) {
+		c.acceptTimeout = d
+	}
+}
+
+// WithStartupDelay makes the fake postgres wait for d after receiving the
+// StartupMessage, before answering it, to test the connect timeout of the
+// client. Like delayMs of B line, the delay isn't counted in WithTimeout.
+func WithStartupDelay(d time.Duration) Option {
+	return func(c *config) {
+		c.startupDelay = d
+	}
+}
+
+// WithStrictStartup makes the replay compare every parameter of the
+// StartupMessage recorded in the snapshot, in any order, so the app that
+// sends a parameter more or less fails. By default only the user and the
+// database are compared.
+func WithStrictStartup(enabled bool) Option {
+	return func(c *config) {
+		c.strictStartup = enabled
+	}
+}
+
+// WithStrictStartupOptions makes WithStrictStartup compare the _pq_.
+// options of the StartupMessage too, and the replay send the recorded
+// NegotiateProtocolVersion as it is. By default the options, which change
+// with the version of the driver, are left out, and the options sent by
+// the client are reported as unrecognized.
+func WithStrictStartupOptions(enabled bool) Option {
+	return func(c *config) {
+		c.strictStartupOptions = enabled
+	}
+}
+
+// WithExpectedStartupParameters makes the replay fail when the app doesn't
+// send params in its StartupMessage, e.g. application_name set in the URL
+// of the app, or options=-c search_path=app
+func WithExpectedStartupParameters(params map[string]string) Option {
+	return func(c *config) {
+		c.expectedStartupParameters = params
+	}
+}
+
+// WithMaxConns makes the fake postgres serve up to n connections at the
+// same time. When the snapshot has only one connection, each of the n
+// connections replays its own copy of it.
+func WithMaxConns(n int) Option {
+	return func(c *config) {
+		c.maxConns = n
+	}
+}
+
+// WithContext closes the Snap when ctx is done, so a replay waiting for
+// a client that never send the expected message can be canceled
+func WithContext(ctx context.Context) Option {
+	return func(c *config) {
+		c.ctx = ctx
+	}
+}
+
+// WithRedactor makes the recorder write every message sent by the client
+// through fn, so secrets don't end up in the snapshot. When fn is nil,
+// RedactBindParameters is used.
+func WithRedactor(fn Redactor) Option {
+	return func(c *config) {
+		if fn == nil {
+			fn = RedactBindParameters
+		}
+		c.redactor = fn
+	}
+}
+
+// WithIgnoreColumns makes the columns with the given names not compared
+// when updating the snapshot, so values that change on every run (like
+// now() or serial id) don't make the snapshot rewritten. Their values are
+// recorded blank, so they don't show up in the diff either, and the replay
+// sends them empty.
+func WithIgnoreColumns(names ...string) Option {
+	return func(c *config) {
+		c.ignoreColumns = append(c.ignoreColumns, names...)
+	}
+}
+
+// WithIgnoreColumnIndexes is like WithIgnoreColumns, but the columns are
+// given by their index (counted from 0)
+func WithIgnoreColumnIndexes(indexes ...int) Option {
+	return func(c *config) {
+		c.ignoreColumnIndexes = append(c.ignoreColumnIndexes, indexes...)
+	}
+}
+
+// WithIgnoreRowDescriptionFields makes the given attributes of the fields
+// of RowDescription (e.g. "TableOID", "TypeModifier", "Format") not compared
+// when updating the snapshot, so the snapshot isn't rewritten only because
+// they're reported differently by another version of postgres. The others,
+// like Name and DataTypeOID, are still compared.
+func WithIgnoreRowDescriptionFields(names ...string) Option {
+	return func(c *config) {
+		c.ignoreRowDescriptionFields = append(c.ignoreRowDescriptionFields, names...)
+	}
+}
+
+// WithNormalizeSQL makes the replay compare the SQL of Query and Parse
+// ignoring whitespace and one trailing semicolon, so a query reformatted by
+// the ORM still match the snapshot. Whitespace inside quoted strings is
+// still compared.
+func WithNormalizeSQL() Option {
+	return func(c *config) {
+		c.normalizeSQL = true
+	}
+}
+
+// WithIgnoreHealthChecks makes the replay answer the Query matching one of
+// patterns, sent by the pool to check the connection, without running the
+// steps of the snapshot, unless the snapshot expects that query. patterns
+// are written like the SQL of the snapshot, compared ignoring whitespace
+// and case, or as regular expression with QueryPatternPrefix. Without
+// patterns, DefaultHealthChecks is used.
+func WithIgnoreHealthChecks(patterns ...string) Option {
+	return func(c *config) {
+		if len(patterns) == 0 {
+			patterns = DefaultHealthChecks
+		}
+		c.healthChecks = append(c.healthChecks, patterns...)
+	}
+}
+
+// WithIgnoreResetQueries makes the replay answer the queries sent by the
+// pool to reset the connection before it's used again, like DISCARD ALL,
+// with CommandComplete, just like WithIgnoreHealthChecks. Without
+// patterns, DefaultResetQueries is used.
+func WithIgnoreResetQueries(patterns ...string) Option {
+	return func(c *config) {
+		if len(patterns) == 0 {
+			patterns = DefaultResetQueries
+		}
+		c.healthChecks = append(c.healthChecks, patterns...)
+	}
+}
+
+// WithAnyProtocol makes the replay match Query sent by the client with
+// the same SQL recorded with Parse, Bind and Execute, and the other way
+// around, so the snapshot still match after the app switch between the
+// simple and the extended protocol. It's best effort: only the SQL is
+// compared, and the binary values can only be sent as text for the common
+// types.
+func WithAnyProtocol() Option {
+	return func(c *config) {
+		c.anyProtocol = true
+	}
+}
+
+// WithCopyDataStream makes the replay compare the data sent by the client
+// in COPY FROM STDIN as one stream, so it doesn't matter how the client
+// split the data into CopyData messages
+func WithCopyDataStream() Option {
+	return func(c *config) {
+		c.copyDataStream = true
+	}
+}
+
+// WithServerParameters set the ParameterStatus sent to the client after
+// the authentication, e.g. {"server_version": "14.2"}. The parameters are
+// added to the default ones (server_version, client_encoding, DateStyle,
+// TimeZone, ...), an empty value removes the parameter.
+func WithServerParameters(params map[string]string) Option {
+	return func(c *config) {
+		if c.serverParameters == nil {
+			c.serverParameters = map[string]string{}
+		}
+		for name, value := range params {
+			if value == "" {
+				delete(c.serverParameters, name)
+				continue
+			}
+			c.serverParameters[name] = value
+		}
+	}
+}
+
+// WithNegotiateProtocolVersion makes the fake postgres answer every
+// StartupMessage with NegotiateProtocolVersion, reporting minor as the
+// newest supported minor protocol version and the given _pq_. options as
+// unrecognized. Without it, NegotiateProtocolVersion is only sent when
+// the client asks for _pq_. options.
+func WithNegotiateProtocolVersion(minor uint32, unrecognized ...string) Option {
+	return func(c *config) {
+		c.negotiate = &negotiateProtocolVersion{
+			NewestMinorProtocol: minor,
+			UnrecognizedOptions: unrecognized,
+		}
+	}
+}
+
+// WithBackendKeyData set the process ID and secret key sent to the client
+// in BackendKeyData, and expected in CancelRequest
+func WithBackendKeyData(pid, secret uint32) Option {
+	return func(c *config) {
+		c.backendPID = pid
+		c.backendSecret = secret
+	}
+}
+
+// WithUnixSocket makes the fake postgres listen on unix socket named
+// .s.PGSQL.5432 in dir, instead of TCP. When dir is empty, a temporary
+// directory is used. The socket file is removed by Close.
+func WithUnixSocket(dir string) Option {
+	return func(c *config) {
+		c.unixSocket = true
+		c.unixSocketDir = dir
+	}
+}
+
+// WithListenAddr makes the fake postgres listen on addr (e.g.
+// "127.0.0.1:15432") instead of a random port, so other tools like psql
+// can connect to it while debugging. The test fails when addr is in use.
+func WithListenAddr(addr string) Option {
+	return func(c *config) {
+		c.listenAddr = addr
+	}
+}
+
+// WithSharedListener makes the fake postgres use the listener shared by
+// the snaps with this option, instead of listening on a new port, which
+// is faster for suites with many snapshots. The listener is used by one
+// snap at a time: the next snap wait in NewSnap until the one before is
+// closed, by Close or on cleanup, and its goroutines are done. It's never
+// closed, and it's not used with WithUnixSocket.
+func WithSharedListener() Option {
+	return func(c *config) {
+		c.sharedListener = true
+	}
+}
+
+// WithLogger makes the fake postgres call fn with every message it sends
+// ('B') or receives ('F'), e.g. TestLogger(t) to see the exchange that led
+// to a mismatch. fn is called from the goroutine of each connection.
+func WithLogger(fn Logger) Option {
+	return func(c *config) {
+		c.logger = fn
+	}
+}
+
+// StepHook is called by the replay for every step of the script, see
+// WithStepHook
+type StepHook func(step int, msg pgproto3.Message) error
+
+// WithStepHook makes the replay call fn with every message received from
+// the client, before it's compared with the snapshot, and every message
+// before it's sent. step is counted from 1 for each connection, startup
+// excluded. The fields of msg can be changed, e.g. to replace a value
+// generated at runtime after checking it, or to send other rows. An error
+// returned by fn stops the replay, and is returned by Wait.
+func WithStepHook(fn StepHook) Option {
+	return func(c *config) {
+		c.stepHook = fn
+	}
+}
+
+// WithForceWrite makes the snapshot recorded from the real postgres even
+// when the file already exists, like running the test with PGSNAP_RECORD=1
+func WithForceWrite(enabled bool) Option {
+	return func(c *config) {
+		c.forceWrite = enabled
+	}
+}
+
+// WithFormat set the format of the recorded snapshot. With FormatText, the
+// SQL of Query and the values of DataRow are written as text, which is
+// easier to review. With FormatYAML, the snapshot is written as YAML
+// document in <test name>.yaml. Snapshots in every format are replayed.
+// The snapshot given to NewSnapFromReader is read as YAML with FormatYAML.
+func WithFormat(format Format) Option {
+	return func(c *config) {
+		c.format = format
+	}
+}
+
+// WithSnapshotDir set the directory of the snapshot files, in place of
+// PGSNAP_DIR or the directory of the package, e.g. to keep them with the
+// fixtures of the monorepo
+func WithSnapshotDir(dir string) Option {
+	return func(c *config) {
+		c.snapshotDir = dir
+	}
+}
+
+// WithUnknownMessagePolicy set what the recording does with the message of
+// postgres that can't be replayed, because pgproto3 can't read it or pgsnap
+// can't read it back from the snapshot, e.g. CopyBothResponse. It's
+// UnknownMessageFail by default.
+func WithUnknownMessagePolicy(policy UnknownMessagePolicy) Option {
+	return func(c *config) {
+		c.unknownMessages = policy
+	}
+}
+
+// OnEmpty is what NewSnap does when the snapshot doesn't exist or is
+// empty, see WithOnEmpty
+type OnEmpty int
+
+const (
+	// OnEmptyRecord records the snapshot from the real postgres
+	OnEmptyRecord OnEmpty = iota
+	// OnEmptyFail fails the test, e.g. in CI where there's no postgres
+	OnEmptyFail
+	// OnEmptySkip skips the test
+	OnEmptySkip
+)
+
+// WithOnEmpty set what NewSnap does when the snapshot doesn't exist or is
+// empty. The default is OnEmptyRecord, not OnEmptyFail, because pgsnap
+// already recorded the missing snapshot before the option, and failing
+// would break the tests relying on it. The snapshot is still recorded with
+// PGSNAP_RECORD=1, PGSNAP_UPDATE=1 or WithForceWrite.
+func WithOnEmpty(onEmpty OnEmpty) Option {
+	return func(c *config) {
+		c.onEmpty = onEmpty
+	}
+}
+
+// WithGzip makes the snapshot recorded compressed with gzip, in
+// <test name>.pgsnap.gz, which keeps snapshot of big result small. The
+// compressed snapshot is read without the option.
+func WithGzip() Option {
+	return func(c *config) {
+		c.gzip = true
+	}
+}
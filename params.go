@@ -0,0 +1,262 @@
+package pgsnap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// bindParam is one typed parameter of Bind, written in the snapshot as
+// "params":[{"int4":42},{"text":"foo"},{"null":true}] in place of
+// Parameters, and encoded to the bytes sent by the client in the format
+// of the parameter
+type bindParam struct {
+	typ   string
+	value json.RawMessage
+}
+
+// paramTypes is the types that can be used in params
+var paramTypes = map[string]bool{
+	"null":   true,
+	"text":   true,
+	"bytea":  true,
+	"bool":   true,
+	"int2":   true,
+	"int4":   true,
+	"int8":   true,
+	"float4": true,
+	"float8": true,
+}
+
+// parseBindParams return the typed parameters in F line b, or nil when
+// the line has no params
+func parseBindParams(b []byte) ([]bindParam, error) {
+	var msg struct {
+		Params []map[string]json.RawMessage `json:"params"`
+	}
+	if err := json.Unmarshal(b, &msg); err != nil {
+		return nil, err
+	}
+
+	var params []bindParam
+	for i, p := range msg.Params {
+		if len(p) != 1 {
+			return nil, fmt.Errorf("params[%d] must have one type, e.g. {\"int4\":42}", i)
+		}
+		for typ, value := range p {
+			if !paramTypes[typ] {
+				return nil, fmt.Errorf("params[%d] has unknown type %q", i, typ)
+			}
+			params = append(params, bindParam{typ: typ, value: value})
+		}
+	}
+
+	return params, nil
+}
+
+// unmarshalBind read Bind, with its Parameters encoded from params when
+// the line has them
+func unmarshalBind(src []byte) (*pgproto3.Bind, error) {
+	bind := &pgproto3.Bind{}
+	if err := json.Unmarshal(src, bind); err != nil {
+		return nil, err
+	}
+
+	params, err := parseBindParams(src)
+	if err != nil || params == nil {
+		return bind, err
+	}
+	if len(bind.Parameters) > 0 {
+		return nil, errors.New("Bind can't have both Parameters and params")
+	}
+
+	bind.Parameters = make([][]byte, len(params))
+	for i, p := range params {
+		v, err := p.encode(paramFormat(bind.ParameterFormatCodes, i))
+		if err != nil {
+			return nil, fmt.Errorf("params[%d]: %w", i, err)
+		}
+		bind.Parameters[i] = v
+	}
+
+	return bind, nil
+}
+
+// paramFormat return the format code of parameter i, as told by codes of
+// Bind
+func paramFormat(codes []int16, i int) int16 {
+	switch {
+	case len(codes) == 0:
+		return 0
+	case len(codes) == 1:
+		return codes[0]
+	case i < len(codes):
+		return codes[i]
+	}
+	return 0
+}
+
+// encode return the bytes of p in the text (0) or binary (1) format
+func (p bindParam) encode(format int16) ([]byte, error) {
+	if p.typ == "null" {
+		var null bool
+		if err := json.Unmarshal(p.value, &null); err != nil || !null {
+			return nil, errors.New(`null must be {"null":true}`)
+		}
+		return nil, nil
+	}
+
+	text := format == 0
+
+	switch p.typ {
+	case "text", "bytea":
+		var s string
+		if err := json.Unmarshal(p.value, &s); err != nil {
+			return nil, fmt.Errorf("%s must be string", p.typ)
+		}
+		if p.typ == "text" {
+			return []byte(s), nil
+		}
+
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, fmt.Errorf("bytea must be hex: %w", err)
+		}
+		if text {
+			return []byte(`\x` + s), nil
+		}
+		return b, nil
+
+	case "bool":
+		var v bool
+		if err := json.Unmarshal(p.value, &v); err != nil {
+			return nil, errors.New("bool must be true or false")
+		}
+		if text {
+			return []byte(map[bool]string{true: "t", false: "f"}[v]), nil
+		}
+		if v {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+
+	case "int2", "int4", "int8":
+		size := map[string]int{"int2": 2, "int4": 4, "int8": 8}[p.typ]
+		v, err := strconv.ParseInt(string(p.value), 10, size*8)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be integer: %s", p.typ, p.value)
+		}
+		if text {
+			return []byte(strconv.FormatInt(v, 10)), nil
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(v))
+		return b[8-size:], nil
+
+	case "float4", "float8":
+		bits := map[string]int{"float4": 32, "float8": 64}[p.typ]
+		v, err := strconv.ParseFloat(string(p.value), bits)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be number: %s", p.typ, p.value)
+		}
+		if text {
+			return []byte(strconv.FormatFloat(v, 'g', -1, bits)), nil
+		}
+		b := make([]byte, bits/8)
+		if bits == 32 {
+			binary.BigEndian.PutUint32(b, math.Float32bits(float32(v)))
+		} else {
+			binary.BigEndian.PutUint64(b, math.Float64bits(v))
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("unknown type %q", p.typ)
+}
+
+// decode write the bytes b of parameter as typed param like p, e.g.
+// {"int4":42}, or return false when b isn't a value of that type
+func (p bindParam) decode(b []byte, format int16) (string, bool) {
+	if b == nil {
+		return `{"null":true}`, true
+	}
+
+	var v interface{}
+	text := format == 0
+
+	switch p.typ {
+	case "null", "text":
+		v = string(b)
+		if p.typ == "null" {
+			// the value is not null, so it's shown as text
+			return fmt.Sprintf(`{"text":%s}`, jsonString(v)), true
+		}
+
+	case "bytea":
+		if text {
+			if !bytes.HasPrefix(b, []byte(`\x`)) {
+				return "", false
+			}
+			v = string(b[2:])
+		} else {
+			v = hex.EncodeToString(b)
+		}
+
+	case "bool":
+		switch {
+		case text && (string(b) == "t" || string(b) == "f"):
+			v = string(b) == "t"
+		case !text && len(b) == 1:
+			v = b[0] != 0
+		default:
+			return "", false
+		}
+
+	case "int2", "int4", "int8":
+		size := map[string]int{"int2": 2, "int4": 4, "int8": 8}[p.typ]
+		if text {
+			n, err := strconv.ParseInt(string(b), 10, size*8)
+			if err != nil {
+				return "", false
+			}
+			v = n
+		} else {
+			if len(b) != size {
+				return "", false
+			}
+			full := make([]byte, 8)
+			copy(full[8-size:], b)
+			n := int64(binary.BigEndian.Uint64(full))
+			v = n << (64 - size*8) >> (64 - size*8)
+		}
+
+	case "float4", "float8":
+		bits := map[string]int{"float4": 32, "float8": 64}[p.typ]
+		switch {
+		case text:
+			f, err := strconv.ParseFloat(string(b), bits)
+			if err != nil {
+				return "", false
+			}
+			v = f
+		case len(b) == 4 && bits == 32:
+			v = math.Float32frombits(binary.BigEndian.Uint32(b))
+		case len(b) == 8 && bits == 64:
+			v = math.Float64frombits(binary.BigEndian.Uint64(b))
+		default:
+			return "", false
+		}
+
+	default:
+		return "", false
+	}
+
+	return fmt.Sprintf(`{%q:%s}`, p.typ, jsonString(v)), true
+}
@@ -0,0 +1,449 @@
+package pgsnap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// postgresPort is the port of postgres, used by ImportPcap when port is 0
+const postgresPort = 5432
+
+// ImportPcap write the snapshot of the connection to postgres captured in
+// the pcap file src (e.g. by "tcpdump -w"), to be replayed like the
+// recorded one. The capture must have one connection to port, without TLS.
+// The authentication is left out, like in the recording.
+func ImportPcap(dst io.Writer, src io.Reader, port uint16) error {
+	if port == 0 {
+		port = postgresPort
+	}
+
+	segments, err := readPcap(src)
+	if err != nil {
+		return fmt.Errorf("pgsnap: %w", err)
+	}
+
+	front, back, err := pcapStreams(segments, port)
+	if err != nil {
+		return fmt.Errorf("pgsnap: %w", err)
+	}
+
+	frames, err := pcapFrames(front, back)
+	if err != nil {
+		return fmt.Errorf("pgsnap: %w", err)
+	}
+
+	out := &recording{}
+	for _, f := range frames {
+		msg, err := f.decode()
+		if err != nil {
+			return fmt.Errorf("pgsnap: %s message in packet %d: %w", f.dir, f.packet, err)
+		}
+		if msg != nil {
+			out.write(f.dir, msg)
+		}
+	}
+
+	if _, err := io.WriteString(dst, header{auth: AuthTrust}.String()+"\n"); err != nil {
+		return err
+	}
+	_, err = dst.Write(out.bytes())
+	return err
+}
+
+// link types of the pcap file, see https://www.tcpdump.org/linktypes.html
+const (
+	linkNull      = 0
+	linkEthernet  = 1
+	linkRaw       = 101
+	linkLinuxSLL  = 113
+	linkLinuxSLL2 = 276
+)
+
+// tcpSegment is TCP packet in the capture
+type tcpSegment struct {
+	packet  int
+	src     string
+	dst     string
+	srcPort uint16
+	dstPort uint16
+	seq     uint32
+	syn     bool
+	payload []byte
+}
+
+// readPcap return the TCP packets in the pcap file src
+func readPcap(src io.Reader) ([]tcpSegment, error) {
+	var head [24]byte
+	if _, err := io.ReadFull(src, head[:]); err != nil {
+		return nil, fmt.Errorf("can't read pcap header: %w", err)
+	}
+
+	var order binary.ByteOrder
+	switch magic := binary.LittleEndian.Uint32(head[:]); magic {
+	case 0xa1b2c3d4, 0xa1b23c4d:
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	case 0x0a0d0d0a:
+		return nil, errors.New("pcapng isn't supported, convert it with \"editcap -F pcap\"")
+	default:
+		return nil, fmt.Errorf("not a pcap file, magic %#x", magic)
+	}
+	link := order.Uint32(head[20:])
+
+	var segments []tcpSegment
+	for packet := 1; ; packet++ {
+		var rec [16]byte
+		if _, err := io.ReadFull(src, rec[:]); err == io.EOF {
+			return segments, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("packet %d: %w", packet, err)
+		}
+
+		size, origSize := order.Uint32(rec[8:]), order.Uint32(rec[12:])
+		if size < origSize {
+			return nil, fmt.Errorf("packet %d is truncated, capture with \"tcpdump -s 0\"", packet)
+		}
+
+		data := make([]byte, size)
+		if _, err := io.ReadFull(src, data); err != nil {
+			return nil, fmt.Errorf("packet %d: %w", packet, err)
+		}
+
+		seg, ok, err := decodePacket(link, data)
+		if err != nil {
+			return nil, fmt.Errorf("packet %d: %w", packet, err)
+		}
+		if ok {
+			seg.packet = packet
+			segments = append(segments, seg)
+		}
+	}
+}
+
+var errShortPacket = errors.New("packet is too short")
+
+// decodePacket return the TCP segment in the packet, ok is false for
+// packet that isn't TCP over IP
+func decodePacket(link uint32, b []byte) (seg tcpSegment, ok bool, err error) {
+	var ip []byte
+	switch link {
+	case linkNull:
+		if len(b) < 4 {
+			return seg, false, errShortPacket
+		}
+		ip = b[4:]
+	case linkEthernet:
+		if len(b) < 14 {
+			return seg, false, errShortPacket
+		}
+		etherType := binary.BigEndian.Uint16(b[12:])
+		ip = b[14:]
+		if etherType == 0x8100 && len(ip) >= 4 {
+			// 802.1Q VLAN tag
+			etherType, ip = binary.BigEndian.Uint16(ip[2:]), ip[4:]
+		}
+		if etherType != 0x0800 && etherType != 0x86dd {
+			return seg, false, nil
+		}
+	case linkRaw:
+		ip = b
+	case linkLinuxSLL:
+		if len(b) < 16 {
+			return seg, false, errShortPacket
+		}
+		ip = b[16:]
+	case linkLinuxSLL2:
+		if len(b) < 20 {
+			return seg, false, errShortPacket
+		}
+		ip = b[20:]
+	default:
+		return seg, false, fmt.Errorf("link type %d isn't supported", link)
+	}
+
+	return decodeIP(ip)
+}
+
+// decodeIP return the TCP segment in IPv4 or IPv6 packet b
+func decodeIP(b []byte) (seg tcpSegment, ok bool, err error) {
+	if len(b) == 0 {
+		return seg, false, errShortPacket
+	}
+
+	var src, dst net.IP
+	var tcp []byte
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return seg, false, errShortPacket
+		}
+		headerLen, total := int(b[0]&0x0f)*4, int(binary.BigEndian.Uint16(b[2:]))
+		if headerLen < 20 || total < headerLen || total > len(b) {
+			return seg, false, errShortPacket
+		}
+		if b[9] != 6 {
+			return seg, false, nil
+		}
+		if binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return seg, false, errors.New("fragmented IP packet isn't supported")
+		}
+		src, dst, tcp = net.IP(b[12:16]), net.IP(b[16:20]), b[headerLen:total]
+	case 6:
+		if len(b) < 40 {
+			return seg, false, errShortPacket
+		}
+		total := 40 + int(binary.BigEndian.Uint16(b[4:]))
+		if total > len(b) {
+			return seg, false, errShortPacket
+		}
+		// extension headers aren't used by TCP to postgres
+		if b[6] != 6 {
+			return seg, false, nil
+		}
+		src, dst, tcp = net.IP(b[8:24]), net.IP(b[24:40]), b[40:total]
+	default:
+		return seg, false, nil
+	}
+
+	if len(tcp) < 20 {
+		return seg, false, errShortPacket
+	}
+	offset := int(tcp[12]>>4) * 4
+	if offset < 20 || offset > len(tcp) {
+		return seg, false, errShortPacket
+	}
+
+	seg = tcpSegment{
+		srcPort: binary.BigEndian.Uint16(tcp[0:]),
+		dstPort: binary.BigEndian.Uint16(tcp[2:]),
+		seq:     binary.BigEndian.Uint32(tcp[4:]),
+		syn:     tcp[13]&0x02 != 0,
+		payload: tcp[offset:],
+	}
+	seg.src = net.JoinHostPort(src.String(), strconv.Itoa(int(seg.srcPort)))
+	seg.dst = net.JoinHostPort(dst.String(), strconv.Itoa(int(seg.dstPort)))
+
+	return seg, true, nil
+}
+
+// tcpStream is the data sent in one direction of the connection, put in
+// order of the sequence number
+type tcpStream struct {
+	started bool
+	next    uint32
+	data    []byte
+
+	// chunks tell the packet the data arrived in, in order
+	chunks []tcpChunk
+
+	// pending is the data that came before the data preceding it
+	pending map[uint32][]byte
+}
+
+// tcpChunk is the data of stream until end, arrived in packet
+type tcpChunk struct {
+	end    int
+	packet int
+}
+
+func (st *tcpStream) add(seg tcpSegment) {
+	if seg.syn {
+		st.started, st.next = true, seg.seq+1
+		return
+	}
+	if len(seg.payload) == 0 {
+		return
+	}
+	if !st.started {
+		// the capture started after the handshake
+		st.started, st.next = true, seg.seq
+	}
+
+	if st.pending == nil {
+		st.pending = map[uint32][]byte{}
+	}
+	if len(seg.payload) > len(st.pending[seg.seq]) {
+		st.pending[seg.seq] = seg.payload
+	}
+
+	for added := true; added; {
+		added = false
+		for seq, payload := range st.pending {
+			// the sequence number wraps around
+			late := int(int32(st.next - seq))
+			if late < 0 {
+				continue
+			}
+
+			delete(st.pending, seq)
+			if late < len(payload) {
+				st.data = append(st.data, payload[late:]...)
+				st.next += uint32(len(payload) - late)
+				st.chunks = append(st.chunks, tcpChunk{end: len(st.data), packet: seg.packet})
+				added = true
+			}
+		}
+	}
+}
+
+// packetOf return the packet the data until end arrived in
+func (st *tcpStream) packetOf(end int) int {
+	i := sort.Search(len(st.chunks), func(i int) bool { return st.chunks[i].end >= end })
+	return st.chunks[i].packet
+}
+
+// pcapStreams return the data sent by the client and by postgres, in the
+// only connection to port
+func pcapStreams(segments []tcpSegment, port uint16) (front, back *tcpStream, err error) {
+	front, back = &tcpStream{}, &tcpStream{}
+
+	client := ""
+	for _, seg := range segments {
+		var st *tcpStream
+		var from string
+		switch port {
+		case seg.dstPort:
+			st, from = front, seg.src
+		case seg.srcPort:
+			st, from = back, seg.dst
+		default:
+			continue
+		}
+
+		if client == "" {
+			client = from
+		}
+		if from != client {
+			return nil, nil, fmt.Errorf("capture has more than one connection to port %d (%s and %s), only one is supported", port, client, from)
+		}
+
+		st.add(seg)
+	}
+
+	if client == "" {
+		return nil, nil, fmt.Errorf("capture has no connection to port %d", port)
+	}
+	for _, st := range []*tcpStream{front, back} {
+		if len(st.pending) > 0 {
+			return nil, nil, errors.New("capture is missing some packets of the connection")
+		}
+	}
+
+	return front, back, nil
+}
+
+// pcapFrame is one message in the connection
+type pcapFrame struct {
+	dir     string
+	packet  int
+	startup bool
+	b       []byte
+}
+
+// gssEncRequest is the whole GSSENCRequest message, sent like SSLRequest
+// to ask for GSSAPI encryption
+var gssEncRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x30}
+
+const (
+	authenticationType = 'R'
+	passwordType       = 'p'
+	terminateType      = 'X'
+)
+
+// pcapFrames split the streams into messages, in the order they're sent
+func pcapFrames(front, back *tcpStream) ([]pcapFrame, error) {
+	var frames []pcapFrame
+
+	// the client send SSLRequest (or GSSENCRequest) before the startup,
+	// which is answered by one byte, before the first message
+	encRequests := 0
+	startup := true
+	for off := 0; off < len(front.data); {
+		n := 5
+		if startup {
+			n = 8
+		}
+		if off+n > len(front.data) {
+			return nil, errors.New("capture ends in the middle of message sent by the client")
+		}
+
+		size := 1 + int(binary.BigEndian.Uint32(front.data[off+1:]))
+		if startup {
+			size = int(binary.BigEndian.Uint32(front.data[off:]))
+		}
+		if size < n || off+size > len(front.data) {
+			return nil, errors.New("capture ends in the middle of message sent by the client")
+		}
+
+		f := pcapFrame{dir: "F", packet: front.packetOf(off + size), startup: startup, b: front.data[off : off+size]}
+		off += size
+
+		if startup {
+			switch {
+			case bytes.Equal(f.b, sslRequest), bytes.Equal(f.b, gssEncRequest):
+				encRequests++
+				continue
+			case bytes.HasPrefix(f.b, cancelRequestCode):
+				return nil, errors.New("the connection is a CancelRequest")
+			}
+			startup = false
+		}
+
+		frames = append(frames, f)
+	}
+
+	off := 0
+	for ; off < encRequests && off < len(back.data); off++ {
+		if back.data[off] != 'N' {
+			return nil, errors.New("the connection uses TLS, only the connection without TLS can be imported")
+		}
+	}
+	for off < len(back.data) {
+		if off+5 > len(back.data) {
+			return nil, errors.New("capture ends in the middle of message sent by postgres")
+		}
+		size := 1 + int(binary.BigEndian.Uint32(back.data[off+1:]))
+		if size < 5 || off+size > len(back.data) {
+			return nil, errors.New("capture ends in the middle of message sent by postgres")
+		}
+
+		frames = append(frames, pcapFrame{dir: "B", packet: back.packetOf(off + size), b: back.data[off : off+size]})
+		off += size
+	}
+
+	// the messages of one direction are already in order
+	sort.SliceStable(frames, func(i, j int) bool { return frames[i].packet < frames[j].packet })
+
+	return frames, nil
+}
+
+// decode return the message in the frame, or nil for the message that
+// isn't in the snapshot: the authentication and Terminate
+func (f pcapFrame) decode() (pgproto3.Message, error) {
+	r := pgproto3.NewChunkReader(bytes.NewReader(f.b))
+
+	if f.dir == "F" {
+		if f.startup {
+			return pgproto3.NewBackend(r, nil).ReceiveStartupMessage()
+		}
+		if f.b[0] == passwordType || f.b[0] == terminateType {
+			return nil, nil
+		}
+		return pgproto3.NewBackend(r, nil).Receive()
+	}
+
+	// only AuthenticationOk is kept, authentication is done by pgsnap
+	if f.b[0] == authenticationType && (len(f.b) < 9 || binary.BigEndian.Uint32(f.b[5:]) != 0) {
+		return nil, nil
+	}
+	return pgproto3.NewFrontend(r, nil).Receive()
+}
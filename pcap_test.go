@@ -0,0 +1,174 @@
+package pgsnap
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgproto3/v2"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pcapWriter write the packets of one connection from 10.0.0.1:50000 to
+// postgres at 10.0.0.2:5432, as captured by tcpdump on ethernet
+type pcapWriter struct {
+	buf bytes.Buffer
+	seq [2]uint32
+}
+
+// newPcapWriter start the capture with the handshake. The sequence number
+// of postgres wraps around after the first few messages.
+func newPcapWriter() *pcapWriter {
+	w := &pcapWriter{seq: [2]uint32{1000, 0xfffffff0}}
+
+	head := make([]byte, 24)
+	binary.LittleEndian.PutUint32(head[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(head[4:], 2)
+	binary.LittleEndian.PutUint16(head[6:], 4)
+	binary.LittleEndian.PutUint32(head[16:], 65535)
+	binary.LittleEndian.PutUint32(head[20:], linkEthernet)
+	w.buf.Write(head)
+
+	w.packet(0, w.seq[0], 0x02, nil)
+	w.packet(1, w.seq[1], 0x12, nil)
+	w.seq[0]++
+	w.seq[1]++
+
+	return w
+}
+
+// send write msgs sent by the client (dir 0) or by postgres (dir 1) in one
+// packet, and return the sequence number of the packet
+func (w *pcapWriter) send(dir int, msgs ...[]byte) uint32 {
+	payload := bytes.Join(msgs, nil)
+	seq := w.seq[dir]
+	w.packet(dir, seq, 0x18, payload)
+	w.seq[dir] += uint32(len(payload))
+	return seq
+}
+
+func (w *pcapWriter) packet(dir int, seq uint32, flags byte, payload []byte) {
+	ports := [2]uint16{50000, 5432}
+	ips := [2][]byte{{10, 0, 0, 1}, {10, 0, 0, 2}}
+
+	tcp := make([]byte, 20)
+	binary.BigEndian.PutUint16(tcp[0:], ports[dir])
+	binary.BigEndian.PutUint16(tcp[2:], ports[1-dir])
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	tcp = append(tcp, payload...)
+
+	ip := make([]byte, 20)
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(20+len(tcp)))
+	ip[8] = 64
+	ip[9] = 6
+	copy(ip[12:], ips[dir])
+	copy(ip[16:], ips[1-dir])
+	ip = append(ip, tcp...)
+
+	frame := append(make([]byte, 12), 0x08, 0x00)
+	frame = append(frame, ip...)
+
+	rec := make([]byte, 16)
+	binary.LittleEndian.PutUint32(rec[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(rec[12:], uint32(len(frame)))
+	w.buf.Write(rec)
+	w.buf.Write(frame)
+}
+
+func encode(msg interface{ Encode([]byte) []byte }) []byte {
+	return msg.Encode(nil)
+}
+
+func TestImportPcap(t *testing.T) {
+	w := newPcapWriter()
+	w.send(0, sslRequest)
+	w.send(1, []byte("N"))
+	w.send(0, encode(&pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: map[string]string{"user": "user"}}))
+	w.send(1, encode(&pgproto3.AuthenticationMD5Password{Salt: [4]byte{1, 2, 3, 4}}))
+	w.send(0, encode(&pgproto3.PasswordMessage{Password: "md5secret"}))
+	w.send(1,
+		encode(&pgproto3.AuthenticationOk{}),
+		encode(&pgproto3.ParameterStatus{Name: "server_version", Value: "14.5"}),
+		encode(&pgproto3.BackendKeyData{ProcessID: 1, SecretKey: 2}),
+		encode(&pgproto3.ReadyForQuery{TxStatus: 'I'}),
+	)
+
+	// the query is sent again, as it's not acked
+	query := encode(&pgproto3.Query{String: "select 1"})
+	seq := w.send(0, query)
+	w.packet(0, seq, 0x18, query)
+
+	// the result is split, and the second half arrive first
+	result := bytes.Join([][]byte{
+		encode(&pgproto3.RowDescription{Fields: []pgproto3.FieldDescription{{Name: []byte("?column?"), DataTypeOID: 23, DataTypeSize: 4, TypeModifier: -1}}}),
+		encode(&pgproto3.DataRow{Values: [][]byte{[]byte("1")}}),
+		encode(&pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")}),
+		encode(&pgproto3.ReadyForQuery{TxStatus: 'I'}),
+	}, nil)
+	seq = w.seq[1]
+	w.packet(1, seq+20, 0x18, result[20:])
+	w.packet(1, seq, 0x18, result[:20])
+	w.seq[1] += uint32(len(result))
+
+	w.send(0, encode(&pgproto3.Terminate{}))
+
+	var out bytes.Buffer
+	require.NoError(t, ImportPcap(&out, &w.buf, 0))
+
+	expected, err := os.ReadFile("TestImportPcap.txt")
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), out.String())
+
+	require.NoError(t, os.MkdirAll("TestImportPcap", 0755))
+	t.Cleanup(func() { os.RemoveAll("TestImportPcap") })
+	require.NoError(t, os.WriteFile("TestImportPcap/replay.txt", out.Bytes(), 0644))
+
+	t.Run("replay", func(t *testing.T) {
+		s := NewSnap(t, addr)
+		defer s.Finish()
+
+		db, err := pgx.Connect(context.TODO(), s.DSN())
+		require.NoError(t, err)
+		defer db.Close(context.TODO())
+
+		assert.Equal(t, "14.5", db.PgConn().ParameterStatus("server_version"))
+
+		results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, "1", string(results[0].Rows[0][0]))
+	})
+}
+
+func TestImportPcap_errors(t *testing.T) {
+	var out bytes.Buffer
+
+	err := ImportPcap(&out, bytes.NewReader([]byte{0x0a, 0x0d, 0x0d, 0x0a, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), 0)
+	require.Error(t, err)
+	assert.Equal(t, `pgsnap: pcapng isn't supported, convert it with "editcap -F pcap"`, err.Error())
+
+	err = ImportPcap(&out, &newPcapWriter().buf, 5433)
+	require.Error(t, err)
+	assert.Equal(t, "pgsnap: capture has no connection to port 5433", err.Error())
+
+	w := newPcapWriter()
+	w.send(0, sslRequest)
+	w.send(1, []byte("S"))
+	err = ImportPcap(&out, &w.buf, 0)
+	require.Error(t, err)
+	assert.Equal(t, "pgsnap: the connection uses TLS, only the connection without TLS can be imported", err.Error())
+
+	w = newPcapWriter()
+	w.seq[0] += 10
+	w.send(0, encode(&pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber}))
+	err = ImportPcap(&out, &w.buf, 0)
+	require.Error(t, err)
+	assert.Equal(t, "pgsnap: capture is missing some packets of the connection", err.Error())
+}
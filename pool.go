@@ -0,0 +1,115 @@
+package pgsnap
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// dataRowPool keep the decoders of the DataRow lines sent by rowsStep, so
+// the rows of every replay reuse the memory of the rows decoded before
+var dataRowPool = sync.Pool{
+	New: func() interface{} { return &dataRowDecoder{} },
+}
+
+// dataRowDecoder read DataRow lines like unmarshalB, into the same row. The
+// values of the row and the JSON read keep their capacity for the next
+// line, so a row is decoded without allocating once they're big enough.
+type dataRowDecoder struct {
+	row pgproto3.DataRow
+
+	line struct {
+		Type   json.RawMessage
+		Values []json.RawMessage
+	}
+	value struct {
+		Text   json.RawMessage `json:"text"`
+		Binary json.RawMessage `json:"binary"`
+	}
+	text []byte
+}
+
+// decode read the DataRow of src. The row is reused by the next decode, so
+// it must not be kept after that.
+func (d *dataRowDecoder) decode(src []byte) (*pgproto3.DataRow, error) {
+	d.line.Type = d.line.Type[:0]
+	d.line.Values = d.line.Values[:0]
+	if err := json.Unmarshal(src, &d.line); err != nil {
+		return nil, err
+	}
+	if string(d.line.Type) != `"DataRow"` {
+		return nil, errRowsChanged
+	}
+
+	values := d.row.Values[:0]
+	for _, raw := range d.line.Values {
+		var buf []byte
+		if len(values) < cap(values) {
+			buf = values[:len(values)+1][len(values)]
+		}
+
+		v, err := d.decodeValue(raw, buf[:0])
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	d.row.Values = values
+
+	return &d.row, nil
+}
+
+// decodeValue append the value of raw to buf, like pgproto3 does for the
+// values of DataRow
+func (d *dataRowDecoder) decodeValue(raw, buf []byte) ([]byte, error) {
+	if string(raw) == "null" {
+		return nil, nil
+	}
+	// the empty value isn't NULL
+	if buf == nil {
+		buf = []byte{}
+	}
+
+	d.value.Text = d.value.Text[:0]
+	d.value.Binary = d.value.Binary[:0]
+	if err := json.Unmarshal(raw, &d.value); err != nil {
+		return nil, err
+	}
+
+	switch {
+	case len(d.value.Text) > 0:
+		return appendString(buf, d.value.Text)
+	case len(d.value.Binary) > 0:
+		var err error
+		d.text, err = appendString(d.text[:0], d.value.Binary)
+		if err != nil {
+			return nil, err
+		}
+		n := hex.DecodedLen(len(d.text))
+		if cap(buf) < n {
+			buf = make([]byte, n)
+		}
+		_, err = hex.Decode(buf[:n], d.text)
+		return buf[:n], err
+	}
+
+	return nil, errors.New("unknown protocol representation")
+}
+
+// appendString append the JSON string raw to buf. Only the string with
+// escapes is decoded by encoding/json.
+func appendString(buf, raw []byte) ([]byte, error) {
+	if len(raw) >= 2 && raw[0] == '"' && bytes.IndexByte(raw, '\\') < 0 {
+		return append(buf, raw[1:len(raw)-1]...), nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return nil, err
+	}
+	return append(buf, s...), nil
+}
@@ -1,102 +1,658 @@
 package pgsnap
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
-	"io"
+	"fmt"
+	"math/big"
 	"net"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
 
+	"github.com/jackc/pgmock"
 	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgx/v4"
 )
 
-func (s *Snap) runProxy(url string) {
-	s.writeMode = true
+// recording keep the messages of one proxied connection, in the same
+// format read by readScript. The messages of the client and of postgres
+// are written by their own goroutine, see runConversation.
+type recording struct {
+	mu     sync.Mutex
+	format Format
 
-	out, err := os.Create(s.getFilename())
-	if err != nil {
-		s.t.Fatalf("can't create file %s: %v", s.getFilename(), err)
+	// section is the name given to Use, the recording has no message
+	section string
+
+	// seq is the sequence number given to the next line. The lines of
+	// each direction are kept in the order they are received, and merged
+	// by their sequence number by bytes, so the interleaving of both
+	// directions is the order they are written.
+	seq      uint64
+	frontend []*recordedLine
+	backend  []*recordedLine
+
+	// pipeline is set while the client sends a batch of extended protocol
+	// messages, until its Sync or Flush. The messages of postgres are held
+	// in held until then, so the batch is written before its responses.
+	pipeline bool
+	held     []*recordedLine
+
+	// startup is the sequence number of the last line of the startup,
+	// once started is set, see StartRecording
+	startup uint64
+	started bool
+}
+
+// recordedLine is one line of the recording, with its sequence number
+type recordedLine struct {
+	seq uint64
+	b   []byte
+}
+
+func (r *recording) write(prefix string, msg pgproto3.Message) {
+	// the line is encoded without the lock, so a direction doesn't wait
+	// for the other, and before msg is reused by the next Receive
+	line := &recordedLine{b: r.encode(prefix, msg)}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if prefix == "B" {
+		r.backend = append(r.backend, line)
+		if r.pipeline {
+			r.held = append(r.held, line)
+			return
+		}
+	} else {
+		r.frontend = append(r.frontend, line)
+	}
+
+	line.seq = r.next()
+
+	if prefix != "F" {
+		return
+	}
+
+	switch msg.(type) {
+	case *pgproto3.Parse, *pgproto3.Bind, *pgproto3.Describe, *pgproto3.Execute, *pgproto3.Close:
+		r.pipeline = true
+	default:
+		r.pipeline = false
+		r.release()
+	}
+}
+
+// next return the next sequence number
+func (r *recording) next() uint64 {
+	r.seq++
+	return r.seq
+}
+
+// release give the held lines their sequence number, after the lines
+// written before
+func (r *recording) release() {
+	for _, held := range r.held {
+		held.seq = r.next()
+	}
+	r.held = nil
+}
+
+func (r *recording) encode(prefix string, msg pgproto3.Message) []byte {
+	if r.format == FormatText {
+		if text, ok := toText(msg); ok {
+			return []byte(text + "\n")
+		}
 	}
 
+	b, _ := marshalJSON(msg)
+
+	line := make([]byte, 0, len(prefix)+len(b)+2)
+	line = append(line, prefix...)
+	line = append(line, ' ')
+	line = append(line, b...)
+	return append(line, '\n')
+}
+
+func (r *recording) bytes() []byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// the client may never end the batch, e.g. when it's closed
+	r.release()
+
+	var buf bytes.Buffer
+	fe, be := r.frontend, r.backend
+	for len(fe) > 0 || len(be) > 0 {
+		if len(be) == 0 || len(fe) > 0 && fe[0].seq < be[0].seq {
+			buf.Write(fe[0].b)
+			fe = fe[1:]
+			continue
+		}
+		buf.Write(be[0].b)
+		be = be[1:]
+	}
+
+	return buf.Bytes()
+}
+
+func (s *Snap) runProxy(url string) error {
+	s.writeMode = true
+
+	// connect once here, so wrong url fail the test right away
 	db, err := pgx.Connect(context.TODO(), url)
 	if err != nil {
-		s.t.Fatalf("can't connect to db %s: %v", url, err)
+		return fmt.Errorf("can't connect to db %s: %w", url, err)
+	}
+
+	s.start(func() { s.acceptConnForProxy(url, db) })
+	return nil
+}
+
+// acceptConnForProxy proxy every connection from the client to its own
+// connection to the real postgres. The first connection use db.
+func (s *Snap) acceptConnForProxy(url string, db *pgx.Conn) {
+	for {
+		raw, conn, err := s.accept()
+		if err != nil {
+			if db != nil {
+				db.Close(context.TODO())
+			}
+			s.report(err)
+			return
+		}
+
+		if db == nil {
+			db, err = pgx.Connect(context.TODO(), url)
+			if err != nil {
+				s.untrack(raw)
+				s.report(err)
+				return
+			}
+		}
+
+		upstream, out := db, s.newRecording()
+		s.start(func() { s.proxyConn(raw, conn, upstream, out) })
+		db = nil
 	}
+}
+
+func (s *Snap) newRecording() *recording {
+	s.recordingsMu.Lock()
+	defer s.recordingsMu.Unlock()
 
-	go s.acceptConnForProxy(db, out)
+	r := &recording{format: s.cfg.format}
+	s.recordings = append(s.recordings, r)
+	return r
 }
 
-func (s *Snap) acceptConnForProxy(db *pgx.Conn, out io.Writer) {
-	conn, err := s.l.Accept()
+func (s *Snap) proxyConn(raw, conn net.Conn, db *pgx.Conn, out *recording) {
+	defer s.untrack(raw)
+	defer conn.Close()
+	defer db.PgConn().Conn().Close()
+
+	s.addUpstream(db)
+	defer s.removeUpstream(db)
+
+	be, err := s.prepareBackend(conn, out)
 	if err != nil {
-		s.errchan <- err
+		s.report(err)
 		return
 	}
 
-	be := s.prepareBackend(conn)
+	fe, upstream := s.prepareFrontend(db)
 
-	fe := s.prepareFrontend(db)
-
-	s.runConversation(fe, be, out)
+	s.runConversation(fe, upstream, be, out)
 }
 
-func (s *Snap) runConversation(fe *pgproto3.Frontend, be *pgproto3.Backend, out io.Writer) {
-	go s.streamBEtoFE(fe, be, out)
-	go s.streamFEtoBE(fe, be, out)
+// runConversation proxy messages in both direction until one of the side
+// close the connection
+func (s *Snap) runConversation(fe *pgproto3.Frontend, raw *rawReader, be *pgproto3.Backend, out *recording) {
+	done := make(chan struct{}, 2)
+
+	s.start(func() {
+		s.streamBEtoFE(fe, be, out)
+		done <- struct{}{}
+	})
+	s.start(func() {
+		s.streamFEtoBE(fe, raw, be, out)
+		done <- struct{}{}
+	})
+
+	<-done
 }
 
-func (s *Snap) streamBEtoFE(fe *pgproto3.Frontend, be *pgproto3.Backend, out io.Writer) {
+// streamBEtoFE receive messages from the client and send it to postgres
+func (s *Snap) streamBEtoFE(fe *pgproto3.Frontend, be *pgproto3.Backend, out *recording) {
 	for {
 		msg, err := be.Receive()
 		if err != nil {
-			s.errchan <- err
-			continue
+			return
 		}
 
-		out.Write([]byte("\nF "))
+		// Terminate is sent when the client close the connection, it's
+		// not part of the conversation
+		if _, ok := msg.(*pgproto3.Terminate); ok {
+			fe.Send(msg)
+			return
+		}
 
-		b, _ := json.Marshal(msg)
-		out.Write(b)
+		s.stats.add(msg)
+		out.write("F", s.redact(msg))
 
-		if msg != nil {
-			fe.Send(msg)
+		err = fe.Send(msg)
+		if err != nil {
+			return
 		}
 	}
 }
 
-func (s *Snap) streamFEtoBE(fe *pgproto3.Frontend, be *pgproto3.Backend, out io.Writer) {
+// streamFEtoBE receive messages from postgres and send it to the client.
+// The messages that can't be replayed are recorded as set by
+// WithUnknownMessagePolicy.
+func (s *Snap) streamFEtoBE(fe *pgproto3.Frontend, raw *rawReader, be *pgproto3.Backend, out *recording) {
+	policy := s.cfg.unknownMessages
+
+	// the columns of the last RowDescription blanked in the recording
+	var ignored map[int]bool
+
 	for {
 		msg, err := fe.Receive()
 		if err != nil {
-			s.errchan <- err
-			continue
+			m, ok := raw.unknown(err)
+			if !ok || policy == UnknownMessageFail {
+				return
+			}
+			msg = m
 		}
 
-		out.Write([]byte("\nB "))
+		_, unknown := msg.(*unknownMessage)
+		if unknown || (policy != UnknownMessageFail && !s.replayable(msg)) {
+			m, ok := raw.message()
+			if !ok {
+				return
+			}
+			msg = m
+			if policy == UnknownMessageSkip {
+				s.t.Logf("pgsnap: message %q of postgres is left out of the snapshot", m.MsgType)
+				if err := be.Send(msg); err != nil {
+					return
+				}
+				continue
+			}
+		}
 
-		b, _ := json.Marshal(msg)
-		out.Write(b)
+		switch m := msg.(type) {
+		case *pgproto3.RowDescription:
+			ignored = s.ignoredColumns(m)
+			out.write("B", msg)
+		case *pgproto3.DataRow:
+			out.write("B", blankColumns(m, ignored))
+		default:
+			out.write("B", msg)
+		}
 
-		if msg != nil {
-			be.Send(msg)
+		err = be.Send(msg)
+		if err != nil {
+			return
 		}
 	}
 }
 
-func (s *Snap) prepareBackend(conn net.Conn) *pgproto3.Backend {
-	be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+func (s *Snap) redact(msg pgproto3.FrontendMessage) pgproto3.FrontendMessage {
+	if s.cfg.redactor == nil {
+		return msg
+	}
+	return s.cfg.redactor(msg)
+}
+
+// prepareBackend do the startup with the client, just like the replay,
+// because the real postgres connection is already started by pgx. The
+// startup is written to out.
+func (s *Snap) prepareBackend(conn net.Conn, out *recording) (*pgproto3.Backend, error) {
+	be := s.newBackend(conn)
 
-	// expect startup message
-	_, _ = be.ReceiveStartupMessage()
-	be.Send(&pgproto3.AuthenticationOk{})
-	be.Send(&pgproto3.BackendKeyData{ProcessID: 0, SecretKey: 0})
-	be.Send(&pgproto3.ReadyForQuery{TxStatus: 'I'})
+	startup := &pgmock.Script{Steps: s.startupSteps()}
+	if err := startup.Run(be); err != nil {
+		return be, err
+	}
 
-	return be
+	writeStartup(out, startup.Steps)
+	out.endStartup()
+	return be, nil
 }
 
-func (s *Snap) prepareFrontend(db *pgx.Conn) *pgproto3.Frontend {
+func (s *Snap) prepareFrontend(db *pgx.Conn) (*pgproto3.Frontend, *rawReader) {
 	conn := db.PgConn().Conn()
-	return pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	raw := &rawReader{cr: pgproto3.NewChunkReader(conn)}
+	return pgproto3.NewFrontend(raw, conn), raw
+}
+
+// saveRecording write every recorded connection into the snapshot file
+func (s *Snap) saveRecording() error {
+	s.recordingsMu.Lock()
+	defer s.recordingsMu.Unlock()
+
+	var buf bytes.Buffer
+	buf.WriteString(header{auth: s.cfg.auth}.String() + "\n")
+	first := true
+	for _, r := range s.recordings {
+		if r.section != "" {
+			buf.WriteString(sectionLine(r.section) + "\n")
+			first = true
+			continue
+		}
+
+		if !first {
+			buf.WriteString("C\n")
+		}
+		first = false
+		buf.Write(r.bytes())
+	}
+
+	filename := s.getFilename()
+
+	old, err := os.ReadFile(filename)
+	if err == nil {
+		old, err = gunzip(old)
+	}
+	if err == nil && s.isYAML() {
+		old = yamlLines(old)
+	}
+	if err == nil && s.sameRecording(old, buf.Bytes()) {
+		return nil
+	}
+
+	data := buf.Bytes()
+	if s.isYAML() {
+		data, err = toYAML(recordingLines(data))
+		if err != nil {
+			return err
+		}
+	}
+	if strings.HasSuffix(filename, gzipExt) {
+		data, err = gzipBytes(data)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filename, data, 0644)
+}
+
+// sameRecording tell whether a and b have the same messages, ignoring
+// blank lines and JSON formatting, so updating a snapshot that doesn't
+// change keep the file as it is. Values of the columns ignored with
+// WithIgnoreColumns are not compared.
+func (s *Snap) sameRecording(a, b []byte) bool {
+	linesA, linesB := recordingLines(a), recordingLines(b)
+
+	// snapshot without header is kept when only the startup is missing
+	if len(linesA) > 0 && !isHeader(linesA[0]) {
+		linesB = s.withoutStartup(linesB)
+	}
+
+	if len(linesA) != len(linesB) {
+		return false
+	}
+
+	var ignored, numeric map[int]bool
+
+	for i := range linesA {
+		msgA, msgB := s.decodeBackendLine(linesA[i]), s.decodeBackendLine(linesB[i])
+
+		if rd, ok := msgB.(*pgproto3.RowDescription); ok {
+			ignored = s.ignoredColumns(rd)
+			numeric = numericColumns(rd)
+		}
+
+		rowA, okA := msgA.(*pgproto3.DataRow)
+		rowB, okB := msgB.(*pgproto3.DataRow)
+		if okA && okB {
+			skipped := wildcardColumns(linesA[i], ignored)
+			if len(skipped) > 0 || len(numeric) > 0 {
+				if !sameDataRow(rowA, rowB, skipped, numeric) {
+					return false
+				}
+				continue
+			}
+		}
+
+		_, okA = msgA.(*pgproto3.RowDescription)
+		_, okB = msgB.(*pgproto3.RowDescription)
+		if okA && okB && len(s.cfg.ignoreRowDescriptionFields) > 0 {
+			if !sameRowDescription(linesA[i], linesB[i], s.cfg.ignoreRowDescriptionFields) {
+				return false
+			}
+			continue
+		}
+
+		if !sameLine(linesA[i], linesB[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// sameRowDescription compare RowDescription lines a and b, without the
+// attributes of the fields ignored with WithIgnoreRowDescriptionFields
+func sameRowDescription(a, b []byte, ignored []string) bool {
+	var rdA, rdB struct {
+		Fields []map[string]interface{}
+	}
+	if json.Unmarshal(a[1:], &rdA) != nil || json.Unmarshal(b[1:], &rdB) != nil {
+		return false
+	}
+
+	if len(rdA.Fields) != len(rdB.Fields) {
+		return false
+	}
+
+	for i := range rdA.Fields {
+		for _, name := range ignored {
+			delete(rdA.Fields[i], name)
+			delete(rdB.Fields[i], name)
+		}
+	}
+
+	return reflect.DeepEqual(rdA.Fields, rdB.Fields)
+}
+
+// decodeBackendLine return the message in B line, or nil for other line
+func (s *Snap) decodeBackendLine(line []byte) pgproto3.BackendMessage {
+	if line[0] != 'B' {
+		return nil
+	}
+
+	msg, err := s.unmarshalB(line[1:])
+	if err != nil {
+		return nil
+	}
+
+	return msg
+}
+
+// ignoredColumns return the index of columns in rd ignored with
+// WithIgnoreColumns or WithIgnoreColumnIndexes
+func (s *Snap) ignoredColumns(rd *pgproto3.RowDescription) map[int]bool {
+	ignored := map[int]bool{}
+
+	for _, i := range s.cfg.ignoreColumnIndexes {
+		ignored[i] = true
+	}
+
+	for i, f := range rd.Fields {
+		for _, name := range s.cfg.ignoreColumns {
+			if string(f.Name) == name {
+				ignored[i] = true
+			}
+		}
+	}
+
+	return ignored
+}
+
+// blankColumns return row with the values of the ignored columns empty,
+// for the recording. NULL is kept as it is.
+func blankColumns(row *pgproto3.DataRow, ignored map[int]bool) *pgproto3.DataRow {
+	if len(ignored) == 0 {
+		return row
+	}
+
+	blanked := *row
+	blanked.Values = make([][]byte, len(row.Values))
+	for i, v := range row.Values {
+		blanked.Values[i] = v
+		if ignored[i] && v != nil {
+			blanked.Values[i] = []byte{}
+		}
+	}
+	return &blanked
+}
+
+// wildcardColumns return ignored with the columns of DataRow line that
+// match any value, e.g. {"text":"2f1c...","match":"*"}
+func wildcardColumns(line []byte, ignored map[int]bool) map[int]bool {
+	var row struct {
+		Values []map[string]string
+	}
+	if json.Unmarshal(line[1:], &row) != nil {
+		return ignored
+	}
+
+	columns := map[int]bool{}
+	for i := range ignored {
+		columns[i] = true
+	}
+	for i, v := range row.Values {
+		if v["match"] == "*" {
+			columns[i] = true
+		}
+	}
+	return columns
+}
+
+// OID of the numeric types
+const (
+	oidFloat4  = 700
+	oidFloat8  = 701
+	oidNumeric = 1700
+)
+
+// numericColumns return the index of float4, float8 and numeric columns in
+// rd sent in text format
+func numericColumns(rd *pgproto3.RowDescription) map[int]bool {
+	numeric := map[int]bool{}
+	for i, f := range rd.Fields {
+		switch f.DataTypeOID {
+		case oidFloat4, oidFloat8, oidNumeric:
+			if f.Format == 0 {
+				numeric[i] = true
+			}
+		}
+	}
+	return numeric
+}
+
+// sameDataRow compare the values of a and b, except the ignored columns.
+// The numeric columns are compared as numbers, so 1.5 and 1.50 are the same.
+func sameDataRow(a, b *pgproto3.DataRow, ignored, numeric map[int]bool) bool {
+	if len(a.Values) != len(b.Values) {
+		return false
+	}
+
+	for i := range a.Values {
+		if ignored[i] || bytes.Equal(a.Values[i], b.Values[i]) {
+			continue
+		}
+		if numeric[i] && sameNumber(a.Values[i], b.Values[i]) {
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+// sameNumber tell whether a and b are the same number, e.g. 1e3 and 1000.
+// NaN and Infinity are compared as they are.
+func sameNumber(a, b []byte) bool {
+	if a == nil || b == nil {
+		return false
+	}
+
+	x, okA := new(big.Rat).SetString(string(a))
+	y, okB := new(big.Rat).SetString(string(b))
+	return okA && okB && x.Cmp(y) == 0
+}
+
+// withoutStartup return lines of V1 snapshot without the header and the
+// startup of every connection
+func (s *Snap) withoutStartup(lines [][]byte) [][]byte {
+	if len(lines) == 0 || !isHeader(lines[0]) {
+		return lines
+	}
+
+	var result [][]byte
+	startup := true
+	for _, line := range lines[1:] {
+		if _, section := parseSection(line); section || line[0] == 'C' {
+			result = append(result, line)
+			startup = true
+			continue
+		}
+
+		if startup {
+			_, rfq := s.decodeBackendLine(line).(*pgproto3.ReadyForQuery)
+			startup = !rfq
+			continue
+		}
+
+		result = append(result, line)
+	}
+
+	return result
+}
+
+// recordingLines return the lines of snapshot b in JSON, without blank
+// lines
+func recordingLines(b []byte) [][]byte {
+	text, err := fromText(b)
+	if err != nil {
+		text = nil
+		for i, line := range bytes.Split(b, []byte("\n")) {
+			text = append(text, textLine{line: i + 1, b: bytes.TrimSpace(line)})
+		}
+	}
+
+	var lines [][]byte
+	for _, line := range text {
+		if len(line.b) > 0 {
+			lines = append(lines, line.b)
+		}
+	}
+	return lines
+}
+
+func sameLine(a, b []byte) bool {
+	if a[0] != b[0] {
+		return false
+	}
+
+	var msgA, msgB interface{}
+	if json.Unmarshal(a[1:], &msgA) != nil || json.Unmarshal(b[1:], &msgB) != nil {
+		return bytes.Equal(a, b)
+	}
+
+	return reflect.DeepEqual(msgA, msgB)
 }
@@ -0,0 +1,152 @@
+package pgsnap
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// QueryPatternPrefix marks the SQL of Query or Parse in the script as a
+// regular expression, e.g. "~select \\* from t where id in \\(.*\\)". The
+// pattern must match the whole SQL sent by the client.
+const QueryPatternPrefix = "~"
+
+// queryOf return the SQL of Query and Parse message
+func queryOf(msg pgproto3.FrontendMessage) (string, bool) {
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		return m.String, true
+	case *pgproto3.Parse:
+		return m.Query, true
+	}
+
+	return "", false
+}
+
+// withQuery return a copy of msg with its SQL replaced by q
+func withQuery(msg pgproto3.FrontendMessage, q string) pgproto3.FrontendMessage {
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		n := *m
+		n.String = q
+		return &n
+	case *pgproto3.Parse:
+		n := *m
+		n.Query = q
+		return &n
+	}
+
+	return msg
+}
+
+// queryPattern compile the SQL of want when it's prefixed with
+// QueryPatternPrefix, or return nil for exact matching
+func queryPattern(want pgproto3.FrontendMessage) (*regexp.Regexp, error) {
+	q, ok := queryOf(want)
+	if !ok || !strings.HasPrefix(q, QueryPatternPrefix) {
+		return nil, nil
+	}
+
+	re, err := regexp.Compile("^(?:" + strings.TrimPrefix(q, QueryPatternPrefix) + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("pgsnap: invalid query pattern %q: %w", q, err)
+	}
+
+	return re, nil
+}
+
+// normalizeQuery return a copy of msg with the whitespace of its SQL
+// collapsed by normalizeSQL
+func normalizeQuery(msg pgproto3.FrontendMessage) pgproto3.FrontendMessage {
+	q, ok := queryOf(msg)
+	if !ok {
+		return msg
+	}
+
+	return withQuery(msg, normalizeSQL(q))
+}
+
+// normalizeSQL collapse every run of whitespace into one space and trim
+// the SQL, with one trailing semicolon. Whitespace and semicolon inside
+// quoted string, quoted identifier and dollar quoted block is kept as it
+// is.
+func normalizeSQL(q string) string {
+	var b strings.Builder
+	space := false
+	// the last token is ; outside of quotes
+	semicolon := false
+
+	for i := 0; i < len(q); {
+		c := q[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			space = true
+			i++
+			continue
+
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(q[i+1:], c)
+			if end < 0 {
+				end = len(q)
+			} else {
+				end += i + 2
+			}
+			writeToken(&b, q[i:end], &space)
+			semicolon = false
+			i = end
+			continue
+
+		case c == '$':
+			if tag := dollarTag(q[i:]); tag != "" {
+				end := strings.Index(q[i+len(tag):], tag)
+				if end < 0 {
+					end = len(q)
+				} else {
+					end += i + 2*len(tag)
+				}
+				writeToken(&b, q[i:end], &space)
+				semicolon = false
+				i = end
+				continue
+			}
+		}
+
+		writeToken(&b, q[i:i+1], &space)
+		semicolon = c == ';'
+		i++
+	}
+
+	if semicolon {
+		return strings.TrimSuffix(strings.TrimSuffix(b.String(), ";"), " ")
+	}
+	return b.String()
+}
+
+func writeToken(b *strings.Builder, token string, space *bool) {
+	if *space && b.Len() > 0 {
+		b.WriteByte(' ')
+	}
+	*space = false
+	b.WriteString(token)
+}
+
+// dollarTag return the opening tag ($$ or $name$) at the start of q, or
+// empty string when q doesn't start a dollar quoted block ($1 parameter)
+func dollarTag(q string) string {
+	for i := 1; i < len(q); i++ {
+		c := q[i]
+		switch {
+		case c == '$':
+			return q[:i+1]
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= 0x80:
+		case c >= '0' && c <= '9' && i > 1:
+		default:
+			return ""
+		}
+	}
+
+	return ""
+}
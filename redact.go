@@ -0,0 +1,29 @@
+package pgsnap
+
+import "github.com/jackc/pgproto3/v2"
+
+// Redacted replace the value hidden by a redactor in the snapshot. On
+// replay, redacted value match any value sent by the client.
+const Redacted = "[redacted]"
+
+// Redactor return msg to be written in the snapshot instead of msg sent
+// by the client. It must not modify msg, but return a modified copy.
+type Redactor func(msg pgproto3.FrontendMessage) pgproto3.FrontendMessage
+
+// RedactBindParameters is Redactor that hide every parameter of Bind
+func RedactBindParameters(msg pgproto3.FrontendMessage) pgproto3.FrontendMessage {
+	bind, ok := msg.(*pgproto3.Bind)
+	if !ok {
+		return msg
+	}
+
+	redacted := *bind
+	redacted.Parameters = make([][]byte, len(bind.Parameters))
+	for i, p := range bind.Parameters {
+		if p != nil {
+			redacted.Parameters[i] = []byte(Redacted)
+		}
+	}
+
+	return &redacted
+}
@@ -0,0 +1,251 @@
+package pgsnap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// VerifyRoundTrip read every message of the snapshot from r and write it
+// back to JSON, like it's written while recording, and return an error for
+// every message that isn't written back as it is, with the first field
+// that differs. Running it over the snapshots catch the fields lost by the
+// JSON encoding of pgproto3, e.g. after upgrading it.
+func VerifyRoundTrip(r io.Reader) []error {
+	_, lines, err := readLines(r)
+	if err != nil {
+		return []error{err}
+	}
+
+	s := &Snap{cfg: defaultConfig(), file: "snapshot"}
+
+	var errs []error
+	for _, l := range lines {
+		b := l.b
+		if len(b) == 0 || (b[0] != 'F' && b[0] != 'B') {
+			continue
+		}
+		if _, ok := parseCloseStep(b[1:]); ok && b[0] == 'B' {
+			continue
+		}
+		// RAW is kept as bytes, it isn't encoded by pgproto3
+		if isRaw(b[1:]) {
+			continue
+		}
+
+		var msg pgproto3.Message
+		if b[0] == 'F' {
+			msg, err = s.unmarshalF(b[1:])
+		} else {
+			msg, err = s.unmarshalB(b[1:])
+		}
+		if err != nil {
+			errs = append(errs, lintError(l.line, err, b))
+			continue
+		}
+
+		got, err := marshalJSON(msg)
+		if err != nil {
+			errs = append(errs, lintError(l.line, err, b))
+			continue
+		}
+
+		if diff, err := roundTripDiff(b[1:], got); err != nil {
+			errs = append(errs, lintError(l.line, err, b))
+		} else if diff != "" {
+			errs = append(errs, lintError(l.line, fmt.Errorf("%s: %s", messageType(msg), diff), nil))
+		}
+	}
+
+	return errs
+}
+
+// roundTripDiff return the first field of JSON object want that is not the
+// same in got, in the order of the fields in want
+func roundTripDiff(want, got []byte) (string, error) {
+	wantFields, err := jsonFields(want)
+	if err != nil {
+		return "", err
+	}
+	gotFields, err := jsonFields(got)
+	if err != nil {
+		return "", err
+	}
+
+	// delayMs and params are read by pgsnap, not by pgproto3, and params
+	// is written back as Parameters
+	wantFields, _ = withoutField(wantFields, "delayMs")
+	withoutWildcards(wantFields)
+	if fields, ok := withoutField(wantFields, "params"); ok {
+		wantFields = fields
+		gotFields, _ = withoutField(gotFields, "Parameters")
+	}
+
+	gotValues := map[string]interface{}{}
+	for _, f := range gotFields {
+		gotValues[f.name] = f.value
+	}
+
+	for _, f := range wantFields {
+		v, ok := gotValues[f.name]
+		if !ok {
+			return fmt.Sprintf("%s is missing after the round trip", f.name), nil
+		}
+		if diff := jsonDiff(f.name, f.value, v); diff != "" {
+			return diff, nil
+		}
+		delete(gotValues, f.name)
+	}
+
+	// the fields left out of the snapshot get their zero value
+	for _, f := range gotFields {
+		if v, ok := gotValues[f.name]; ok && !isZeroJSON(v) {
+			return fmt.Sprintf("%s is added after the round trip: %s", f.name, jsonString(v)), nil
+		}
+	}
+
+	return "", nil
+}
+
+type jsonField struct {
+	name  string
+	value interface{}
+}
+
+// withoutField return fields without the field name, and whether it's
+// found
+func withoutField(fields []jsonField, name string) ([]jsonField, bool) {
+	for i, f := range fields {
+		if f.name == name {
+			return append(fields[:i:i], fields[i+1:]...), true
+		}
+	}
+	return fields, false
+}
+
+// withoutWildcards remove "match" of DataRow values in fields, which is
+// read by pgsnap when updating the snapshot
+func withoutWildcards(fields []jsonField) {
+	for _, f := range fields {
+		values, ok := f.value.([]interface{})
+		if f.name != "Values" || !ok {
+			continue
+		}
+		for _, v := range values {
+			if m, ok := v.(map[string]interface{}); ok {
+				delete(m, "match")
+			}
+		}
+	}
+}
+
+// jsonFields return the fields of JSON object b, in their order
+func jsonFields(b []byte) ([]jsonField, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return nil, errors.New("message must be JSON object")
+	}
+
+	var fields []jsonField
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		f := jsonField{name: t.(string)}
+		if err := dec.Decode(&f.value); err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+
+	return fields, nil
+}
+
+// jsonDiff return the path of the first value in want that differs in got.
+// null and empty list are the same, as both are sent as no value.
+func jsonDiff(path string, want, got interface{}) string {
+	if isEmptyList(want) && isEmptyList(got) {
+		return ""
+	}
+
+	switch w := want.(type) {
+	case map[string]interface{}:
+		g, ok := got.(map[string]interface{})
+		if !ok {
+			break
+		}
+
+		keys := make([]string, 0, len(w)+len(g))
+		for k := range w {
+			keys = append(keys, k)
+		}
+		for k := range g {
+			if _, ok := w[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			if diff := jsonDiff(path+"."+k, w[k], g[k]); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	case []interface{}:
+		g, ok := got.([]interface{})
+		if !ok || len(w) != len(g) {
+			break
+		}
+
+		for i := range w {
+			if diff := jsonDiff(fmt.Sprintf("%s[%d]", path, i), w[i], g[i]); diff != "" {
+				return diff
+			}
+		}
+		return ""
+	}
+
+	if reflect.DeepEqual(want, got) {
+		return ""
+	}
+	return fmt.Sprintf("%s is %s after the round trip, want %s", path, jsonString(got), jsonString(want))
+}
+
+func isEmptyList(v interface{}) bool {
+	l, ok := v.([]interface{})
+	return v == nil || (ok && len(l) == 0)
+}
+
+func isZeroJSON(v interface{}) bool {
+	switch v := v.(type) {
+	case nil:
+		return true
+	case bool:
+		return !v
+	case string:
+		return v == ""
+	case json.Number:
+		return v == "0"
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+func jsonString(v interface{}) string {
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,141 @@
+package pgsnap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// streamRows is the number of DataRow lines following each other from
+// which they are replaced by one rowsStep
+var streamRows = 1000
+
+// errRowsChanged is returned by rowsStep when a line of its rows isn't
+// DataRow anymore
+var errRowsChanged = errors.New("expect DataRow, the snapshot is changed while it's replayed")
+
+// rowsStep send the DataRow of n lines following each other in the
+// snapshot, from line at offset. The lines are read from the file again
+// when they are sent, one at a time, so a huge result of the snapshot
+// isn't kept in memory.
+type rowsStep struct {
+	s      *Snap
+	offset int64
+	line   int
+	n      int
+}
+
+func (r *rowsStep) Step(be *pgproto3.Backend) error {
+	return r.stepSession(newSession(be))
+}
+
+func (r *rowsStep) stepSession(sess *session) error {
+	return r.each(func(st *sendStep) error {
+		return st.stepSession(sess)
+	})
+}
+
+// each call fn with the step of every row, read from the snapshot. The
+// message of the step is reused for the next row, so it must not be kept
+// after fn returns.
+func (r *rowsStep) each(fn func(st *sendStep) error) error {
+	f, err := r.s.getFile()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	src, err := gunzipReader(f)
+	if err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, src, r.offset); err != nil {
+		return fmt.Errorf("pgsnap: can't read the rows of %s:%d again: %w", r.s.getFilename(), r.line, err)
+	}
+
+	dec := dataRowPool.Get().(*dataRowDecoder)
+	defer dataRowPool.Put(dec)
+
+	st := &sendStep{}
+	sc := newTextScanner(src, r.line-1)
+	for i := 0; i < r.n; i++ {
+		l, err := sc.scan()
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return fmt.Errorf("pgsnap: can't read the rows of %s:%d again: %w", r.s.getFilename(), r.line, err)
+		}
+
+		// the lines are checked by readStep when the snapshot is read,
+		// so only the message is read again
+		var row *pgproto3.DataRow
+		if len(l.b) > 0 && l.b[0] == 'B' {
+			row, err = dec.decode(l.b[1:])
+		} else {
+			err = errRowsChanged
+		}
+		if err != nil {
+			return r.s.lineError(l.line, err, l.b)
+		}
+
+		st.msg = row
+		if err := fn(st); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// steps return the step of every row, for running them one by one
+func (r *rowsStep) steps() ([]pgmock.Step, error) {
+	var steps []pgmock.Step
+	err := r.each(func(st *sendStep) error {
+		steps = append(steps, &sendStep{msg: copyMessage(st.msg).(pgproto3.BackendMessage)})
+		return nil
+	})
+	return steps, err
+}
+
+// rowRun is the DataRow lines following each other, read last
+type rowRun struct {
+	offset int64
+	line   int
+	n      int
+}
+
+// appendRow add step of line l to script when it sends DataRow following
+// the rows of run, and return false when the step must be added as it is.
+// The rows are replaced by rowsStep once there are streamRows of them.
+func (s *Snap) appendRow(script *pgmock.Script, run *rowRun, step pgmock.Step, l textLine) bool {
+	st, ok := step.(*sendStep)
+	if ok {
+		_, ok = st.msg.(*pgproto3.DataRow)
+	}
+	if !ok {
+		*run = rowRun{}
+		return false
+	}
+
+	if run.n == 0 || l.line != run.line+run.n {
+		*run = rowRun{offset: l.offset, line: l.line}
+	}
+	run.n++
+
+	if last, ok := script.Steps[len(script.Steps)-1].(*rowsStep); ok && run.n > streamRows {
+		last.n++
+		return true
+	}
+	if run.n < streamRows {
+		return false
+	}
+
+	// the rows before are replaced
+	steps := script.Steps[:len(script.Steps)-(run.n-1)]
+	script.Steps = append(steps, &rowsStep{s: s, offset: run.offset, line: run.line, n: run.n})
+	return true
+}
@@ -1,12 +1,15 @@
 package pgsnap
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/jackc/pgmock"
@@ -14,121 +17,821 @@ import (
 )
 
 var (
-	EmptyScript = errors.New("script is empty")
+	EmptyScript   = errors.New("script is empty")
+	ErrNoMoreConn = errors.New("pgsnap: no more connection in the script")
 )
 
-func (s *Snap) getScript() (*pgmock.Script, error) {
-	f, err := s.getFile()
-	if err != nil {
-		return nil, err
+func (s *Snap) getScript() ([]*pgmock.Script, error) {
+	var f io.Reader = bytes.NewReader(s.src)
+	if s.src == nil {
+		file, err := s.getFile()
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		f = file
 	}
 
-	script, err := s.readScript(f)
+	scripts, err := s.readScript(f)
 	if err != nil {
 		return nil, err
 	}
-	if len(script.Steps) < len(pgmock.AcceptUnauthenticatedConnRequestSteps())+1 {
-		return script, EmptyScript
+	// snapshot with only named sections, see Use
+	if len(scripts) == 0 {
+		return scripts, nil
+	}
+
+	_, recorded := s.startups[scripts[0]]
+	if len(scripts) == 1 && !recorded && len(scripts[0].Steps) < s.startupLen(scripts[0])+1 {
+		return scripts, EmptyScript
+	}
+
+	return scripts, nil
+}
+
+func (s *Snap) runFakePostgre(scripts []*pgmock.Script) {
+	s.setScripts(scripts)
+
+	if d := s.cfg.acceptTimeout; d > 0 {
+		s.acceptTimer = time.NewTimer(d)
+		s.start(func() {
+			select {
+			case <-s.acceptTimer.C:
+				s.close(fmt.Errorf("%w in %s", ErrNoClient, d))
+			case <-s.closed:
+			}
+		})
 	}
 
-	return script, nil
+	s.acceptConnForScrpts()
 }
 
-func (s *Snap) runFakePostgre(script *pgmock.Script) {
-	go s.acceptConnForScrpt(script)
+// setScripts makes the scripts of the snapshot the ones replayed, in place
+// of the ones given before
+func (s *Snap) setScripts(scripts []*pgmock.Script) {
+	s.scripts = scripts
+	scripts = s.withMaxConns(scripts)
+
+	s.progress.start(scripts, s.startupLen)
+	s.queue.reset(scripts)
 }
 
-func (s *Snap) acceptConnForScrpt(script *pgmock.Script) {
-	conn, err := s.l.Accept()
-	if err != nil {
-		s.errchan <- err
-		return
+// withMaxConns return scripts with a copy of the only script for every
+// connection allowed by WithMaxConns
+func (s *Snap) withMaxConns(scripts []*pgmock.Script) []*pgmock.Script {
+	if len(scripts) == 1 && s.cfg.maxConns > 1 {
+		for i := 1; i < s.cfg.maxConns; i++ {
+			scripts = append(scripts, s.copyScript(scripts[0]))
+		}
 	}
-	defer conn.Close()
+	return scripts
+}
 
-	err = conn.SetDeadline(time.Now().Add(time.Second))
-	if err != nil {
-		s.errchan <- err
-		return
+// copyScript return script with its own startup steps, so it can be
+// replayed at the same time with the original one
+func (s *Snap) copyScript(script *pgmock.Script) *pgmock.Script {
+	steps := script.Steps[s.startupLen(script):]
+
+	c := &pgmock.Script{}
+	if r, ok := s.startups[script]; ok {
+		s.setStartup(c, r)
+	} else {
+		c.Steps = s.startupSteps()
+	}
+
+	c.Steps = append(c.Steps, steps...)
+	return c
+}
+
+// queue is the scripts waiting for a connection, which can be replaced by
+// Use
+type queue struct {
+	mu      sync.Mutex
+	scripts []*pgmock.Script
+	running int
+	failed  bool
+
+	// gen is the number of times the queue is reset by Load. The scripts
+	// given before don't change the queue anymore.
+	gen int
+
+	// workers is the number of goroutines accepting the connections
+	workers int
+}
+
+// set replace the scripts waiting for a connection
+func (q *queue) set(scripts []*pgmock.Script) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.scripts = scripts
+}
+
+// reset replace the scripts, forgetting the scripts given before and the
+// failure, see Load
+func (q *queue) reset(scripts []*pgmock.Script) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.scripts = scripts
+	q.running = 0
+	q.failed = false
+	q.gen++
+}
+
+// addWorkers return how many workers must be started to have n of them,
+// which are counted right away
+func (q *queue) addWorkers(n int) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	start := n - q.workers
+	if start < 0 {
+		start = 0
+	}
+	q.workers += start
+	return start
+}
+
+// busy tell whether a script given by next isn't replayed yet, while none
+// failed
+func (q *queue) busy() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.running > 0 && !q.failed
+}
+
+// next return the script for a new connection with the generation of the
+// queue, or nil when every script is already given
+func (q *queue) next() (*pgmock.Script, int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.scripts) == 0 {
+		return nil, q.gen
+	}
+
+	script := q.scripts[0]
+	q.scripts = q.scripts[1:]
+	q.running++
+	return script, q.gen
+}
+
+// finish mark the script given by next of generation gen is replayed, and
+// tell whether every script is replayed
+func (q *queue) finish(gen int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if gen != q.gen {
+		return false
+	}
+	q.running--
+	return q.running == 0 && len(q.scripts) == 0 && !q.failed
+}
+
+// empty tell whether there is no script to replay
+func (q *queue) empty() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.running == 0 && len(q.scripts) == 0
+}
+
+// generation return the number of times the queue is reset
+func (q *queue) generation() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.gen
+}
+
+// fail stop giving the scripts when the failure is of the scripts of
+// generation gen, and tell whether it's the first failure
+func (q *queue) fail(gen int) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if gen != q.gen {
+		return false
+	}
+
+	first := !q.failed
+	q.failed = true
+	q.scripts = nil
+	return first
+}
+
+// stop tell whether the worker must stop because a script failed, which
+// is then counted out of the workers
+func (q *queue) stop() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.failed {
+		q.workers--
+	}
+	return q.failed
+}
+
+// acceptConnForScrpts replay the scripts in the queue, one for every
+// connection. Scripts are given to the connections in the order they are
+// accepted, and with WithMaxConns several connections are replayed at the
+// same time. Connections that come when every script is replayed fail.
+func (s *Snap) acceptConnForScrpts() {
+	// snapshot with only named sections, which are replayed after Use
+	if s.queue.empty() {
+		s.signalDone()
+	}
+
+	s.startWorkers()
+}
+
+// startWorkers start the workers missing, e.g. after a failure
+func (s *Snap) startWorkers() {
+	for i := s.queue.addWorkers(s.workers()); i > 0; i-- {
+		s.start(s.acceptWorker)
+	}
+}
+
+// workers return the number of connections replayed at the same time
+func (s *Snap) workers() int {
+	if s.cfg.maxConns < 1 {
+		return 1
+	}
+	return s.cfg.maxConns
+}
+
+// acceptWorker replay the scripts of the queue for the connections it
+// accepts, until a script fails. The failure of a script given before
+// Load doesn't stop it.
+func (s *Snap) acceptWorker() {
+	fail := func(err error, gen int) {
+		if s.queue.fail(gen) {
+			s.report(err)
+		}
+	}
+
+	for !s.queue.stop() {
+		gen := s.queue.generation()
+		raw, conn, err := s.accept()
+		if err != nil {
+			fail(err, gen)
+			continue
+		}
+
+		script, gen := s.queue.next()
+		if script == nil {
+			s.rejectConn(raw, conn)
+			continue
+		}
+
+		err = s.acceptConnForScrpt(raw, conn, script)
+		if err != nil {
+			fail(err, gen)
+			continue
+		}
+
+		if s.queue.finish(gen) {
+			s.signalDone()
+		}
+	}
+}
+
+// signalDone tell Wait that every script is replayed
+func (s *Snap) signalDone() {
+	select {
+	case s.done <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Snap) acceptConnForScrpt(raw, conn net.Conn, script *pgmock.Script) error {
+	be := s.newBackend(conn)
+
+	sess := newSession(be)
+	sess.hook = s.cfg.stepHook
+	sess.healthChecks = s.healthChecks
+	sess.stats = &s.stats
+	sess.conn, sess.closed = raw, s.closed
+	if _, ok := conn.(*tls.Conn); ok {
+		sess.tlsEndPoint = s.tlsEndPoint
 	}
 
-	be := pgproto3.NewBackend(pgproto3.NewChunkReader(conn), conn)
+	// the deadline is set again, to be moved by the delay of the steps
+	if s.cfg.timeout > 0 {
+		sess.deadline = time.Now().Add(s.cfg.timeout)
+		if err := raw.SetDeadline(sess.deadline); err != nil {
+			s.untrack(raw)
+			return err
+		}
+	}
+
+	err := s.runScript(sess, script)
+
+	var closed *closeStep
+	if errors.As(err, &closed) {
+		if closed.Reset {
+			setLinger(raw)
+		}
+		conn.Close()
+		s.untrack(raw)
+		return nil
+	}
 
-	err = script.Run(be)
 	if err != nil {
-		s.waitTilSync(be)
+		// skip the rest of the pipeline, unless the client is already
+		// waiting for the answer (there is no Sync after simple Query)
+		if !sess.waiting {
+			s.waitTilSync(be)
+		}
 
-		s.sendError(be, err)
+		s.sendError(sess, err)
 
 		be.Send(&pgproto3.ErrorResponse{
 			Severity:            "ERROR",
 			SeverityUnlocalized: "ERROR",
-			Message:             err.Error(),
+			Message:             plainError(err),
 		})
-		be.Send(&pgproto3.ReadyForQuery{'I'})
+		be.Send(&pgproto3.ReadyForQuery{TxStatus: sess.errorTxStatus()})
+
+		setLinger(raw)
+		conn.Close()
+		s.untrack(raw)
+		return err
+	}
+
+	s.start(func() { s.rejectExtraMessages(raw, conn, sess) })
+
+	return nil
+}
+
+// rejectExtraMessages keep reading the connection after the script is
+// finished, and fail on any message other than Terminate
+func (s *Snap) rejectExtraMessages(raw, conn net.Conn, sess *session) {
+	defer s.untrack(raw)
+	defer conn.Close()
+
+	be := sess.be
+
+	msg, err := be.Receive()
+	if err != nil {
+		return
+	}
 
-		conn.(*net.TCPConn).SetLinger(0)
-		s.errchan <- err
+	if _, ok := msg.(*pgproto3.Terminate); ok {
 		return
 	}
 
-	s.done <- struct{}{}
+	err = fmt.Errorf("pgsnap: unexpected message after the script is finished: %#v", msg)
+	s.report(err)
+
+	be.Send(&pgproto3.ErrorResponse{
+		Severity:            "ERROR",
+		SeverityUnlocalized: "ERROR",
+		Message:             err.Error(),
+	})
+	be.Send(&pgproto3.ReadyForQuery{TxStatus: sess.errorTxStatus()})
+
+	setLinger(raw)
+}
+
+// runScript run every step in script like script.Run, but with the state
+// of the connection kept in session, and keep track which step is running
+func (s *Snap) runScript(sess *session, script *pgmock.Script) error {
+	startupLen := s.progress.startup(script)
+
+	for i := 0; i < len(script.Steps); i++ {
+		s.progress.set(script, i)
+		sess.step = i - startupLen + 1
+
+		if s.cfg.anyProtocol {
+			next, ok, err := s.interchange(sess, script.Steps, i)
+			if err != nil {
+				return err
+			}
+			if ok {
+				// next may be i, when the step is kept for the next message
+				i = next - 1
+				continue
+			}
+		}
+
+		if err := runStep(sess, script.Steps[i]); err != nil {
+			return stepError(sess, err)
+		}
+	}
+
+	s.progress.set(script, len(script.Steps))
+	return nil
+}
+
+// stepError return err of the running step as MismatchError with the step,
+// or as TransportError when the connection fails
+func stepError(sess *session, err error) error {
+	var me *MismatchError
+	if errors.As(err, &me) {
+		if me.Step == 0 && sess.step > 0 {
+			me.Step = sess.step
+		}
+		return err
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) || isClosed(err) {
+		step := sess.step
+		if step < 0 {
+			step = 0
+		}
+		return &TransportError{Step: step, Err: err}
+	}
+	return err
 }
 
+// runStep run step with the state of the connection, when it needs it
+func runStep(sess *session, step pgmock.Step) error {
+	if st, ok := step.(sessionStep); ok {
+		return st.stepSession(sess)
+	}
+	return step.Step(sess.be)
+}
+
+// rejectConn fail connection that come after every script is replayed
+func (s *Snap) rejectConn(raw, conn net.Conn) {
+	be := s.newBackend(conn)
+	_, _ = be.ReceiveStartupMessage()
+
+	err := ErrNoMoreConn
+	be.Send(&pgproto3.ErrorResponse{
+		Severity:            "FATAL",
+		SeverityUnlocalized: "FATAL",
+		Message:             err.Error(),
+	})
+	conn.Close()
+	s.untrack(raw)
+
+	s.report(err)
+}
+
+// waitTilSync skip messages until Sync, or Flush for client that wait for
+// the responses without Sync, so the error is sent when the client read it.
+// The batch of pipelining client can be long, so it's read until the
+// connection fails, e.g. by the deadline set by WithTimeout.
 func (s *Snap) waitTilSync(be *pgproto3.Backend) {
-	for i := 0; i < 10; i++ {
+	for {
 		msg, err := be.Receive()
 		if err != nil {
-			continue
+			return
 		}
 
-		_, ok := msg.(*pgproto3.Sync)
-		if ok {
-			break
+		switch msg.(type) {
+		case *pgproto3.Sync, *pgproto3.Flush:
+			return
 		}
 	}
 }
 
-func (s *Snap) sendError(be *pgproto3.Backend, err error) {
-	be.Send(&pgproto3.ErrorResponse{
+func (s *Snap) sendError(sess *session, err error) {
+	sess.be.Send(&pgproto3.ErrorResponse{
 		Severity:            "ERROR",
 		SeverityUnlocalized: "ERROR",
-		Message:             "pgsnap: diff:\n" + err.Error(),
+		Message:             "pgsnap: diff:\n" + plainError(err),
 	})
-	be.Send(&pgproto3.ReadyForQuery{'I'})
+	sess.be.Send(&pgproto3.ReadyForQuery{TxStatus: sess.errorTxStatus()})
+}
+
+// plainError return the message of err without color, to be sent to the
+// client
+func plainError(err error) string {
+	var me *MismatchError
+	if errors.As(err, &me) {
+		return me.format(false)
+	}
+	return err.Error()
+}
+
+// TransportError is returned by Wait when the connection of the client
+// fails during the replay, e.g. it's closed before the end of the snapshot
+// or it's timed out by WithTimeout, as opposed to MismatchError
+type TransportError struct {
+	// Step is the number of the step of the connection (counted from 1,
+	// startup excluded), 0 for the startup
+	Step int
+	Err  error
+}
+
+func (e *TransportError) Error() string {
+	return fmt.Sprintf("pgsnap: connection failed at step %d: %v", e.Step, e.Err)
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// lineError is error in a line of the snapshot file
+type lineError struct {
+	file string
+	line int
+	err  error
+	text []byte
+}
+
+func (s *Snap) lineError(line int, err error, text []byte) error {
+	return &lineError{file: s.getFilename(), line: line, err: err, text: text}
+}
+
+func (e *lineError) Error() string {
+	if e.text == nil {
+		return fmt.Sprintf("%s:%d: %v", e.file, e.line, e.err)
+	}
+	return fmt.Sprintf("%s:%d: %v: %s", e.file, e.line, e.err, e.text)
+}
+
+func (e *lineError) Unwrap() error {
+	return e.err
 }
 
-func (s *Snap) readScript(f io.Reader) (*pgmock.Script, error) {
+// readError return err of reading the lines of the snapshot, with its line
+// when it's known
+func (s *Snap) readError(err error) error {
+	var te *textError
+	if errors.As(err, &te) {
+		return s.lineError(te.line, te.err, te.b)
+	}
+	return fmt.Errorf("%s: %w", s.getFilename(), err)
+}
+
+// readScript read the snapshot and return one script for every connection.
+// Scripts for different connections are separated by a line with "C".
+// Blank lines and lines starting with "#" are ignored.
+func (s *Snap) readScript(f io.Reader) ([]*pgmock.Script, error) {
 	script := &pgmock.Script{
-		Steps: pgmock.AcceptUnauthenticatedConnRequestSteps(),
+		Steps: s.startupSteps(),
+	}
+	scripts := []*pgmock.Script{script}
+	startupLen := len(script.Steps)
+
+	// in V1 snapshot, the startup of every connection is read until the
+	// first ReadyForQuery
+	var v1 bool
+	var startup *recordedStartup
+
+	// the scripts of every section, after the first "=== case:name ==="
+	var sections sectionReader
+
+	// the unordered group read, until its "=== end ==="
+	var group *unorderedGroup
+
+	// the lines are read one at a time, so the snapshot isn't kept in
+	// memory, except YAML which is read as a whole
+	lines, err := s.scanLines(f)
+	if err != nil {
+		return nil, s.readError(err)
 	}
 
-	scanner := bufio.NewScanner(f)
+	// the rows of the snapshot file are read again when they are sent, see
+	// rowsStep
+	_, isFile := f.(*os.File)
+	reread := isFile && !s.isYAML()
+	var rows rowRun
 
-	for scanner.Scan() {
-		b := scanner.Bytes()
+	for {
+		l, err := lines.scan()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, s.readError(err)
+		}
+		b, line := l.b, l.line
 
-		if len(b) < 2 {
+		// blank line and comment
+		if len(b) == 0 || b[0] == '#' {
 			continue
 		}
 
-		switch b[0] {
-		case 'B':
-			msg, err := s.unmarshalB(b[1:])
+		if isHeader(b) {
+			if v1 || len(script.Steps) > startupLen || sections.names != nil {
+				return nil, s.lineError(line, errors.New("header must be the first line"), b)
+			}
+
+			h, err := parseHeader(b)
+			if err == nil {
+				err = s.checkHeader(h)
+			}
 			if err != nil {
-				return nil, err
+				return nil, s.lineError(line, err, b)
+			}
+
+			v1 = true
+			script.Steps = nil
+			startupLen = 0
+			continue
+		}
+
+		if _, ok := parseSection(b); (ok || b[0] == 'C') && group != nil {
+			return nil, s.lineError(group.line, errors.New("unordered group isn't ended in the connection"), nil)
+		}
+
+		if ok, err := s.readUnordered(script, &group, b, line); ok {
+			if err == nil && (startup != nil || len(script.Steps) < startupLen || v1 && len(script.Steps) == 0) {
+				err = errors.New("unordered group must follow the startup")
 			}
-			script.Steps = append(script.Steps, pgmock.SendMessage(msg))
-		case 'F':
-			msg, err := s.unmarshalF(b[1:])
 			if err != nil {
+				return nil, s.lineError(line, err, b)
+			}
+			continue
+		}
+
+		if name, ok := parseSection(b); ok {
+			if startup != nil {
+				return nil, s.lineError(startup.line, errors.New("startup doesn't end with ReadyForQuery"), nil)
+			}
+			if err := sections.add(scripts, isEmptyScript(script, v1, startupLen)); err != nil {
+				return nil, s.lineError(line, err, b)
+			}
+			if err := sections.start(name); err != nil {
+				return nil, s.lineError(line, err, b)
+			}
+
+			script = &pgmock.Script{}
+			if !v1 {
+				script.Steps = s.startupSteps()
+			}
+			scripts = []*pgmock.Script{script}
+			startupLen = len(script.Steps)
+			continue
+		}
+
+		if b[0] == 'C' {
+			// in V1 snapshot, connection with only the startup is kept
+			if len(script.Steps) > startupLen || (v1 && len(script.Steps) > 0) {
+				script = &pgmock.Script{}
+				if !v1 {
+					script.Steps = s.startupSteps()
+				}
+				scripts = append(scripts, script)
+			}
+			continue
+		}
+
+		if isWarmup(b) {
+			if startup != nil || len(script.Steps) == 0 || len(script.Steps) != startupLen {
+				return nil, s.lineError(line, errors.New("warm-up must follow the startup"), b)
+			}
+			script.Steps = append(script.Steps, &warmupStep{s: s})
+			continue
+		}
+
+		if v1 && len(script.Steps) == 0 {
+			startup, err = s.readStartupLine(startup, b, line)
+			if err != nil {
+				return nil, s.lineError(line, err, b)
+			}
+			if startup.done() {
+				s.setStartup(script, startup)
+				startupLen = len(script.Steps)
+				startup = nil
+			}
+			continue
+		}
+
+		step, err := s.readStep(b, line)
+		if err != nil {
+			return nil, s.lineError(line, err, b)
+		}
+		if n := len(script.Steps); n > 0 {
+			if isCloseStep(script.Steps[n-1]) {
+				return nil, s.lineError(line, errors.New("the connection is already closed by Close"), b)
+			}
+		}
+		if reread && s.appendRow(script, &rows, step, l) {
+			continue
+		}
+		s.appendStep(script, step)
+	}
+
+	if startup != nil {
+		return nil, s.lineError(startup.line, errors.New("startup doesn't end with ReadyForQuery"), nil)
+	}
+	if group != nil {
+		return nil, s.lineError(group.line, errors.New("unordered group isn't ended in the connection"), nil)
+	}
+
+	if sections.names != nil {
+		if err := sections.add(scripts, isEmptyScript(script, v1, startupLen)); err != nil {
+			return nil, fmt.Errorf("%s: %w", s.getFilename(), err)
+		}
+		s.sections = sections.names
+		return sections.first, nil
+	}
+
+	// the C at the end of V1 snapshot
+	if v1 && len(scripts) > 1 && len(script.Steps) == 0 {
+		scripts = scripts[:len(scripts)-1]
+	}
+
+	return scripts, nil
+}
+
+// readStartupLine add the message in line b to startup of V1 snapshot,
+// which must start with StartupMessage
+func (s *Snap) readStartupLine(startup *recordedStartup, b []byte, line int) (*recordedStartup, error) {
+	switch b[0] {
+	case 'F':
+		msg, err := s.unmarshalF(b[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		sm, ok := msg.(*pgproto3.StartupMessage)
+		if !ok || startup != nil {
+			return nil, errors.New("expect StartupMessage at the start of connection")
+		}
+
+		return &recordedStartup{want: sm, line: line}, nil
+	case 'B':
+		if startup == nil {
+			return nil, errors.New("expect StartupMessage at the start of connection")
+		}
+
+		msg, err := s.unmarshalB(b[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		startup.messages = append(startup.messages, msg)
+		return startup, nil
+	}
+
+	return nil, errors.New("unknown line")
+}
+
+// setStartup replace the startup of script with startup
+func (s *Snap) setStartup(script *pgmock.Script, startup *recordedStartup) {
+	if s.startups == nil {
+		s.startups = map[*pgmock.Script]*recordedStartup{}
+	}
+	s.startups[script] = startup
+	script.Steps = s.recordedStartupSteps(startup)
+}
+
+// readStep parse one B or F line of the snapshot
+func (s *Snap) readStep(b []byte, line int) (pgmock.Step, error) {
+	switch b[0] {
+	case 'B':
+		step, err := s.readBackendStep(b[1:])
+		if err != nil {
+			return nil, err
+		}
+
+		delay, err := parseDelay(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		if delay > 0 {
+			return &delayStep{delay: delay, step: step}, nil
+		}
+		return step, nil
+	case 'F':
+		msg, err := s.unmarshalF(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		step, err := s.newExpectStep(msg, line)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := msg.(*pgproto3.Bind); ok {
+			// the params are kept to show the mismatch as typed values
+			if step.params, err = parseBindParams(b[1:]); err != nil {
 				return nil, err
 			}
-			script.Steps = append(script.Steps, pgmock.ExpectMessage(msg))
 		}
+		return step, nil
 	}
 
-	return script, nil
+	return nil, errors.New("unknown line")
+}
+
+// readBackendStep return the step sending the message in B line b
+func (s *Snap) readBackendStep(b []byte) (pgmock.Step, error) {
+	if c, ok := parseCloseStep(b); ok {
+		return c, nil
+	}
+
+	msg, err := s.unmarshalB(b)
+	if err != nil {
+		return nil, err
+	}
+	if isCancel(msg) {
+		return &cancelStep{s: s, msg: msg.(*pgproto3.ErrorResponse)}, nil
+	}
+	if rfq, ok := msg.(*pgproto3.ReadyForQuery); ok {
+		return &readyForQueryStep{msg: rfq}, nil
+	}
+	return &sendStep{msg: msg}, nil
 }
 
 func (s *Snap) unmarshalB(src []byte) (pgproto3.BackendMessage, error) {
@@ -138,37 +841,27 @@ func (s *Snap) unmarshalB(src []byte) (pgproto3.BackendMessage, error) {
 
 	json.Unmarshal(src, &t)
 
-	var o pgproto3.BackendMessage
-
 	switch t.Type {
-	case "AuthenticationOK":
-		o = &pgproto3.AuthenticationOk{}
-	case "BackendKeyData":
-		o = &pgproto3.BackendKeyData{}
-	case "ParseComplete":
-		o = &pgproto3.ParseComplete{}
-	case "ParameterDescription":
-		o = &pgproto3.ParameterDescription{}
-	case "RowDescription":
-		o = &pgproto3.RowDescription{}
-	case "ReadyForQuery":
-		o = &pgproto3.ReadyForQuery{}
-	case "BindComplete":
-		o = &pgproto3.BindComplete{}
-	case "DataRow":
-		o = &pgproto3.DataRow{}
-	case "CommandComplete":
-		o = &pgproto3.CommandComplete{}
-	case "EmptyQueryResponse":
-		o = &pgproto3.EmptyQueryResponse{}
-	case "NoData":
-		o = &pgproto3.NoData{}
-	case "ErrorResponse":
-		o = &pgproto3.ErrorResponse{}
-	default:
+	case "CopyInResponse":
+		return unmarshalCopyInResponse(src)
+	case "CopyOutResponse":
+		return unmarshalCopyOutResponse(src)
+	case "CopyData":
+		return unmarshalCopyData(src)
+	case "NoticeResponse":
+		return unmarshalNoticeResponse(src)
+	case "UnknownMessage":
+		return unmarshalUnknownMessage(src)
+	case "RAW":
+		return unmarshalRawB(src)
+	}
+
+	newMessage, ok := backendMessages[t.Type]
+	if !ok {
 		return nil, fmt.Errorf("B: unknown type `%s`", t.Type)
 	}
 
+	o := newMessage()
 	if err := json.Unmarshal(src, o); err != nil {
 		return nil, err
 	}
@@ -176,6 +869,32 @@ func (s *Snap) unmarshalB(src []byte) (pgproto3.BackendMessage, error) {
 	return o, nil
 }
 
+// backendMessages create the messages of every type in B line that are
+// read from their JSON as they are
+var backendMessages = map[string]func() pgproto3.BackendMessage{
+	"AuthenticationOK":                func() pgproto3.BackendMessage { return &pgproto3.AuthenticationOk{} },
+	"AuthenticationMD5Password":       func() pgproto3.BackendMessage { return &pgproto3.AuthenticationMD5Password{} },
+	"AuthenticationCleartextPassword": func() pgproto3.BackendMessage { return &pgproto3.AuthenticationCleartextPassword{} },
+	"BackendKeyData":                  func() pgproto3.BackendMessage { return &pgproto3.BackendKeyData{} },
+	"ParseComplete":                   func() pgproto3.BackendMessage { return &pgproto3.ParseComplete{} },
+	"ParameterDescription":            func() pgproto3.BackendMessage { return &pgproto3.ParameterDescription{} },
+	"RowDescription":                  func() pgproto3.BackendMessage { return &pgproto3.RowDescription{} },
+	"ReadyForQuery":                   func() pgproto3.BackendMessage { return &pgproto3.ReadyForQuery{} },
+	"BindComplete":                    func() pgproto3.BackendMessage { return &pgproto3.BindComplete{} },
+	"DataRow":                         func() pgproto3.BackendMessage { return &pgproto3.DataRow{} },
+	"CommandComplete":                 func() pgproto3.BackendMessage { return &pgproto3.CommandComplete{} },
+	"EmptyQueryResponse":              func() pgproto3.BackendMessage { return &pgproto3.EmptyQueryResponse{} },
+	"NoData":                          func() pgproto3.BackendMessage { return &pgproto3.NoData{} },
+	"ErrorResponse":                   func() pgproto3.BackendMessage { return &pgproto3.ErrorResponse{} },
+	"CopyDone":                        func() pgproto3.BackendMessage { return &pgproto3.CopyDone{} },
+	"NotificationResponse":            func() pgproto3.BackendMessage { return &pgproto3.NotificationResponse{} },
+	"ParameterStatus":                 func() pgproto3.BackendMessage { return &pgproto3.ParameterStatus{} },
+	"CloseComplete":                   func() pgproto3.BackendMessage { return &pgproto3.CloseComplete{} },
+	"PortalSuspended":                 func() pgproto3.BackendMessage { return &pgproto3.PortalSuspended{} },
+	"FunctionCallResponse":            func() pgproto3.BackendMessage { return &pgproto3.FunctionCallResponse{} },
+	"NegotiateProtocolVersion":        func() pgproto3.BackendMessage { return &negotiateProtocolVersion{} },
+}
+
 func (s *Snap) unmarshalF(src []byte) (pgproto3.FrontendMessage, error) {
 	t := struct {
 		Type string
@@ -197,16 +916,34 @@ func (s *Snap) unmarshalF(src []byte) (pgproto3.FrontendMessage, error) {
 	case "Sync":
 		o = &pgproto3.Sync{}
 	case "Bind":
-		o = &pgproto3.Bind{}
+		return unmarshalBind(src)
 	case "Execute":
 		o = &pgproto3.Execute{}
 	case "Terminate":
 		o = &pgproto3.Terminate{}
+	case "PasswordMessage":
+		o = &pgproto3.PasswordMessage{}
+	case "CopyData":
+		return unmarshalCopyData(src)
+	case "CopyDone":
+		o = &pgproto3.CopyDone{}
+	case "CopyFail":
+		o = &pgproto3.CopyFail{}
+	case "Flush":
+		o = &pgproto3.Flush{}
+	case "Close":
+		o = &pgproto3.Close{}
+	case "FunctionCall":
+		return unmarshalFunctionCall(src)
+	case "RAW":
+		return unmarshalRawF(src)
 	default:
 		return nil, fmt.Errorf("F: unknown type `%s`", t.Type)
 	}
 
-	_ = json.Unmarshal(src, o)
+	if err := json.Unmarshal(src, o); err != nil {
+		return nil, err
+	}
 
 	return o, nil
 }
@@ -0,0 +1,145 @@
+package pgsnap
+
+import (
+	"bytes"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/jackc/pgmock"
+)
+
+var (
+	sectionPrefix = []byte("=== case:")
+	sectionSuffix = []byte(" ===")
+)
+
+// parseSection return the name of the section started by line b, like
+// "=== case:happy ==="
+func parseSection(b []byte) (string, bool) {
+	if !bytes.HasPrefix(b, sectionPrefix) || !bytes.HasSuffix(b, sectionSuffix) || len(b) < len(sectionPrefix)+len(sectionSuffix) {
+		return "", false
+	}
+
+	name := bytes.TrimSpace(b[len(sectionPrefix) : len(b)-len(sectionSuffix)])
+	return string(name), len(name) > 0
+}
+
+func sectionLine(name string) string {
+	return string(sectionPrefix) + name + string(sectionSuffix)
+}
+
+// sectionReader collect the scripts of every section while the snapshot
+// is read. The scripts before the first section are replayed without Use.
+type sectionReader struct {
+	first   []*pgmock.Script
+	names   map[string][]*pgmock.Script
+	current string
+}
+
+// add keep the scripts read until the next section, the last one is left
+// out when it's empty
+func (r *sectionReader) add(scripts []*pgmock.Script, lastEmpty bool) error {
+	if lastEmpty {
+		scripts = scripts[:len(scripts)-1]
+	}
+
+	if r.names == nil {
+		r.first = scripts
+		r.names = map[string][]*pgmock.Script{}
+		return nil
+	}
+
+	if len(scripts) == 0 {
+		return fmt.Errorf("section %q is empty", r.current)
+	}
+	r.names[r.current] = scripts
+	return nil
+}
+
+func (r *sectionReader) start(name string) error {
+	if _, ok := r.names[name]; ok {
+		return fmt.Errorf("section %q is repeated", name)
+	}
+	r.current = name
+	return nil
+}
+
+// isEmptyScript tell whether script has no step after the startup. In V1
+// snapshot, connection with only the startup is not empty.
+func isEmptyScript(script *pgmock.Script, v1 bool, startupLen int) bool {
+	return len(script.Steps) == 0 || (!v1 && len(script.Steps) == startupLen)
+}
+
+// Use makes the next connections replay the section of the snapshot
+// started by "=== case:name ===", in place of the connections that are not
+// replayed yet. A section can be used more than once. While recording,
+// the next connections are recorded in the section.
+func (s *Snap) Use(name string) error {
+	if s.writeMode {
+		s.recordingsMu.Lock()
+		defer s.recordingsMu.Unlock()
+
+		s.recordings = append(s.recordings, &recording{section: name})
+		return nil
+	}
+
+	scripts, ok := s.sections[name]
+	if !ok {
+		return fmt.Errorf("pgsnap: %s has no section %q", s.getFilename(), name)
+	}
+
+	copies := make([]*pgmock.Script, len(scripts))
+	for i, script := range scripts {
+		copies[i] = s.copyScript(script)
+	}
+
+	copies = s.withMaxConns(copies)
+	s.progress.add(copies)
+
+	// the replay isn't done until the section is replayed
+	select {
+	case <-s.done:
+	default:
+	}
+	s.queue.set(copies)
+
+	return nil
+}
+
+// Load makes s replay the snapshot file name in place of its snapshot, e.g.
+// for the next case of a table-driven test, keeping the listener, so DSN
+// doesn't change. The snapshot before must be replayed, or failed, and
+// what's left of it is dropped: the errors not returned by Wait yet, the
+// counters of Stats and the connections still open after a failure.
+func (s *Snap) Load(name string) error {
+	if s.writeMode {
+		return fmt.Errorf("pgsnap: can't load %s while recording", name)
+	}
+	if s.isClosed() {
+		return ErrClosed
+	}
+	if s.queue.busy() {
+		return fmt.Errorf("pgsnap: can't load %s, %s is still replayed", name, s.getFilename())
+	}
+
+	file, src := s.file, s.src
+	s.file, s.src = name, nil
+	scripts, err := s.getScript()
+	if err != nil {
+		s.file, s.src = file, src
+		return fmt.Errorf("pgsnap: can't read %s: %w", name, err)
+	}
+
+	s.setScripts(scripts)
+	s.closeConns()
+
+	// the reset queue doesn't take the errors of the snapshot before
+	// anymore, the ones already reported are dropped
+	s.drain()
+	s.stats.reset()
+	atomic.StoreInt32(&s.waited, 0)
+	atomic.StoreInt32(&s.warmedUp, 0)
+
+	s.acceptConnForScrpts()
+	return nil
+}
@@ -0,0 +1,293 @@
+package pgsnap
+
+import (
+	"net"
+	"regexp"
+	"time"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// session is the state of one replayed connection
+type session struct {
+	be *pgproto3.Backend
+
+	// statements map prepared statement name in the script to the name
+	// used by the client, and names the other way around
+	statements map[string]string
+	names      map[string]string
+
+	// prepared map the name of the statements parsed by the client to their
+	// SQL, and pending is a message received ahead by WithAnyProtocol
+	prepared map[string]string
+	pending  pgproto3.FrontendMessage
+
+	// txStatus is the status sent in the last ReadyForQuery
+	txStatus byte
+
+	// tx is the status of the transaction after the messages sent since
+	// the last ReadyForQuery, and query is the last SQL received, see sent
+	tx    byte
+	query string
+
+	// waiting is set when the last message received is Query, Sync or
+	// Flush, after which the client wait for the answer
+	waiting bool
+
+	// step is the number of the running step (counted from 1, startup
+	// excluded), given to hook set by WithStepHook
+	step int
+	hook StepHook
+
+	// healthChecks is answered without running the steps, see
+	// WithIgnoreHealthChecks
+	healthChecks []healthCheck
+
+	stats *stats
+
+	// tlsEndPoint is the channel binding data of the TLS connection, for
+	// SCRAM-SHA-256-PLUS, nil without TLS
+	tlsEndPoint []byte
+
+	// conn is the raw connection, with deadline set by WithTimeout, which
+	// is moved by the delay of the steps
+	conn     net.Conn
+	deadline time.Time
+	closed   <-chan struct{}
+}
+
+func newSession(be *pgproto3.Backend) *session {
+	return &session{
+		be:         be,
+		statements: map[string]string{},
+		names:      map[string]string{},
+		prepared:   map[string]string{},
+		txStatus:   'I',
+		tx:         'I',
+	}
+}
+
+// sessionStep is step that need the state of the connection
+type sessionStep interface {
+	stepSession(sess *session) error
+}
+
+// receive return the message received ahead, or the next message of the
+// client
+func (sess *session) receive() (pgproto3.FrontendMessage, error) {
+	if msg := sess.pending; msg != nil {
+		sess.pending = nil
+		return msg, nil
+	}
+	return sess.be.Receive()
+}
+
+// received keep track of msg received from the client
+func (sess *session) received(msg pgproto3.FrontendMessage) {
+	switch msg.(type) {
+	case *pgproto3.Query, *pgproto3.Sync, *pgproto3.Flush:
+		sess.waiting = true
+	default:
+		sess.waiting = false
+	}
+
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		sess.query = m.String
+	case *pgproto3.Parse:
+		sess.query = m.Query
+		sess.prepared[m.Name] = m.Query
+	}
+
+	if sess.stats != nil {
+		sess.stats.add(msg)
+	}
+}
+
+// rollbackTo match ROLLBACK TO SAVEPOINT, which has the same tag as
+// ROLLBACK but keeps the transaction
+var rollbackTo = regexp.MustCompile(`(?i)^\s*rollback\s+((work|transaction)\s+)?to\s`)
+
+// sent keep track of the status of the transaction after msg is sent, like
+// postgres: BEGIN starts the transaction, an error fails it, and COMMIT or
+// ROLLBACK ends it
+func (sess *session) sent(msg pgproto3.BackendMessage) {
+	switch m := msg.(type) {
+	case *pgproto3.ErrorResponse:
+		if sess.tx == 'T' {
+			sess.tx = 'E'
+		}
+	case *pgproto3.CommandComplete:
+		switch string(m.CommandTag) {
+		case "BEGIN", "START TRANSACTION":
+			if sess.tx == 'I' {
+				sess.tx = 'T'
+			}
+		case "ROLLBACK":
+			if rollbackTo.MatchString(sess.query) {
+				sess.tx = 'T'
+			} else {
+				sess.tx = 'I'
+			}
+		case "COMMIT", "PREPARE TRANSACTION":
+			sess.tx = 'I'
+		}
+	}
+}
+
+// runHook call the hook set by WithStepHook with msg, except during the
+// startup
+func (sess *session) runHook(msg pgproto3.Message) error {
+	if sess.hook == nil || sess.step < 1 {
+		return nil
+	}
+	return sess.hook(sess.step, msg)
+}
+
+// sleep wait for d before the next step. The deadline of the connection is
+// moved by d, so the delay isn't counted in WithTimeout.
+func (sess *session) sleep(d time.Duration) error {
+	select {
+	case <-time.After(d):
+	case <-sess.closed:
+		return ErrClosed
+	}
+
+	if sess.conn == nil || sess.deadline.IsZero() {
+		return nil
+	}
+	sess.deadline = sess.deadline.Add(d)
+	return sess.conn.SetDeadline(sess.deadline)
+}
+
+// delayStep run step after waiting for delay, set by "delayMs" in B line
+type delayStep struct {
+	delay time.Duration
+	step  pgmock.Step
+}
+
+func (d *delayStep) Step(be *pgproto3.Backend) error {
+	time.Sleep(d.delay)
+	return d.step.Step(be)
+}
+
+func (d *delayStep) stepSession(sess *session) error {
+	if err := sess.sleep(d.delay); err != nil {
+		return err
+	}
+	if st, ok := d.step.(sessionStep); ok {
+		return st.stepSession(sess)
+	}
+	return d.step.Step(sess.be)
+}
+
+// errorTxStatus return the status sent in ReadyForQuery after an error
+// made by pgsnap, which fail the transaction when the client is in one
+func (sess *session) errorTxStatus() byte {
+	if sess.txStatus == 'I' {
+		return 'I'
+	}
+	return 'E'
+}
+
+// readyForQueryStep send ReadyForQuery and keep its status in session, so
+// the error sent by pgsnap report the status of the transaction
+type readyForQueryStep struct {
+	msg *pgproto3.ReadyForQuery
+}
+
+func (r *readyForQueryStep) Step(be *pgproto3.Backend) error {
+	return be.Send(r.msg)
+}
+
+func (r *readyForQueryStep) stepSession(sess *session) error {
+	msg := r.msg
+	if sess.hook != nil {
+		msg = copyMessage(msg).(*pgproto3.ReadyForQuery)
+		if err := sess.runHook(msg); err != nil {
+			return err
+		}
+	}
+
+	// the status follows the transaction, even when the snapshot is
+	// written by hand with I everywhere, or edited to send the error in
+	// place of the result. The recorded status is kept otherwise.
+	if (msg.TxStatus == 'I' && sess.tx != 'I') || (msg.TxStatus == 'T' && sess.tx == 'E') {
+		msg = &pgproto3.ReadyForQuery{TxStatus: sess.tx}
+	}
+
+	sess.txStatus = msg.TxStatus
+	sess.tx = msg.TxStatus
+	return sess.be.Send(msg)
+}
+
+// statementName return the name the client should use for statement
+// named want in the script. The first time want is seen, it is mapped to
+// got, so generated names (like stmtcache_42) match as long as they are
+// used consistently. Unnamed statement is never mapped.
+func (sess *session) statementName(want, got string) string {
+	if want == "" || got == "" {
+		return want
+	}
+
+	if name, ok := sess.statements[want]; ok {
+		return name
+	}
+
+	if _, ok := sess.names[got]; ok {
+		return want
+	}
+
+	sess.statements[want] = got
+	sess.names[got] = want
+	return got
+}
+
+// objectName return the name the client should use for statement named
+// want in the script, when the client describes or closes the object
+// named got of objectType. A portal is never mapped, but the statement
+// already mapped keeps the name used by the client, so the mismatch only
+// shows the type.
+func (sess *session) objectName(want string, objectType byte, got string) string {
+	if objectType == 'S' {
+		return sess.statementName(want, got)
+	}
+	if name, ok := sess.statements[want]; ok {
+		return name
+	}
+	return want
+}
+
+// normalize return want with its prepared statement name replaced by the
+// one used by client in got
+func (sess *session) normalize(want, got pgproto3.FrontendMessage) pgproto3.FrontendMessage {
+	switch w := want.(type) {
+	case *pgproto3.Parse:
+		if g, ok := got.(*pgproto3.Parse); ok {
+			n := *w
+			n.Name = sess.statementName(w.Name, g.Name)
+			return &n
+		}
+	case *pgproto3.Describe:
+		if g, ok := got.(*pgproto3.Describe); ok && w.ObjectType == 'S' {
+			n := *w
+			n.Name = sess.objectName(w.Name, g.ObjectType, g.Name)
+			return &n
+		}
+	case *pgproto3.Close:
+		if g, ok := got.(*pgproto3.Close); ok && w.ObjectType == 'S' {
+			n := *w
+			n.Name = sess.objectName(w.Name, g.ObjectType, g.Name)
+			return &n
+		}
+	case *pgproto3.Bind:
+		if g, ok := got.(*pgproto3.Bind); ok {
+			n := *w
+			n.PreparedStatement = sess.statementName(w.PreparedStatement, g.PreparedStatement)
+			return &n
+		}
+	}
+
+	return want
+}
@@ -0,0 +1,78 @@
+package pgsnap
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sharedListener is the TCP listener of WithSharedListener, which is never
+// closed. It's used by one snap at a time, the one holding lock.
+type sharedListener struct {
+	l    *net.TCPListener
+	lock chan struct{}
+}
+
+// sharedListeners is the shared listener of every listen address
+var sharedListeners = struct {
+	sync.Mutex
+	m map[string]*sharedListener
+}{m: map[string]*sharedListener{}}
+
+// listenShared return the shared listener of addr, once the snap using it
+// before is closed and its goroutines are done
+func (s *Snap) listenShared(addr string) (net.Listener, error) {
+	sharedListeners.Lock()
+	sl, ok := sharedListeners.m[addr]
+	if !ok {
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			sharedListeners.Unlock()
+			return nil, fmt.Errorf("pgsnap: can't listen on %s: %w", addr, err)
+		}
+		sl = &sharedListener{l: l.(*net.TCPListener), lock: make(chan struct{}, 1)}
+		sharedListeners.m[addr] = sl
+	}
+	sharedListeners.Unlock()
+
+	sl.lock <- struct{}{}
+	s.release = sl.release
+
+	return &leasedListener{sl: sl}, nil
+}
+
+// release let the next snap use the listener
+func (sl *sharedListener) release() {
+	// the deadline set by Close of the lease is removed
+	_ = sl.l.SetDeadline(time.Time{})
+	<-sl.lock
+}
+
+// leasedListener is the shared listener used by one snap. Close stops its
+// Accept without closing the shared listener.
+type leasedListener struct {
+	sl     *sharedListener
+	closed int32 // set atomically by Close
+}
+
+func (ll *leasedListener) Accept() (net.Conn, error) {
+	conn, err := ll.sl.l.Accept()
+	if atomic.LoadInt32(&ll.closed) == 1 {
+		if err == nil {
+			conn.Close()
+		}
+		return nil, net.ErrClosed
+	}
+	return conn, err
+}
+
+func (ll *leasedListener) Close() error {
+	atomic.StoreInt32(&ll.closed, 1)
+	return ll.sl.l.SetDeadline(time.Now())
+}
+
+func (ll *leasedListener) Addr() net.Addr {
+	return ll.sl.l.Addr()
+}
@@ -1,118 +1,676 @@
 package pgsnap
 
 import (
+	"context"
+	"database/sql"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgx/v4"
 )
 
+// ErrClosed is returned by Wait when the Snap is closed before the script
+// is finished
+var ErrClosed = errors.New("pgsnap: closed")
+
+// ErrNoClient is returned by Wait when no client connects before the
+// timeout set by WithAcceptTimeout
+var ErrNoClient = errors.New("pgsnap: no client connected")
+
+// Snap is the fake postgres of one test. Every Snap has its own listener,
+// script and state, so tests using it can run with t.Parallel().
 type Snap struct {
-	t         *testing.T
+	t         testing.TB
 	addr      string
 	errchan   chan error
 	msgchan   chan string
 	done      chan struct{}
 	writeMode bool
 	l         net.Listener
+	cfg       config
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	closeErr  error
+	reason    error
+
+	connsMu sync.Mutex
+	conns   map[net.Conn]struct{}
+
+	progress progress
+	stats    stats
+	queue    queue
+
+	// file is the name of the snapshot, instead of the one from the test
+	// name, e.g. for Lint
+	file string
+
+	// src is the snapshot given to NewSnapFromReader
+	src []byte
+
+	// release let the next snap use the listener, see WithSharedListener
+	release func()
+
+	// acceptTimer fires when no client connects in time, see
+	// WithAcceptTimeout
+	acceptTimer *time.Timer
+
+	// scripts is the scripts of the snapshot replayed without Use
+	scripts []*pgmock.Script
+
+	// sections is the scripts of every named section, see Use
+	sections map[string][]*pgmock.Script
+
+	// startups is the startup of the scripts read from V1 snapshot
+	startups map[*pgmock.Script]*recordedStartup
+	waited   int32 // set atomically by Wait
+	warmedUp int32 // set atomically by StartRecording
+
+	// running is the goroutines started by start, waited on cleanup
+	running sync.WaitGroup
+
+	recordingsMu sync.Mutex
+	recordings   []*recording
+
+	cancels     chan struct{}
+	upstreamsMu sync.Mutex
+	upstreams   map[*pgx.Conn]struct{}
+
+	healthChecks []healthCheck
+
+	// tlsEndPoint is the channel binding data of the certificate of
+	// WithTLS, see SCRAM-SHA-256-PLUS
+	tlsEndPoint []byte
 }
 
-// NewSnap will create snap
-func NewSnap(t *testing.T, postgreURL string) *Snap {
-	return NewSnapWithForceWrite(t, postgreURL, false)
+// NewSnap create snap for the test t. The snapshot is replayed when the
+// file exists, otherwise it is recorded from the postgres at postgreURL.
+// opts configure everything else, with defaults that work for most tests.
+// The test fails right away when the snap can't be created, see New.
+func NewSnap(t testing.TB, postgreURL string, opts ...Option) *Snap {
+	t.Helper()
+
+	s, err := New(t, postgreURL, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s
+}
+
+// New is like NewSnap, but return the error when the snap can't be
+// created: the snapshot file can't be read or parsed, the fake postgres
+// can't listen, or the real postgres can't be connected to record the
+// snapshot (e.g. because the file doesn't exist).
+func New(t testing.TB, postgreURL string, opts ...Option) (*Snap, error) {
+	return newSnap(t, postgreURL, nil, opts)
 }
 
-// NewSnap
-func NewSnapWithForceWrite(t *testing.T, url string, forceWrite bool) *Snap {
+// NewSnapFromReader create snap replaying the snapshot read from r, e.g.
+// embedded with go:embed, instead of the file of the test. The snapshot is
+// never recorded, and the test fails right away when r can't be read or
+// parsed. The snap is finished and closed on cleanup, like NewSnap.
+func NewSnapFromReader(t testing.TB, r io.Reader, opts ...Option) *Snap {
+	t.Helper()
+
+	src, err := io.ReadAll(r)
+	if err == nil {
+		var s *Snap
+		if s, err = newSnap(t, "", src, opts); err == nil {
+			return s
+		}
+	}
+
+	t.Fatal(err)
+	return nil
+}
+
+// newSnap create snap replaying src when it's not nil, or the snapshot file
+// of the test otherwise
+func newSnap(t testing.TB, postgreURL string, src []byte, opts []Option) (*Snap, error) {
 	s := &Snap{
 		t:       t,
 		errchan: make(chan error, 100),
 		msgchan: make(chan string, 100),
 		done:    make(chan struct{}, 1),
+		cfg:     defaultConfig(),
+		closed:  make(chan struct{}),
+		conns:   map[net.Conn]struct{}{},
+		cancels: make(chan struct{}, 1),
+
+		upstreams: map[*pgx.Conn]struct{}{},
+	}
+
+	for _, opt := range opts {
+		opt(&s.cfg)
 	}
 
-	s.listen()
+	if src != nil {
+		s.src, s.file = src, "snapshot"
+	} else if err := s.claimSnapshot(); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if s.healthChecks, err = compileHealthChecks(s.cfg.healthChecks); err != nil {
+		return nil, err
+	}
+
+	if s.cfg.useTLS && s.cfg.tls == nil {
+		var err error
+		s.cfg.tls, err = selfSignedTLSConfig()
+		if err != nil {
+			return nil, fmt.Errorf("pgsnap: can't generate certificate: %w", err)
+		}
+	}
+	s.tlsEndPoint = tlsServerEndPoint(s.cfg.tls)
+
+	if err := s.listen(); err != nil {
+		return nil, err
+	}
+
+	if s.cfg.ctx != nil {
+		s.start(func() { s.closeOnDone(s.cfg.ctx) })
+	}
 
 	script, err := s.getScript()
-	if s.shouldRunProxy(forceWrite, err) {
-		s.runProxy(url)
-		return s
+	if isMissing(err) && !s.shouldRecord() {
+		// with OnEmptyRecord, the default, the snapshot is recorded like
+		// before the option
+		switch s.cfg.onEmpty {
+		case OnEmptySkip:
+			s.abort()
+			s.t.Skipf("pgsnap: %s doesn't exist or is empty, record it with PGSNAP_RECORD=1", s.getFilename())
+		case OnEmptyFail:
+			s.abort()
+			return nil, fmt.Errorf("pgsnap: %s doesn't exist or is empty, record it with PGSNAP_RECORD=1", s.getFilename())
+		}
 	}
 
-	if err != nil {
-		s.t.Fatalf("can't open file \"%s\": %v", s.getFilename(), err)
+	if s.src == nil && s.shouldRunProxy(err) {
+		if proxyErr := s.runProxy(postgreURL); proxyErr != nil {
+			s.abort()
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("pgsnap: %s doesn't exist, can't record it: %w", s.getFilename(), proxyErr)
+			}
+			return nil, fmt.Errorf("pgsnap: can't record %s: %w", s.getFilename(), proxyErr)
+		}
+	} else {
+		if err != nil {
+			s.abort()
+			return nil, fmt.Errorf("pgsnap: can't read %s: %w", s.getFilename(), err)
+		}
+
+		s.runFakePostgre(script)
 	}
 
-	s.runFakePostgre(script)
-	return s
+	t.Cleanup(s.cleanup)
+	return s, nil
 }
 
+// NewSnapContext create snap that will be closed when ctx is done
+func NewSnapContext(ctx context.Context, t testing.TB, postgreURL string, opts ...Option) *Snap {
+	return NewSnap(t, postgreURL, append(opts, WithContext(ctx))...)
+}
+
+// NewSnapWithForceWrite is NewSnap with WithForceWrite(forceWrite)
+func NewSnapWithForceWrite(t testing.TB, url string, forceWrite bool, opts ...Option) *Snap {
+	return NewSnap(t, url, append(opts, WithForceWrite(forceWrite))...)
+}
+
+// Finish wait for the script to be finished, and fail the test when there
+// is an error or there are messages in the script that never sent by
+// the client. Finish is called on test cleanup if Finish or Wait wasn't
+// called by the test.
 func (s *Snap) Finish() {
+	s.t.Helper()
+
 	err := s.Wait()
 	if err != nil {
-		s.t.Helper()
 		s.t.Error(err)
 	}
+
+	if unconsumed := s.progress.unconsumed(); len(unconsumed) > 0 {
+		s.t.Errorf("pgsnap: messages in the script never sent by the client:\n%s", strings.Join(unconsumed, "\n"))
+	}
 }
 
+// cleanup finish the snap if the test doesn't, then close it and wait for
+// every goroutine to return, so nothing is left running after the test.
+// Errors reported after Wait fail the test.
+func (s *Snap) cleanup() {
+	if atomic.LoadInt32(&s.waited) == 0 {
+		s.Finish()
+	}
+
+	s.Close()
+	s.running.Wait()
+
+	for {
+		select {
+		case err := <-s.errchan:
+			s.t.Error(err)
+		default:
+			return
+		}
+	}
+}
+
+// abort close the snap that can't be created
+func (s *Snap) abort() {
+	s.Close()
+	s.running.Wait()
+}
+
+// start run f in new goroutine, which is waited when the test is done
+func (s *Snap) start(f func()) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		f()
+	}()
+}
+
+// Addr return the address of the fake postgres, as host:port, or the path
+// of the socket with WithUnixSocket
 func (s *Snap) Addr() string {
 	return s.addr
 }
 
+// DSN return the URL to connect to the fake postgres. It has the password
+// set by WithAuth, and sslmode=require when WithTLS is used (sslmode=disable
+// otherwise). With WithUnixSocket, the socket directory is given as host.
+func (s *Snap) DSN() string {
+	user := url.User("user")
+	if s.cfg.auth != AuthTrust {
+		user = url.UserPassword("user", s.cfg.password)
+	}
+
+	query := url.Values{}
+	query.Set("sslmode", "disable")
+	query.Set("statement_cache_mode", "describe")
+
+	host := s.addr
+	if s.cfg.unixSocket {
+		// the clients don't do TLS over unix socket, sslmode stays disable
+		host = ""
+		query.Set("host", filepath.Dir(s.addr))
+	} else if s.cfg.useTLS {
+		query.Set("sslmode", "require")
+	}
+
+	u := url.URL{
+		Scheme:   "postgres",
+		User:     user,
+		Host:     host,
+		Path:     "/",
+		RawQuery: query.Encode(),
+	}
+
+	return u.String()
+}
+
+// OpenDB return *sql.DB of driverName (e.g. "postgres" of lib/pq, or "pgx"
+// of pgx/v4/stdlib) connected to the fake postgres, which is closed on test
+// cleanup before the snap. The pool is limited to the connections set by
+// WithMaxConns, so the connections are the ones in the snapshot. The
+// connection isn't pinged, as the ping is sent as query.
+func (s *Snap) OpenDB(driverName string) *sql.DB {
+	s.t.Helper()
+
+	db, err := sql.Open(driverName, s.DSN())
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	db.SetMaxOpenConns(s.cfg.maxConns)
+
+	s.t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// Connect return *pgx.Conn connected to the fake postgres, with the auth
+// and TLS of the options, which is closed on test cleanup before the snap
+func (s *Snap) Connect(ctx context.Context) *pgx.Conn {
+	s.t.Helper()
+
+	db, err := pgx.Connect(ctx, s.DSN())
+	if err != nil {
+		s.t.Fatalf("pgsnap: can't connect to %s: %v", s.addr, err)
+	}
+
+	s.t.Cleanup(func() { db.Close(context.Background()) })
+	return db
+}
+
 func (s *Snap) Wait() error {
 	return s.WaitFor(5 * time.Second)
 }
 
 func (s *Snap) WaitFor(d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	return s.wait(ctx.Done(), func() error { return errors.New("pgsnap timeout") })
+}
+
+// Replay block until the snapshot is replayed (or the recording is saved),
+// and return the error of the replay, like Wait, or ctx.Err() when ctx is
+// done first. Unlike Finish it never fails the test, so the error is the
+// caller's to handle, e.g. in a harness running outside go test. The snap
+// isn't closed when ctx is done, Close does it.
+func (s *Snap) Replay(ctx context.Context) error {
+	return s.wait(ctx.Done(), ctx.Err)
+}
+
+// wait return the end of the replay, or expired() once expired is closed
+func (s *Snap) wait(expired <-chan struct{}, timeout func() error) error {
+	atomic.StoreInt32(&s.waited, 1)
+
 	if s.writeMode {
-		s.done <- struct{}{}
+		return s.saveRecording()
 	}
 
 	select {
-	case <-time.After(d):
-		return errors.New("pgsnap timeout")
+	case <-expired:
+		return timeout()
 	case e := <-s.errchan:
 		return e
 	case <-s.done:
+		return s.pendingErr()
+	case <-s.closed:
+		select {
+		case <-s.done:
+			return s.pendingErr()
+		default:
+			return s.reason
+		}
+	}
+}
+
+// pendingErr return error reported after the script is finished, e.g.
+// connection that come after the last script
+func (s *Snap) pendingErr() error {
+	select {
+	case e := <-s.errchan:
+		return e
+	default:
 		return nil
 	}
 }
 
+// drain drop the errors reported and the end of the replay not taken by
+// Wait
+func (s *Snap) drain() {
+	for {
+		select {
+		case <-s.errchan:
+		case <-s.done:
+		default:
+			return
+		}
+	}
+}
+
+// Close stops the fake postgres by closing the listener and every open
+// connection. It is called on test cleanup, and it is safe to call Close
+// more than once.
+func (s *Snap) Close() error {
+	return s.close(ErrClosed)
+}
+
+func (s *Snap) close(reason error) error {
+	s.closeOnce.Do(func() {
+		s.reason = reason
+		close(s.closed)
+
+		s.closeErr = s.l.Close()
+		if s.cfg.unixSocket {
+			os.Remove(s.addr)
+		}
+
+		s.closeConns()
+
+		// the next snap use the shared listener once every goroutine of
+		// this one is done, so none of them accept its connections
+		if s.release != nil {
+			go func() {
+				s.running.Wait()
+				s.release()
+			}()
+		}
+	})
+
+	return s.closeErr
+}
+
+// closeConns close every open connection
+func (s *Snap) closeConns() {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Snap) closeOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		s.close(ctx.Err())
+	case <-s.closed:
+	}
+}
+
+func (s *Snap) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// report send err to be returned by Wait, errors after Snap is closed
+// are dropped as they're caused by the closing itself
+func (s *Snap) report(err error) {
+	if s.isClosed() {
+		return
+	}
+
+	select {
+	case s.errchan <- err:
+	case <-s.closed:
+	}
+}
+
+// track keep conn to be closed by Close, until untrack is called
+func (s *Snap) track(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.isClosed() {
+		conn.Close()
+		return
+	}
+	s.conns[conn] = struct{}{}
+}
+
+func (s *Snap) untrack(conn net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, conn)
+	conn.Close()
+}
+
 func (s *Snap) getFile() (*os.File, error) {
 	return os.Open(s.getFilename())
 }
 
 func (s *Snap) getFilename() string {
-	return s.t.Name() + ".txt"
+	if s.file != "" {
+		return s.file
+	}
+	return s.snapshotPath() + s.fileExt()
 }
 
-func (s *Snap) listen() net.Listener {
-	var err error
+// snapshotPath return the path of the snapshot without its extension: the
+// name of the test in the directory set by WithSnapshotDir or PGSNAP_DIR.
+// Subtest is in the directory of its parent test, e.g. TestDB/get_user.
+func (s *Snap) snapshotPath() string {
+	dir := s.cfg.snapshotDir
+	if dir == "" {
+		dir = os.Getenv("PGSNAP_DIR")
+	}
+	return filepath.Join(dir, snapshotName(s.t.Name()))
+}
 
-	s.l, err = net.Listen("tcp", "127.0.0.1:")
+// snapshotName return test name as path, with "/" kept as the separator
+// of subtest, and space and control characters replaced by "_" like
+// testing does for the name of subtest
+func snapshotName(name string) string {
+	parts := strings.Split(name, "/")
+	for i, p := range parts {
+		if p == "" || p == "." || p == ".." {
+			parts[i] = "_"
+			continue
+		}
+		parts[i] = strings.Map(func(r rune) rune {
+			if r <= ' ' || r == 0x7f {
+				return '_'
+			}
+			return r
+		}, p)
+	}
+	return strings.Join(parts, "/")
+}
+
+// snapshotOwners map the path of every snapshot used in the process to
+// the test using it, so two tests don't use the same file. The path is
+// compared ignoring case, as it's the same file on macOS and Windows.
+var snapshotOwners = struct {
+	sync.Mutex
+	tests map[string]string
+}{tests: map[string]string{}}
+
+// claimSnapshot return an error when the snapshot of the test is already
+// used by another test, e.g. subtests "User" and "user"
+func (s *Snap) claimSnapshot() error {
+	path, err := filepath.Abs(s.snapshotPath())
 	if err != nil {
-		s.t.Fatal("can't open port: " + err.Error())
+		return err
 	}
+	path = strings.ToLower(path)
 
-	s.addr = fmt.Sprintf("postgres://user@%s/?sslmode=disable&statement_cache_mode=describe", s.l.Addr())
+	snapshotOwners.Lock()
+	defer snapshotOwners.Unlock()
 
-	return s.l
+	if other, ok := snapshotOwners.tests[path]; ok && other != s.t.Name() {
+		return fmt.Errorf("pgsnap: %s and %s use the same snapshot %s", other, s.t.Name(), s.getFilename())
+	}
+	snapshotOwners.tests[path] = s.t.Name()
+	return nil
 }
 
-func (s *Snap) shouldRunProxy(forceWrite bool, err error) bool {
-	if forceWrite == true {
-		return true
+// fileExt return the extension of the snapshot file. The snapshot is read
+// from the file that exists, a new one is recorded as set by WithFormat
+// and WithGzip.
+func (s *Snap) fileExt() string {
+	name := s.snapshotPath()
+	for _, ext := range []string{".txt", yamlExt, gzipExt} {
+		if _, err := os.Stat(name + ext); err == nil {
+			return ext
+		}
 	}
 
-	if os.IsNotExist(err) {
-		return true
+	switch {
+	case s.cfg.format == FormatYAML:
+		return yamlExt
+	case s.cfg.gzip:
+		return gzipExt
 	}
+	return ".txt"
+}
 
-	if errors.Is(EmptyScript, err) {
-		return true
+func (s *Snap) listen() error {
+	if s.cfg.unixSocket {
+		return s.listenUnix()
+	}
+
+	addr := s.cfg.listenAddr
+	if addr == "" {
+		addr = "127.0.0.1:"
+	}
+
+	var l net.Listener
+	var err error
+	if s.cfg.sharedListener {
+		l, err = s.listenShared(addr)
+	} else if l, err = net.Listen("tcp", addr); err != nil {
+		err = fmt.Errorf("pgsnap: can't listen on %s: %w", addr, err)
+	}
+	if err != nil {
+		return err
 	}
+	s.l = s.newCancelListener(l)
+
+	s.addr = s.l.Addr().String()
+
+	return nil
+}
+
+// unixSocketName is the name of the socket file used by postgres (and
+// expected by the clients) for port 5432
+const unixSocketName = ".s.PGSQL.5432"
+
+// listenUnix listen on unix socket in the directory set by WithUnixSocket,
+// or in a new temporary directory
+func (s *Snap) listenUnix() error {
+	dir := s.cfg.unixSocketDir
+	if dir == "" {
+		var err error
+		dir, err = os.MkdirTemp("", "pgsnap")
+		if err != nil {
+			return fmt.Errorf("pgsnap: can't create directory for socket: %w", err)
+		}
+		s.t.Cleanup(func() { os.RemoveAll(dir) })
+	}
+
+	path := filepath.Join(dir, unixSocketName)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("pgsnap: can't listen on %s: %w", path, err)
+	}
+	s.l = s.newCancelListener(l)
+
+	s.addr = path
+
+	return nil
+}
+
+func (s *Snap) shouldRunProxy(err error) bool {
+	return s.shouldRecord() || isMissing(err)
+}
+
+// shouldRecord tell whether the snapshot is recorded even when it exists
+func (s *Snap) shouldRecord() bool {
+	return s.cfg.forceWrite || os.Getenv("PGSNAP_RECORD") == "1" || os.Getenv("PGSNAP_UPDATE") == "1"
+}
 
-	return false
+// isMissing tell whether err is returned by getScript because the
+// snapshot doesn't exist or is empty
+func isMissing(err error) bool {
+	return os.IsNotExist(err) || errors.Is(EmptyScript, err)
 }
@@ -1,15 +1,31 @@
 package pgsnap
 
 import (
+	"bytes"
 	"context"
 	"database/sql"
+	_ "embed"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgx/v4"
-	_ "github.com/lib/pq"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/lib/pq"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"go.uber.org/goleak"
 )
 
 const addr = "postgres://postgres@127.0.0.1:15432/?sslmode=disable"
@@ -18,33 +34,498 @@ func TestSnap_runScript_pq(t *testing.T) {
 	s := NewSnap(t, addr)
 	defer s.Finish()
 
-	runPQ(t, s.Addr())
+	runPQ(t, s.DSN())
 }
 
 func TestSnap_runScript_pgx(t *testing.T) {
 	s := NewSnap(t, addr)
 	defer s.Finish()
 
-	runPGX(t, s.Addr())
+	runPGX(t, s.DSN())
 }
 
 func TestSnap_runProxy_pq(t *testing.T) {
 	s := NewSnapWithForceWrite(t, addr, true)
 	defer s.Finish()
 
-	runPQ(t, s.Addr())
+	runPQ(t, s.DSN())
 }
 
 func TestSnap_runEmptyScript(t *testing.T) {
 	s := NewSnap(t, addr)
 	defer s.Finish()
 
-	runPQ(t, s.Addr())
+	runPQ(t, s.DSN())
 
 	// revert to empty file again
 	os.WriteFile("TestSnap_runEmptyScript.txt", []byte(""), os.ModePerm)
 }
 
+func TestSnap_withTimeout(t *testing.T) {
+	s := NewSnap(t, addr, WithTimeout(5*time.Second))
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+
+	err = db.Ping()
+	require.NoError(t, err)
+
+	// slower than the default deadline
+	time.Sleep(1500 * time.Millisecond)
+
+	rows, err := db.Query("select id from generate_series(1, 1000) id")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	count := 0
+	for rows.Next() {
+		count++
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, 1000, count)
+}
+
+func TestSnap_multipleConnections(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	runPingAndSelect1(t, s.DSN())
+}
+
+func TestSnap_multipleConnectionsTooMany(t *testing.T) {
+	s := NewSnap(t, addr)
+
+	runPingAndSelect1(t, s.DSN())
+
+	_, err := pgx.Connect(context.TODO(), s.DSN())
+	assert.Error(t, err)
+
+	assert.Equal(t, ErrNoMoreConn, s.Wait())
+}
+
+func TestSnap_withMaxConns(t *testing.T) {
+	s := NewSnap(t, addr, WithMaxConns(8))
+	defer s.Finish()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			db, err := sql.Open("postgres", s.DSN())
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer db.Close()
+
+			var one int
+			err = db.QueryRow("select 1").Scan(&one)
+			assert.NoError(t, err)
+			assert.Equal(t, 1, one)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestSnap_withContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	s := NewSnapContext(ctx, t, addr, WithTimeout(0))
+	t.Cleanup(func() { s.Close() })
+
+	// connect but never send the query expected by the script
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+
+	start := time.Now()
+	err = s.Wait()
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close())
+}
+
+func TestSnap_unconsumedSteps(t *testing.T) {
+	s := NewSnap(t, addr, WithTimeout(200*time.Millisecond))
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	// the script expects select 1 after the ping
+	err = db.Ping()
+	require.NoError(t, err)
+
+	assert.Error(t, s.Wait())
+	assert.Equal(t, []string{"  connection 1 step 4: Query"}, s.progress.unconsumed())
+}
+
+func TestSnap_extraQuery(t *testing.T) {
+	s := NewSnap(t, addr)
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Ping()
+	require.NoError(t, err)
+
+	_, err = db.Exec("delete from mytable")
+	assert.Error(t, err)
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "unexpected message after the script is finished")
+	assert.Contains(t, err.Error(), "delete from mytable")
+}
+
+func TestSnap_record(t *testing.T) {
+	// the replay of TestSnap_record.txt act as the real postgres
+	upstream := NewSnap(t, addr)
+	defer upstream.Finish()
+
+	t.Run("record", func(t *testing.T) {
+		t.Cleanup(func() { os.RemoveAll("TestSnap_record") })
+
+		s := NewSnapWithForceWrite(t, upstream.DSN(), true)
+
+		db, err := sql.Open("postgres", s.DSN())
+		require.NoError(t, err)
+
+		err = db.Ping()
+		require.NoError(t, err)
+
+		var one int
+		err = db.QueryRow("select 1").Scan(&one)
+		require.NoError(t, err)
+		db.Close()
+
+		require.NoError(t, s.Wait())
+
+		recorded, err := os.ReadFile("TestSnap_record/record.txt")
+		require.NoError(t, err)
+
+		expected, err := os.ReadFile("TestSnap_record.txt")
+		require.NoError(t, err)
+
+		assert.Equal(t, string(expected), withoutStartup(t, recorded))
+	})
+}
+
+// withoutStartup check the header and startup of the recording, and return
+// the rest of it, to be compared with snapshot in the old format
+func withoutStartup(t *testing.T, recorded []byte) string {
+	t.Helper()
+
+	lines := recordingLines(recorded)
+	require.NotEmpty(t, lines)
+	assert.Equal(t, "V1 auth=trust", string(lines[0]))
+	assert.Contains(t, string(recorded), "\nF {\"Type\":\"StartupMessage\"")
+
+	var b strings.Builder
+	for _, line := range (&Snap{}).withoutStartup(lines) {
+		b.Write(line)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func TestSnap_update(t *testing.T) {
+	upstream := NewSnap(t, addr, WithMaxConns(2))
+	defer upstream.Finish()
+
+	os.Setenv("PGSNAP_UPDATE", "1")
+	defer os.Unsetenv("PGSNAP_UPDATE")
+
+	t.Cleanup(func() { os.RemoveAll("TestSnap_update") })
+	require.NoError(t, os.MkdirAll("TestSnap_update", 0755))
+
+	expected, err := os.ReadFile("TestSnap_update.txt")
+	require.NoError(t, err)
+
+	t.Run("unchanged", func(t *testing.T) {
+		// same messages in the old format, with blank lines
+		unchanged := "\n" + strings.TrimSpace(string(expected))
+		require.NoError(t, os.WriteFile("TestSnap_update/unchanged.txt", []byte(unchanged), 0644))
+
+		s := NewSnap(t, upstream.DSN())
+		runPingAndSelect1InOneConn(t, s.DSN())
+		require.NoError(t, s.Wait())
+
+		updated, err := os.ReadFile("TestSnap_update/unchanged.txt")
+		require.NoError(t, err)
+		assert.Equal(t, unchanged, string(updated))
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		stale := `F {"Type":"Query","String":"select 2"}`
+		require.NoError(t, os.WriteFile("TestSnap_update/stale.txt", []byte(stale), 0644))
+
+		s := NewSnap(t, upstream.DSN())
+		runPingAndSelect1InOneConn(t, s.DSN())
+		require.NoError(t, s.Wait())
+
+		updated, err := os.ReadFile("TestSnap_update/stale.txt")
+		require.NoError(t, err)
+		assert.Equal(t, string(expected), withoutStartup(t, updated))
+	})
+}
+
+func TestSnap_unknownMessagePolicy(t *testing.T) {
+	// the replay of TestSnap_unknownMessagePolicy.txt act as the real
+	// postgres, sending messages that pgsnap can't replay
+	upstream := NewSnap(t, addr, WithMaxConns(2))
+	defer upstream.Finish()
+
+	t.Cleanup(func() { os.RemoveAll("TestSnap_unknownMessagePolicy") })
+
+	query := `F {"Type":"Query","String":"select 1"}` + "\n"
+	end := `B {"Type":"CommandComplete","CommandTag":"SELECT 1"}` + "\n" +
+		`B {"Type":"ReadyForQuery","TxStatus":"I"}` + "\n"
+
+	t.Run("raw", func(t *testing.T) {
+		s := NewSnapWithForceWrite(t, upstream.DSN(), true, WithUnknownMessagePolicy(UnknownMessageRaw))
+		assert.Equal(t, []string{"W", "x", "CommandComplete", "ReadyForQuery"}, rawQuery(t, s.Addr(), "select 1"))
+		require.NoError(t, s.Wait())
+
+		recorded, err := os.ReadFile("TestSnap_unknownMessagePolicy/raw.txt")
+		require.NoError(t, err)
+		assert.Equal(t, query+
+			`B {"Type":"UnknownMessage","MsgType":"W","Data":"AAAA"}`+"\n"+
+			`B {"Type":"UnknownMessage","MsgType":"x","Data":"AQID"}`+"\n"+
+			end, withoutStartup(t, recorded))
+	})
+
+	t.Run("skip", func(t *testing.T) {
+		s := NewSnapWithForceWrite(t, upstream.DSN(), true, WithUnknownMessagePolicy(UnknownMessageSkip))
+		assert.Equal(t, []string{"W", "x", "CommandComplete", "ReadyForQuery"}, rawQuery(t, s.Addr(), "select 1"))
+		require.NoError(t, s.Wait())
+
+		recorded, err := os.ReadFile("TestSnap_unknownMessagePolicy/skip.txt")
+		require.NoError(t, err)
+		assert.Equal(t, query+end, withoutStartup(t, recorded))
+	})
+}
+
+// rawQuery send Query sql to the fake postgres at addr, and return the
+// types of the messages answering it, with the message type of the
+// messages that pgproto3 can't read
+func rawQuery(t *testing.T, addr, sql string) []string {
+	t.Helper()
+	return rawSend(t, addr, &pgproto3.Query{String: sql})
+}
+
+// rawSend send msgs after the startup, and return the types of the
+// message received until ReadyForQuery
+func rawSend(t *testing.T, addr string, msgs ...pgproto3.FrontendMessage) []string {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	raw := &rawReader{cr: pgproto3.NewChunkReader(conn)}
+	fe := pgproto3.NewFrontend(raw, conn)
+
+	receive := func() string {
+		msg, err := fe.Receive()
+		if m, ok := raw.unknown(err); ok {
+			return string(rune(m.MsgType))
+		}
+		require.NoError(t, err)
+		if m, ok := msg.(*pgproto3.CopyBothResponse); ok {
+			require.Empty(t, m.ColumnFormatCodes)
+			return "W"
+		}
+		return messageType(msg)
+	}
+
+	require.NoError(t, fe.Send(&pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: map[string]string{"user": "user"}}))
+	for receive() != "ReadyForQuery" {
+	}
+
+	for _, msg := range msgs {
+		require.NoError(t, fe.Send(msg))
+	}
+	var types []string
+	for len(types) == 0 || types[len(types)-1] != "ReadyForQuery" {
+		types = append(types, receive())
+	}
+
+	// pgsnap may have closed the connection after a mismatch
+	_ = fe.Send(&pgproto3.Terminate{})
+	return types
+}
+
+func TestSnap_rawStep(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "SELECT 1", string(results[0].CommandTag))
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+
+	f, err := os.Open("TestSnap_rawStep.txt")
+	require.NoError(t, err)
+	defer f.Close()
+	assert.Empty(t, VerifyRoundTrip(f))
+}
+
+func Test_unmarshalRaw(t *testing.T) {
+	msg, err := unmarshalRawF([]byte(`{"Type":"RAW","Data":"UQAAAA1zZWxlY3QgMQA="}`))
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.Query{String: "select 1"}, msg)
+
+	_, err = unmarshalRawB([]byte(`{"Type":"RAW","Data":"QwAAAA9TRUxFQ1QgMQA="}`))
+	require.Error(t, err)
+	assert.Equal(t, "Data of RAW must be one message, with its type and length", err.Error())
+}
+
+func TestSnap_withOnEmptyFail(t *testing.T) {
+	_, err := New(t, addr, WithOnEmpty(OnEmptyFail))
+	require.Error(t, err)
+	assert.Equal(t, "pgsnap: TestSnap_withOnEmptyFail.txt doesn't exist or is empty, record it with PGSNAP_RECORD=1", err.Error())
+}
+
+func TestSnap_withOnEmptyRecord(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll("TestSnap_withOnEmptyRecord") })
+	require.NoError(t, os.MkdirAll("TestSnap_withOnEmptyRecord", 0755))
+	require.NoError(t, os.WriteFile("TestSnap_withOnEmptyRecord/upstream.txt", []byte(selectOneSnapshot), 0644))
+
+	t.Run("upstream", func(t *testing.T) {
+		upstream := NewSnap(t, addr)
+		defer upstream.Finish()
+
+		// the snapshot doesn't exist, it's recorded by default
+		t.Run("missing", func(t *testing.T) {
+			s := NewSnap(t, upstream.DSN())
+			execSelectOne(t, s)
+			require.NoError(t, s.Wait())
+		})
+	})
+
+	b, err := os.ReadFile("TestSnap_withOnEmptyRecord/upstream/missing.txt")
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `F {"Type":"Query","String":"select 1"}`)
+}
+
+func TestSnap_withOnEmptySkip(t *testing.T) {
+	var sub *testing.T
+	reached := false
+	t.Run("missing", func(t *testing.T) {
+		sub = t
+		NewSnap(t, addr, WithOnEmpty(OnEmptySkip))
+		reached = true
+	})
+
+	assert.True(t, sub.Skipped())
+	assert.False(t, reached)
+}
+
+func runPingAndSelect1InOneConn(t *testing.T, addr string) {
+	t.Helper()
+
+	db, err := sql.Open("postgres", addr)
+	require.NoError(t, err)
+	defer db.Close()
+
+	err = db.Ping()
+	require.NoError(t, err)
+
+	var one int
+	err = db.QueryRow("select 1").Scan(&one)
+	require.NoError(t, err)
+	assert.Equal(t, 1, one)
+}
+
+func TestSnap_withRedactor(t *testing.T) {
+	upstream := NewSnap(t, addr)
+	defer upstream.Finish()
+
+	t.Cleanup(func() { os.RemoveAll("TestSnap_withRedactor") })
+
+	t.Run("record", func(t *testing.T) {
+		s := NewSnapWithForceWrite(t, upstream.DSN(), true, WithRedactor(nil))
+		assert.Equal(t, "secret", runSelectText(t, s.DSN(), "secret"))
+		require.NoError(t, s.Wait())
+
+		recorded, err := os.ReadFile("TestSnap_withRedactor/record.txt")
+		require.NoError(t, err)
+		assert.NotContains(t, string(recorded), `"Parameters":[{"text":"secret"}]`)
+		assert.Contains(t, string(recorded), Redacted)
+
+		require.NoError(t, os.WriteFile("TestSnap_withRedactor/replay.txt", recorded, 0644))
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		s := NewSnap(t, addr)
+		defer s.Finish()
+
+		// the redacted parameter match any value
+		assert.Equal(t, "secret", runSelectText(t, s.DSN(), "another secret"))
+	})
+}
+
+func runSelectText(t *testing.T, addr string, param string) string {
+	t.Helper()
+
+	db, err := sql.Open("postgres", addr)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var result string
+	err = db.QueryRow("select $1::text", param).Scan(&result)
+	require.NoError(t, err)
+
+	return result
+}
+
+func TestSnap_statementNames(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	// the snapshot name the statement stmtcache_42, pgx will name it lrupsc_*
+	dsn := strings.Replace(s.DSN(), "statement_cache_mode=describe", "statement_cache_mode=prepare", 1)
+
+	runPGX(t, dsn)
+}
+
+// runPingAndSelect1 ping in one connection and select 1 in another one
+func runPingAndSelect1(t *testing.T, addr string) {
+	t.Helper()
+
+	db, err := sql.Open("postgres", addr)
+	require.NoError(t, err)
+
+	err = db.Ping()
+	require.NoError(t, err)
+	db.Close()
+
+	db, err = sql.Open("postgres", addr)
+	require.NoError(t, err)
+	defer db.Close()
+
+	var one int
+	err = db.QueryRow("select 1").Scan(&one)
+	require.NoError(t, err)
+	assert.Equal(t, 1, one)
+}
+
 func runPQ(t *testing.T, addr string) {
 	t.Helper()
 
@@ -87,3 +568,3668 @@ func Test_getFilename(t *testing.T) {
 		assert.Equal(t, "Test_getFilename/what_about_this_one?.txt", s.getFilename())
 	})
 }
+
+func TestSnap_withIgnoreColumnsRecorded(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll("TestSnap_withIgnoreColumnsRecorded") })
+	require.NoError(t, os.MkdirAll("TestSnap_withIgnoreColumnsRecorded", 0755))
+	require.NoError(t, os.WriteFile("TestSnap_withIgnoreColumnsRecorded/upstream.txt", []byte(`F {"Type":"Query","String":"select id, name from users"}
+B {"Type":"RowDescription","Fields":[{"Name":"id","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0},{"Name":"name","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":25,"DataTypeSize":-1,"TypeModifier":-1,"Format":0}]}
+B {"Type":"DataRow","Values":[{"text":"1"},{"text":"joe"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`), 0644))
+
+	t.Run("upstream", func(t *testing.T) {
+		upstream := NewSnap(t, addr)
+		defer upstream.Finish()
+
+		t.Run("ignored", func(t *testing.T) {
+			s := NewSnap(t, upstream.DSN(), WithIgnoreColumns("id"))
+
+			db, err := pgx.Connect(context.TODO(), s.DSN())
+			require.NoError(t, err)
+			defer db.Close(context.TODO())
+
+			// the client gets the value of postgres
+			results, err := db.PgConn().Exec(context.TODO(), "select id, name from users").ReadAll()
+			require.NoError(t, err)
+			assert.Equal(t, "1", string(results[0].Rows[0][0]))
+
+			require.NoError(t, s.Wait())
+		})
+	})
+
+	// only the ignored column is blanked in the snapshot
+	b, err := os.ReadFile("TestSnap_withIgnoreColumnsRecorded/upstream/ignored.txt")
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `B {"Type":"DataRow","Values":[{"text":""},{"text":"joe"}]}`)
+}
+
+func Test_blankColumns(t *testing.T) {
+	row := &pgproto3.DataRow{Values: [][]byte{[]byte("1"), nil, []byte("joe")}}
+
+	blanked := blankColumns(row, map[int]bool{0: true, 1: true})
+	assert.Equal(t, [][]byte{{}, nil, []byte("joe")}, blanked.Values)
+
+	// the row sent to the client isn't changed
+	assert.Equal(t, "1", string(row.Values[0]))
+}
+
+func Test_sameRecording(t *testing.T) {
+	recording := func(id, createdAt string) []byte {
+		return []byte(`F {"Type":"Query","String":"select id, name, created_at from users"}
+B {"Type":"RowDescription","Fields":[{"Name":"id","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0},{"Name":"name","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":25,"DataTypeSize":-1,"TypeModifier":-1,"Format":0},{"Name":"created_at","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":1184,"DataTypeSize":8,"TypeModifier":-1,"Format":0}]}
+B {"Type":"DataRow","Values":[{"text":"` + id + `"},{"text":"joe"},{"text":"` + createdAt + `"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`)
+	}
+
+	old := recording("1", "2021-01-01 00:00:00+00")
+	changed := recording("2", "2021-01-02 00:00:00+00")
+
+	s := &Snap{cfg: defaultConfig()}
+	assert.True(t, s.sameRecording(old, old))
+	assert.False(t, s.sameRecording(old, changed))
+
+	s = &Snap{cfg: defaultConfig()}
+	WithIgnoreColumns("id", "created_at")(&s.cfg)
+	assert.True(t, s.sameRecording(old, changed))
+
+	s = &Snap{cfg: defaultConfig()}
+	WithIgnoreColumnIndexes(0, 2)(&s.cfg)
+	assert.True(t, s.sameRecording(old, changed))
+
+	s = &Snap{cfg: defaultConfig()}
+	WithIgnoreColumns("created_at")(&s.cfg)
+	assert.False(t, s.sameRecording(old, changed))
+}
+
+func Test_sameRecordingWildcard(t *testing.T) {
+	recording := func(id, createdAt string) []byte {
+		return []byte(`F {"Type":"Query","String":"select id, name, created_at from users"}
+B {"Type":"RowDescription","Fields":[{"Name":"id","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":2950,"DataTypeSize":16,"TypeModifier":-1,"Format":0},{"Name":"name","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":25,"DataTypeSize":-1,"TypeModifier":-1,"Format":0},{"Name":"created_at","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":1184,"DataTypeSize":8,"TypeModifier":-1,"Format":0}]}
+B {"Type":"DataRow","Values":[` + id + `,{"text":"joe"},` + createdAt + `]}
+B {"Type":"DataRow","Values":[{"text":"6e0e"},{"text":"jane"},{"text":"2021-01-01 00:00:00+00"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 2"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`)
+	}
+
+	old := recording(`{"text":"2f1c","match":"*"}`, `{"text":"2021-01-01 00:00:00+00","match":"*"}`)
+	changed := recording(`{"text":"9a3b"}`, `{"text":"2021-01-02 00:00:00+00"}`)
+
+	s := &Snap{cfg: defaultConfig()}
+	assert.True(t, s.sameRecording(old, changed))
+
+	// only the columns of the row with the wildcard are skipped
+	assert.False(t, s.sameRecording(old, bytes.Replace(changed, []byte("6e0e"), []byte("7f1f"), 1)))
+
+	old = recording(`{"text":"2f1c","match":"*"}`, `{"text":"2021-01-01 00:00:00+00"}`)
+	assert.False(t, s.sameRecording(old, changed))
+
+	s = &Snap{cfg: defaultConfig()}
+	WithIgnoreColumns("created_at")(&s.cfg)
+	assert.True(t, s.sameRecording(old, changed))
+}
+
+func TestSnap_dataRowWildcard(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	// the recorded value is sent
+	results, err := db.PgConn().Exec(context.TODO(), "select gen_random_uuid()::text, 'joe'").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "2f1c6a3e-5d0b-4b8e-9f1a-3c2d1e0f9a8b", string(results[0].Rows[0][0]))
+}
+
+func Test_sameRecordingNumeric(t *testing.T) {
+	recording := func(price, rate, code string) []byte {
+		return []byte(`F {"Type":"Query","String":"select price, rate, code from products"}
+B {"Type":"RowDescription","Fields":[{"Name":"price","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":1700,"DataTypeSize":-1,"TypeModifier":-1,"Format":0},{"Name":"rate","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":701,"DataTypeSize":8,"TypeModifier":-1,"Format":0},{"Name":"code","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":25,"DataTypeSize":-1,"TypeModifier":-1,"Format":0}]}
+B {"Type":"DataRow","Values":[{"text":"` + price + `"},{"text":"` + rate + `"},{"text":"` + code + `"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`)
+	}
+
+	s := &Snap{cfg: defaultConfig()}
+	assert.True(t, s.sameRecording(recording("1.5", "1e3", "1.0"), recording("1.50", "1000", "1.0")))
+	assert.True(t, s.sameRecording(recording("NaN", "Infinity", "1.0"), recording("NaN", "Infinity", "1.0")))
+	assert.False(t, s.sameRecording(recording("1.5", "1000", "1.0"), recording("1.51", "1000", "1.0")))
+
+	// text that looks like number is compared as it is
+	assert.False(t, s.sameRecording(recording("1.5", "1000", "1.0"), recording("1.5", "1000", "1.00")))
+}
+
+func Test_sameRecordingRowDescription(t *testing.T) {
+	recording := func(field string) []byte {
+		return []byte(`F {"Type":"Query","String":"select name from users"}
+B {"Type":"RowDescription","Fields":[` + field + `]}
+B {"Type":"DataRow","Values":[{"text":"joe"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`)
+	}
+
+	old := recording(`{"Name":"name","TableOID":16384,"TableAttributeNumber":2,"DataTypeOID":25,"DataTypeSize":-1,"TypeModifier":-1,"Format":0}`)
+	upgraded := recording(`{"Name":"name","TableOID":24576,"TableAttributeNumber":2,"DataTypeOID":25,"DataTypeSize":-1,"TypeModifier":-1,"Format":0}`)
+	varchar := recording(`{"Name":"name","TableOID":24576,"TableAttributeNumber":2,"DataTypeOID":1043,"DataTypeSize":-1,"TypeModifier":259,"Format":0}`)
+	renamed := recording(`{"Name":"full_name","TableOID":24576,"TableAttributeNumber":2,"DataTypeOID":25,"DataTypeSize":-1,"TypeModifier":-1,"Format":0}`)
+
+	s := &Snap{cfg: defaultConfig()}
+	assert.False(t, s.sameRecording(old, upgraded))
+
+	s = &Snap{cfg: defaultConfig()}
+	WithIgnoreRowDescriptionFields("TableOID", "TypeModifier")(&s.cfg)
+	assert.True(t, s.sameRecording(old, upgraded))
+	assert.False(t, s.sameRecording(old, varchar))
+	assert.False(t, s.sameRecording(old, renamed))
+
+	s = &Snap{cfg: defaultConfig()}
+	WithIgnoreRowDescriptionFields("TableOID", "TypeModifier", "DataTypeOID")(&s.cfg)
+	assert.True(t, s.sameRecording(old, varchar))
+}
+
+func TestSnap_queryPattern(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	var one int
+	require.NoError(t, db.QueryRow("select 1").Scan(&one))
+	require.NoError(t, db.QueryRow("select 42").Scan(&one))
+}
+
+func Test_queryPattern(t *testing.T) {
+	re, err := queryPattern(&pgproto3.Query{String: `~select \* from t where id in \(.*\)`})
+	require.NoError(t, err)
+	assert.True(t, re.MatchString("select * from t where id in (1, 2, 3)"))
+	assert.False(t, re.MatchString("select * from t where id in (1, 2, 3) limit 1"))
+
+	re, err = queryPattern(&pgproto3.Parse{Query: "~select now\\(\\)"})
+	require.NoError(t, err)
+	assert.True(t, re.MatchString("select now()"))
+
+	re, err = queryPattern(&pgproto3.Query{String: "select 1"})
+	require.NoError(t, err)
+	assert.Nil(t, re)
+
+	_, err = queryPattern(&pgproto3.Query{String: "~select ("})
+	assert.Error(t, err)
+}
+
+func TestSnap_withNormalizeSQL(t *testing.T) {
+	s := NewSnap(t, addr, WithNormalizeSQL())
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var one int
+	require.NoError(t, db.QueryRow("\n\tselect 1\n\tas one\n").Scan(&one))
+}
+
+func TestSnap_withNormalizeSQLSemicolon(t *testing.T) {
+	s := NewSnap(t, addr, WithNormalizeSQL())
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var one int
+	require.NoError(t, db.QueryRow("SELECT 1;").Scan(&one))
+	assert.Equal(t, 1, one)
+}
+
+func Test_normalizeSQL(t *testing.T) {
+	tests := map[string]string{
+		"select 1":                          "select 1",
+		"  select\n\t1  ":                   "select 1",
+		"select  *\nfrom t\nwhere a = $1":   "select * from t where a = $1",
+		"select 'a  b',  'it''s  ok'":       "select 'a  b', 'it''s  ok'",
+		`select  "my   column"  from t`:     `select "my   column" from t`,
+		"select $$a  b$$,  $f$ x  $$ y $f$": "select $$a  b$$, $f$ x  $$ y $f$",
+		"select $1,  $2":                    "select $1, $2",
+		"select 'unterminated   ":           "select 'unterminated   ",
+		"SELECT 1;":                         "SELECT 1",
+		"SELECT 1 ;\n":                      "SELECT 1",
+		"SELECT 1;;":                        "SELECT 1;",
+		"select 1; select 2;":               "select 1; select 2",
+		"select 1; select 2":                "select 1; select 2",
+		"select ';'":                        "select ';'",
+		"select $$a;$$":                     "select $$a;$$",
+		"select 'unterminated;":             "select 'unterminated;",
+	}
+
+	for q, want := range tests {
+		assert.Equal(t, want, normalizeSQL(q), q)
+	}
+}
+
+func TestSnap_mismatch(t *testing.T) {
+	s := NewSnap(t, addr)
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Ping())
+
+	var n int
+	err = db.QueryRow("select 2").Scan(&n)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TestSnap_mismatch.txt:4: Query doesn't match the snapshot")
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TestSnap_mismatch.txt:4: Query doesn't match the snapshot")
+
+	var me *MismatchError
+	require.ErrorAs(t, err, &me)
+	assert.Equal(t, 4, me.Line)
+	assert.Equal(t, 4, me.Step)
+	assert.Equal(t, &pgproto3.Query{String: "select 2"}, me.Got)
+}
+
+func TestSnap_executeMaxRows(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	types := rawSend(t, s.Addr(),
+		&pgproto3.Parse{Query: "select * from generate_series(1, 3)"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{MaxRows: 2},
+		&pgproto3.Execute{MaxRows: 2},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{
+		"ParseComplete", "BindComplete",
+		"DataRow", "DataRow", "PortalSuspended",
+		"DataRow", "CommandComplete",
+		"ReadyForQuery",
+	}, types)
+}
+
+func TestSnap_executeMaxRowsMismatch(t *testing.T) {
+	s := NewSnap(t, addr)
+
+	// fetching every row is caught when the snapshot fetch 2 rows at a time
+	types := rawSend(t, s.Addr(),
+		&pgproto3.Parse{Query: "select * from generate_series(1, 3)"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{"ErrorResponse", "ReadyForQuery"}, types)
+
+	err := s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TestSnap_executeMaxRowsMismatch.txt:3: Execute doesn't match the snapshot")
+	assert.Contains(t, err.Error(), "MaxRows")
+}
+
+func TestSnap_transportError(t *testing.T) {
+	s := NewSnap(t, addr)
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+
+	// closed before sending the query of the snapshot
+	require.NoError(t, db.PgConn().Conn().Close())
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Equal(t, "pgsnap: connection failed at step 1: unexpected EOF", err.Error())
+
+	var te *TransportError
+	require.ErrorAs(t, err, &te)
+	assert.Equal(t, 1, te.Step)
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+
+	var me *MismatchError
+	assert.False(t, errors.As(err, &me))
+}
+
+func Test_mismatchError(t *testing.T) {
+	err := &MismatchError{
+		File: "TestX.txt",
+		Line: 12,
+		Want: &pgproto3.Bind{PreparedStatement: "s", Parameters: [][]byte{[]byte("1"), []byte("a")}},
+		Got:  &pgproto3.Bind{PreparedStatement: "s", Parameters: [][]byte{[]byte("1"), []byte("b")}},
+	}
+
+	assert.Equal(t, `pgsnap: TestX.txt:12: Bind doesn't match the snapshot
+--- want (snapshot)
++++ got (client)
+  Parameters[1]:
+-   "a"
++   "b"`, err.format(false))
+
+	assert.Contains(t, err.format(true), colorRed+"-   \"a\""+colorReset)
+
+	err = &MismatchError{
+		File: "TestX.txt",
+		Line: 3,
+		Want: &pgproto3.Query{String: "select 1"},
+		Got:  &pgproto3.Parse{Query: "select 1"},
+	}
+
+	assert.Equal(t, `pgsnap: TestX.txt:3: want Query, got Parse
+- {"Type":"Query","String":"select 1"}
++ {"Type":"Parse","Name":"","Query":"select 1","ParameterOIDs":null}`, err.format(false))
+}
+
+func Test_mismatchErrorOffset(t *testing.T) {
+	params := make([][]byte, 50)
+	for i := range params {
+		params[i] = []byte(fmt.Sprintf("value %d", i))
+	}
+	got := append([][]byte{}, params...)
+	got[37] = []byte("value 73")
+
+	err := &MismatchError{
+		File: "TestX.txt",
+		Line: 7,
+		Want: &pgproto3.Bind{Parameters: params},
+		Got:  &pgproto3.Bind{Parameters: got},
+	}
+
+	field, offset := err.Diverge()
+	assert.Equal(t, "Parameters[37]", field)
+	assert.Equal(t, 6, offset)
+	assert.Equal(t, `pgsnap: TestX.txt:7: Bind doesn't match the snapshot
+--- want (snapshot)
++++ got (client)
+  Parameters[37] (byte 6):
+-   "value 37"
++   "value 73"`, err.format(false))
+
+	// only the bytes around the offset of a long value are shown
+	data := strings.Repeat("a", 100) + "b" + strings.Repeat("c", 100)
+	err = &MismatchError{
+		File: "TestX.txt",
+		Line: 9,
+		Want: &pgproto3.CopyData{Data: []byte(data)},
+		Got:  &pgproto3.CopyData{Data: []byte(strings.Replace(data, "b", "x", 1))},
+	}
+
+	field, offset = err.Diverge()
+	assert.Equal(t, "Data", field)
+	assert.Equal(t, 100, offset)
+	assert.Equal(t, `pgsnap: TestX.txt:9: CopyData doesn't match the snapshot
+--- want (snapshot)
++++ got (client)
+  Data (byte 100):
+-   ..."`+strings.Repeat("a", 32)+"b"+strings.Repeat("c", 31)+`"...
++   ..."`+strings.Repeat("a", 32)+"x"+strings.Repeat("c", 31)+`"...`, err.format(false))
+
+	// other fields and other message types have no offset
+	err = &MismatchError{
+		Want: &pgproto3.Execute{MaxRows: 1},
+		Got:  &pgproto3.Execute{MaxRows: 2},
+	}
+	field, offset = err.Diverge()
+	assert.Equal(t, "MaxRows", field)
+	assert.Equal(t, -1, offset)
+
+	err = &MismatchError{Want: &pgproto3.Sync{}, Got: &pgproto3.Flush{}}
+	field, offset = err.Diverge()
+	assert.Equal(t, "", field)
+	assert.Equal(t, -1, offset)
+}
+
+func Test_mismatchErrorParams(t *testing.T) {
+	want, err := unmarshalBind([]byte(`{"Type":"Bind","ParameterFormatCodes":[1,0],"params":[{"int4":42},{"text":"foo"}]}`))
+	require.NoError(t, err)
+	params, err := parseBindParams([]byte(`{"params":[{"int4":42},{"text":"foo"}]}`))
+	require.NoError(t, err)
+
+	err = &MismatchError{
+		File:   "TestX.txt",
+		Line:   5,
+		Want:   want,
+		Got:    &pgproto3.Bind{ParameterFormatCodes: []int16{1, 0}, Parameters: [][]byte{{0, 0, 0, 43}, nil}},
+		params: params,
+	}
+
+	assert.Equal(t, `pgsnap: TestX.txt:5: Bind doesn't match the snapshot
+--- want (snapshot)
++++ got (client)
+  Parameters[0]:
+-   {"int4":42}
++   {"int4":43}
+  Parameters[1]:
+-   {"text":"foo"}
++   {"null":true}`, err.(*MismatchError).format(false))
+
+	// the typed parameter has no offset, like in the diff
+	field, offset := err.(*MismatchError).Diverge()
+	assert.Equal(t, "Parameters[0]", field)
+	assert.Equal(t, -1, offset)
+}
+
+func Test_unmarshalBind(t *testing.T) {
+	tests := []struct {
+		params string
+		codes  string
+		want   [][]byte
+	}{
+		{`[{"int2":-2},{"int4":42},{"int8":7}]`, `[1]`, [][]byte{{0xff, 0xfe}, {0, 0, 0, 42}, {0, 0, 0, 0, 0, 0, 0, 7}}},
+		{`[{"int2":-2},{"int4":42},{"int8":7}]`, `[]`, [][]byte{[]byte("-2"), []byte("42"), []byte("7")}},
+		{`[{"bool":true},{"float8":1.5},{"float4":0.5}]`, `[0,1,1]`, [][]byte{[]byte("t"), {0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, {0x3f, 0, 0, 0}}},
+		{`[{"bytea":"dead"},{"bytea":"beef"},{"null":true}]`, `[0,1,0]`, [][]byte{[]byte(`\xdead`), {0xbe, 0xef}, nil}},
+	}
+
+	for _, tt := range tests {
+		bind, err := unmarshalBind([]byte(`{"Type":"Bind","ParameterFormatCodes":` + tt.codes + `,"params":` + tt.params + `}`))
+		require.NoError(t, err, tt.params)
+		assert.Equal(t, tt.want, bind.Parameters, tt.params)
+	}
+
+	for _, src := range []string{
+		`{"Type":"Bind","params":[{"int2":100000}]}`,
+		`{"Type":"Bind","params":[{"int4":42,"text":"42"}]}`,
+		`{"Type":"Bind","params":[{"uuid":"x"}]}`,
+		`{"Type":"Bind","params":[{"null":false}]}`,
+		`{"Type":"Bind","Parameters":[{"text":"1"}],"params":[{"int4":1}]}`,
+	} {
+		_, err := unmarshalBind([]byte(src))
+		assert.Error(t, err, src)
+	}
+}
+
+func Test_readScriptLongLine(t *testing.T) {
+	value := strings.Repeat("x", 1<<20)
+
+	script := `F {"Type":"Query","String":"select big from t"}
+B {"Type":"DataRow","Values":[{"text":"` + value + `"}]}
+B {"Type":"ReadyForQuery","TxStatus":"I"}`
+
+	s := &Snap{t: t, cfg: defaultConfig()}
+	scripts, err := s.readScript(strings.NewReader(script))
+	require.NoError(t, err)
+	require.Len(t, scripts, 1)
+
+	steps := scripts[0].Steps[len(s.startupSteps()):]
+	require.Len(t, steps, 3)
+
+	var out bytes.Buffer
+	be := pgproto3.NewBackend(pgproto3.NewChunkReader(&bytes.Buffer{}), &out)
+	require.NoError(t, steps[1].Step(be))
+
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(&out), nil)
+	msg, err := fe.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.DataRow{}, msg)
+	assert.Equal(t, value, string(msg.(*pgproto3.DataRow).Values[0]))
+}
+
+func Test_readScriptComments(t *testing.T) {
+	script := `# ping
+F {"Type":"Query","String":";"}
+
+  # the answer
+B {"Type":"EmptyQueryResponse"}
+#B {"Type":"NoticeResponse"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`
+
+	s := &Snap{t: t, cfg: defaultConfig()}
+	scripts, err := s.readScript(strings.NewReader(script))
+	require.NoError(t, err)
+	require.Len(t, scripts, 1)
+	assert.Len(t, scripts[0].Steps, len(s.startupSteps())+3)
+
+	step := scripts[0].Steps[len(s.startupSteps())].(*expectStep)
+	assert.Equal(t, 2, step.line)
+
+	_, err = s.readScript(strings.NewReader("B"))
+	assert.Error(t, err)
+
+	_, err = s.readScript(strings.NewReader(`X {"Type":"Query","String":";"}`))
+	assert.Error(t, err)
+
+	_, err = s.readScript(strings.NewReader(`B {"Type":"Foo"}`))
+	assert.Error(t, err)
+}
+
+func Test_readScriptError(t *testing.T) {
+	script := `F {"Type":"Query","String":";"}
+B {"Type":"EmptyQueryResponse"}
+B {"Type":"Fo"}`
+
+	s := &Snap{t: t, cfg: defaultConfig()}
+	_, err := s.readScript(strings.NewReader(script))
+	require.Error(t, err)
+	assert.Equal(t, "Test_readScriptError.txt:3: B: unknown type `Fo`: B {\"Type\":\"Fo\"}", err.Error())
+
+	_, err = s.readScript(strings.NewReader(`F {"Type":"Query","String":1}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Test_readScriptError.txt:1: ")
+}
+
+func TestSnap_copyFrom(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	runCopyFrom(t, s.DSN(), "joe", "ann")
+}
+
+func TestSnap_copyFromStream(t *testing.T) {
+	// the snapshot split the data in two CopyData, lib/pq send only one
+	s := NewSnap(t, addr, WithCopyDataStream())
+	defer s.Finish()
+
+	runCopyFrom(t, s.DSN(), "joe", "ann")
+}
+
+func runCopyFrom(t *testing.T, addr string, names ...string) {
+	t.Helper()
+
+	db, err := sql.Open("postgres", addr)
+	require.NoError(t, err)
+	defer db.Close()
+
+	tx, err := db.Begin()
+	require.NoError(t, err)
+
+	stmt, err := tx.Prepare(pq.CopyIn("users", "name"))
+	require.NoError(t, err)
+
+	for _, name := range names {
+		_, err = stmt.Exec(name)
+		require.NoError(t, err)
+	}
+
+	_, err = stmt.Exec()
+	require.NoError(t, err)
+	require.NoError(t, stmt.Close())
+	require.NoError(t, tx.Commit())
+}
+
+func TestSnap_copyTo(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	var out bytes.Buffer
+	tag, err := db.PgConn().CopyTo(context.TODO(), &out, "copy users (name) to stdout")
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), tag.RowsAffected())
+	assert.Equal(t, "joe\nann\n", out.String())
+}
+
+func TestSnap_notification(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	_, err = db.Exec(context.TODO(), "listen events")
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.TODO(), time.Second)
+	defer cancel()
+
+	n, err := db.WaitForNotification(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(42), n.PID)
+	assert.Equal(t, "events", n.Channel)
+	assert.Equal(t, "hello", n.Payload)
+}
+
+func TestSnap_notice(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	base, err := pq.NewConnector(s.DSN())
+	require.NoError(t, err)
+
+	var notices []string
+	db := sql.OpenDB(pq.ConnectorWithNoticeHandler(base, func(n *pq.Error) {
+		notices = append(notices, n.Message)
+	}))
+	defer db.Close()
+
+	_, err = db.Exec("drop table if exists missing")
+	require.NoError(t, err)
+	assert.Equal(t, []string{`table "missing" does not exist, skipping`}, notices)
+}
+
+func Test_marshalJSONNoticeResponse(t *testing.T) {
+	notice := &pgproto3.NoticeResponse{Severity: "WARNING", Code: "01000", Message: "careful"}
+
+	b, err := marshalJSON(notice)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"Type":"NoticeResponse"`)
+
+	s := &Snap{t: t, cfg: defaultConfig()}
+	msg, err := s.unmarshalB(b)
+	require.NoError(t, err)
+	assert.Equal(t, notice, msg)
+}
+
+func TestSnap_withServerParameters(t *testing.T) {
+	s := NewSnap(t, addr, WithServerParameters(map[string]string{
+		"server_version":   "14.2",
+		"application_name": "pgsnap",
+		"IntervalStyle":    "",
+	}))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	require.NoError(t, db.Ping(context.TODO()))
+
+	assert.Equal(t, "14.2", db.PgConn().ParameterStatus("server_version"))
+	assert.Equal(t, "pgsnap", db.PgConn().ParameterStatus("application_name"))
+	assert.Equal(t, "UTC", db.PgConn().ParameterStatus("TimeZone"))
+	assert.Equal(t, "", db.PgConn().ParameterStatus("IntervalStyle"))
+}
+
+func TestSnap_parameterStatus(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	assert.Equal(t, "UTC", db.PgConn().ParameterStatus("TimeZone"))
+
+	_, err = db.Exec(context.TODO(), "set TimeZone = 'Asia/Jakarta'")
+	require.NoError(t, err)
+
+	assert.Equal(t, "Asia/Jakarta", db.PgConn().ParameterStatus("TimeZone"))
+}
+
+func TestSnap_flush(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	fe, conn := connectFrontend(t, s)
+	defer conn.Close()
+
+	require.NoError(t, fe.Send(&pgproto3.Parse{Query: "select 1"}))
+	require.NoError(t, fe.Send(&pgproto3.Flush{}))
+
+	// ParseComplete is sent after Flush, without waiting for Sync
+	msg, err := fe.Receive()
+	require.NoError(t, err)
+	assert.IsType(t, &pgproto3.ParseComplete{}, msg)
+
+	require.NoError(t, fe.Send(&pgproto3.Sync{}))
+	msg, err = fe.Receive()
+	require.NoError(t, err)
+	assert.IsType(t, &pgproto3.ReadyForQuery{}, msg)
+
+	require.NoError(t, fe.Send(&pgproto3.Terminate{}))
+}
+
+// connectFrontend open a connection to s and do the startup, so test can
+// send messages that drivers don't expose
+func connectFrontend(t *testing.T, s *Snap) (*pgproto3.Frontend, net.Conn) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.l.Addr().String())
+	require.NoError(t, err)
+
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	err = fe.Send(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "user"},
+	})
+	require.NoError(t, err)
+
+	for {
+		msg, err := fe.Receive()
+		require.NoError(t, err)
+
+		if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+			return fe, conn
+		}
+	}
+}
+
+func TestSnap_closeStatement(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	fe, conn := connectFrontend(t, s)
+	defer conn.Close()
+
+	// the snapshot name the statement stmt_1
+	require.NoError(t, fe.Send(&pgproto3.Parse{Name: "evicted", Query: "select 1"}))
+	require.NoError(t, fe.Send(&pgproto3.Sync{}))
+	receiveTypes(t, fe, &pgproto3.ParseComplete{}, &pgproto3.ReadyForQuery{})
+
+	require.NoError(t, fe.Send(&pgproto3.Close{ObjectType: 'S', Name: "evicted"}))
+	require.NoError(t, fe.Send(&pgproto3.Sync{}))
+	receiveTypes(t, fe, &pgproto3.CloseComplete{}, &pgproto3.ReadyForQuery{})
+
+	require.NoError(t, fe.Send(&pgproto3.Terminate{}))
+}
+
+// receiveTypes receive one message for every message in want and check its
+// type
+func receiveTypes(t *testing.T, fe *pgproto3.Frontend, want ...pgproto3.BackendMessage) {
+	t.Helper()
+
+	for _, w := range want {
+		msg, err := fe.Receive()
+		require.NoError(t, err)
+		require.IsType(t, w, msg)
+	}
+}
+
+func TestSnap_setLocal(t *testing.T) {
+	s := NewSnap(t, addr, WithServerParameters(map[string]string{"TimeZone": "Asia/Jakarta"}))
+	defer s.Finish()
+
+	fe, conn := connectFrontend(t, s)
+	defer conn.Close()
+
+	require.NoError(t, fe.Send(&pgproto3.Query{String: "begin"}))
+	receiveTypes(t, fe, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{})
+
+	// the ParameterStatus is sent where it is in the snapshot, after the
+	// CommandComplete and before the ReadyForQuery
+	require.NoError(t, fe.Send(&pgproto3.Query{String: "set local timezone = 'UTC'"}))
+	receiveTypes(t, fe, &pgproto3.CommandComplete{})
+	msg, err := fe.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.ParameterStatus{Name: "TimeZone", Value: "UTC"}, msg)
+	msg, err = fe.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'T'}, msg)
+
+	// the value is set back by the end of the transaction
+	require.NoError(t, fe.Send(&pgproto3.Query{String: "commit"}))
+	receiveTypes(t, fe, &pgproto3.CommandComplete{})
+	msg, err = fe.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.ParameterStatus{Name: "TimeZone", Value: "Asia/Jakarta"}, msg)
+	msg, err = fe.Receive()
+	require.NoError(t, err)
+	assert.Equal(t, &pgproto3.ReadyForQuery{TxStatus: 'I'}, msg)
+
+	require.NoError(t, fe.Send(&pgproto3.Terminate{}))
+}
+
+func TestSnap_setLocalPgx(t *testing.T) {
+	s := NewSnap(t, addr, WithServerParameters(map[string]string{"TimeZone": "Asia/Jakarta"}))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	tx, err := db.Begin(context.TODO())
+	require.NoError(t, err)
+	_, err = tx.Exec(context.TODO(), "set local timezone = 'UTC'")
+	require.NoError(t, err)
+	assert.Equal(t, "UTC", db.PgConn().ParameterStatus("TimeZone"))
+
+	require.NoError(t, tx.Commit(context.TODO()))
+	assert.Equal(t, "Asia/Jakarta", db.PgConn().ParameterStatus("TimeZone"))
+}
+
+func TestSnap_portalSuspended(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	fe, conn := connectFrontend(t, s)
+	defer conn.Close()
+
+	require.NoError(t, fe.Send(&pgproto3.Parse{Query: "select generate_series(1, 2)"}))
+	require.NoError(t, fe.Send(&pgproto3.Bind{}))
+
+	var rows []string
+	for suspended := true; suspended; {
+		require.NoError(t, fe.Send(&pgproto3.Execute{MaxRows: 1}))
+		if len(rows) < 2 {
+			require.NoError(t, fe.Send(&pgproto3.Flush{}))
+		} else {
+			require.NoError(t, fe.Send(&pgproto3.Sync{}))
+		}
+
+		for {
+			msg, err := fe.Receive()
+			require.NoError(t, err)
+
+			if row, ok := msg.(*pgproto3.DataRow); ok {
+				rows = append(rows, string(row.Values[0]))
+			}
+			if _, ok := msg.(*pgproto3.PortalSuspended); ok {
+				break
+			}
+			if _, ok := msg.(*pgproto3.ReadyForQuery); ok {
+				suspended = false
+				break
+			}
+		}
+	}
+
+	assert.Equal(t, []string{"1", "2"}, rows)
+	require.NoError(t, fe.Send(&pgproto3.Terminate{}))
+}
+
+func TestSnap_functionCall(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	fe, conn := connectFrontend(t, s)
+	defer conn.Close()
+
+	call := func(function uint32, args ...uint32) []byte {
+		fc := &pgproto3.FunctionCall{Function: function, ArgFormatCodes: []uint16{1}, ResultFormatCode: 1}
+		for _, arg := range args {
+			fc.Arguments = append(fc.Arguments, []byte{byte(arg >> 24), byte(arg >> 16), byte(arg >> 8), byte(arg)})
+		}
+		require.NoError(t, fe.Send(fc))
+
+		msg, err := fe.Receive()
+		require.NoError(t, err)
+		require.IsType(t, &pgproto3.FunctionCallResponse{}, msg)
+		result := append([]byte(nil), msg.(*pgproto3.FunctionCallResponse).Result...)
+
+		receiveTypes(t, fe, &pgproto3.ReadyForQuery{})
+		return result
+	}
+
+	fd := call(952, 16400, 0x40000)
+	assert.Equal(t, []byte{0, 0, 0, 0}, fd)
+	assert.Equal(t, "hello", string(call(954, 0, 5)))
+
+	require.NoError(t, fe.Send(&pgproto3.Terminate{}))
+}
+
+func Test_marshalJSONFunctionCall(t *testing.T) {
+	fc := &pgproto3.FunctionCall{
+		Function:         954,
+		ArgFormatCodes:   []uint16{0, 1},
+		Arguments:        [][]byte{[]byte("0"), {0, 0, 0, 5}},
+		ResultFormatCode: 1,
+	}
+
+	b, err := marshalJSON(fc)
+	require.NoError(t, err)
+	assert.Equal(t, `{"Type":"FunctionCall","Function":954,"ArgFormatCodes":[0,1],"Arguments":[{"text":"0"},{"binary":"00000005"}],"ResultFormatCode":1}`, string(b))
+
+	s := &Snap{t: t, cfg: defaultConfig()}
+	msg, err := s.unmarshalF(b)
+	require.NoError(t, err)
+	assert.Equal(t, fc, msg)
+}
+
+func TestSnap_negotiateProtocolVersion(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	msg := startupWithNegotiate(t, s, map[string]string{"_pq_.b": "on", "_pq_.a": "on", "application_name": "x"})
+	assert.Equal(t, &negotiateProtocolVersion{UnrecognizedOptions: []string{"_pq_.a", "_pq_.b"}}, msg)
+}
+
+func TestSnap_withNegotiateProtocolVersion(t *testing.T) {
+	s := NewSnap(t, addr, WithNegotiateProtocolVersion(0, "_pq_.compression"))
+	defer s.Finish()
+
+	msg := startupWithNegotiate(t, s, map[string]string{})
+	assert.Equal(t, &negotiateProtocolVersion{UnrecognizedOptions: []string{"_pq_.compression"}}, msg)
+}
+
+// startupWithNegotiate start a connection to s with params, return the
+// NegotiateProtocolVersion sent by s and then run the ping
+func startupWithNegotiate(t *testing.T, s *Snap, params map[string]string) *negotiateProtocolVersion {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", s.l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+
+	params["user"] = "user"
+	_, err = conn.Write((&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      params,
+	}).Encode(nil))
+	require.NoError(t, err)
+
+	// pgproto3 can't decode NegotiateProtocolVersion
+	header := make([]byte, 5)
+	_, err = io.ReadFull(conn, header)
+	require.NoError(t, err)
+	require.Equal(t, byte('v'), header[0])
+
+	body := make([]byte, binary.BigEndian.Uint32(header[1:])-4)
+	_, err = io.ReadFull(conn, body)
+	require.NoError(t, err)
+
+	msg := &negotiateProtocolVersion{}
+	require.NoError(t, msg.Decode(body))
+
+	fe := pgproto3.NewFrontend(pgproto3.NewChunkReader(conn), conn)
+	for {
+		m, err := fe.Receive()
+		require.NoError(t, err)
+		if _, ok := m.(*pgproto3.ReadyForQuery); ok {
+			break
+		}
+	}
+
+	require.NoError(t, fe.Send(&pgproto3.Query{String: ";"}))
+	receiveTypes(t, fe, &pgproto3.EmptyQueryResponse{}, &pgproto3.ReadyForQuery{})
+	require.NoError(t, fe.Send(&pgproto3.Terminate{}))
+
+	return msg
+}
+
+func Test_negotiateProtocolVersion(t *testing.T) {
+	msg := &negotiateProtocolVersion{NewestMinorProtocol: 2, UnrecognizedOptions: []string{"_pq_.a", "_pq_.b"}}
+
+	b := msg.Encode(nil)
+	assert.Equal(t, byte('v'), b[0])
+	assert.Equal(t, uint32(len(b)-1), binary.BigEndian.Uint32(b[1:]))
+
+	decoded := &negotiateProtocolVersion{}
+	require.NoError(t, decoded.Decode(b[5:]))
+	assert.Equal(t, msg, decoded)
+
+	j, err := marshalJSON(msg)
+	require.NoError(t, err)
+
+	s := &Snap{t: t, cfg: defaultConfig()}
+	unmarshaled, err := s.unmarshalB(j)
+	require.NoError(t, err)
+	assert.Equal(t, msg, unmarshaled)
+}
+
+func TestSnap_cancelRequest(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		assert.NoError(t, db.PgConn().CancelRequest(context.TODO()))
+	}()
+
+	start := time.Now()
+	_, err = db.Exec(context.TODO(), "select pg_sleep(10)")
+	require.Error(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "57014", pgErr.Code)
+}
+
+func TestSnap_withBackendKeyData(t *testing.T) {
+	s := NewSnap(t, addr, WithBackendKeyData(7, 1234))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	assert.Equal(t, uint32(7), db.PgConn().PID())
+	assert.Equal(t, uint32(1234), db.PgConn().SecretKey())
+
+	require.NoError(t, db.Ping(context.TODO()))
+
+	// BackendKeyData in the snapshot is replayed as it is
+	key := &pgproto3.BackendKeyData{ProcessID: 7, SecretKey: 1234}
+	b, err := marshalJSON(key)
+	require.NoError(t, err)
+	msg, err := s.unmarshalB(b)
+	require.NoError(t, err)
+	assert.Equal(t, key.Encode(nil), msg.Encode(nil))
+}
+
+func TestSnap_handleCancelUnknownKey(t *testing.T) {
+	s := &Snap{t: t, cfg: defaultConfig(), errchan: make(chan error, 1), closed: make(chan struct{}), cancels: make(chan struct{}, 1)}
+
+	s.handleCancel(&pgproto3.CancelRequest{ProcessID: DefaultBackendPID, SecretKey: 1})
+	assert.Len(t, s.cancels, 0)
+	require.Len(t, s.errchan, 1)
+	assert.Contains(t, (<-s.errchan).Error(), "unknown key")
+
+	s.handleCancel(&pgproto3.CancelRequest{ProcessID: DefaultBackendPID, SecretKey: DefaultBackendSecret})
+	assert.Len(t, s.cancels, 1)
+	assert.Len(t, s.errchan, 0)
+}
+
+func TestSnap_multipleStatements(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	results, err := db.PgConn().Exec(context.TODO(), "SELECT 1; SELECT 2;").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	for i, want := range []string{"1", "2"} {
+		require.Len(t, results[i].Rows, 1)
+		assert.Equal(t, want, string(results[i].Rows[0][0]))
+		assert.Equal(t, "SELECT 1", results[i].CommandTag.String())
+	}
+}
+
+func TestSnap_binaryFormat(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	var n int64
+	var f float64
+	err = db.QueryRow(context.TODO(), "select $1::int8, 1.5::numeric", int64(-123)).Scan(&n, &f)
+	require.NoError(t, err)
+	assert.Equal(t, int64(-123), n)
+	assert.Equal(t, 1.5, f)
+}
+
+func TestSnap_bindParams(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	var n int64
+	var str string
+	err = db.QueryRow(context.TODO(), "select $1::int8, $2::text", int64(42), "foo").Scan(&n, &str)
+	require.NoError(t, err)
+	assert.Equal(t, int64(42), n)
+	assert.Equal(t, "foo", str)
+}
+
+func TestSnap_sendBatch(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	b := &pgx.Batch{}
+	for i := 1; i <= 3; i++ {
+		b.Queue("select $1::int8", int64(i))
+	}
+
+	br := db.SendBatch(context.TODO(), b)
+	for i := 1; i <= 3; i++ {
+		var n int64
+		require.NoError(t, br.QueryRow().Scan(&n))
+		assert.Equal(t, int64(i), n)
+	}
+	require.NoError(t, br.Close())
+}
+
+func TestSnap_sendBatchMismatch(t *testing.T) {
+	s := NewSnap(t, addr)
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	// the first Bind doesn't match, and the rest of the batch is skipped
+	b := &pgx.Batch{}
+	for _, n := range []int64{9, 2, 3} {
+		b.Queue("select $1::int8", n)
+	}
+
+	br := db.SendBatch(context.TODO(), b)
+	var n int64
+	err = br.QueryRow().Scan(&n)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TestSnap_sendBatchMismatch.txt:9: Bind doesn't match the snapshot")
+	assert.Contains(t, err.Error(), `{"int8":9}`)
+	br.Close()
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TestSnap_sendBatchMismatch.txt:9: Bind doesn't match the snapshot")
+}
+
+const describeSnapshot = `F {"Type":"Parse","Name":"stmt_1","Query":"select 1","ParameterOIDs":null}
+F {"Type":"Describe","ObjectType":"S","Name":"stmt_1"}
+F {"Type":"Sync"}
+B {"Type":"ParseComplete"}
+B {"Type":"ParameterDescription","ParameterOIDs":[]}
+B {"Type":"RowDescription","Fields":[{"Name":"?column?","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`
+
+func TestSnap_describeStatement(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(describeSnapshot))
+	defer s.Finish()
+
+	// the name of the statement is the one used by the client
+	types := rawSend(t, s.Addr(),
+		&pgproto3.Parse{Name: "stmtcache_7", Query: "select 1"},
+		&pgproto3.Describe{ObjectType: 'S', Name: "stmtcache_7"},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{"ParseComplete", "ParameterDescription", "RowDescription", "ReadyForQuery"}, types)
+}
+
+func TestSnap_describeMismatch(t *testing.T) {
+	tests := map[string]struct {
+		describe *pgproto3.Describe
+		diff     string
+	}{
+		"portal": {
+			describe: &pgproto3.Describe{ObjectType: 'P', Name: "stmtcache_7"},
+			diff:     "  ObjectType:\n-   \"S\"\n+   \"P\"",
+		},
+		"other name": {
+			describe: &pgproto3.Describe{ObjectType: 'S', Name: "stmtcache_8"},
+			diff:     "  Name:\n-   \"stmtcache_7\"\n+   \"stmtcache_8\"",
+		},
+	}
+
+	for name, tt := range tests {
+		tt := tt
+		t.Run(name, func(t *testing.T) {
+			s := NewSnapFromReader(t, strings.NewReader(describeSnapshot))
+
+			rawSend(t, s.Addr(),
+				&pgproto3.Parse{Name: "stmtcache_7", Query: "select 1"},
+				tt.describe,
+				&pgproto3.Sync{},
+			)
+
+			err := s.Wait()
+			var me *MismatchError
+			require.True(t, errors.As(err, &me), err)
+			assert.Equal(t, 2, me.Line)
+			assert.Equal(t, tt.describe, me.Got)
+			assert.Equal(t, "pgsnap: snapshot:2: Describe doesn't match the snapshot\n--- want (snapshot)\n+++ got (client)\n"+tt.diff, me.format(false))
+		})
+	}
+}
+
+func Test_recordingPipeline(t *testing.T) {
+	r := &recording{}
+	r.write("F", &pgproto3.Parse{Query: "select 1"})
+	r.write("B", &pgproto3.ParseComplete{})
+	r.write("F", &pgproto3.Bind{})
+	r.write("F", &pgproto3.Execute{})
+	r.write("B", &pgproto3.BindComplete{})
+	r.write("F", &pgproto3.Sync{})
+	r.write("B", &pgproto3.CommandComplete{CommandTag: []byte("SELECT 1")})
+	r.write("B", &pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	// the responses are written after the batch
+	assert.Equal(t, `F {"Type":"Parse","Name":"","Query":"select 1","ParameterOIDs":null}
+F {"Type":"Bind","DestinationPortal":"","PreparedStatement":"","ParameterFormatCodes":null,"Parameters":[],"ResultFormatCodes":null}
+F {"Type":"Execute","Portal":"","MaxRows":0}
+F {"Type":"Sync"}
+B {"Type":"ParseComplete"}
+B {"Type":"BindComplete"}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`, string(r.bytes()))
+}
+
+func Test_recordingParameterStatus(t *testing.T) {
+	r := &recording{}
+	r.write("F", &pgproto3.Parse{Query: "set local timezone = 'UTC'"})
+	r.write("F", &pgproto3.Bind{})
+	r.write("F", &pgproto3.Execute{})
+	r.write("B", &pgproto3.ParseComplete{})
+	r.write("B", &pgproto3.BindComplete{})
+	r.write("B", &pgproto3.CommandComplete{CommandTag: []byte("SET")})
+	r.write("B", &pgproto3.ParameterStatus{Name: "TimeZone", Value: "UTC"})
+	r.write("F", &pgproto3.Sync{})
+	r.write("B", &pgproto3.ReadyForQuery{TxStatus: 'T'})
+
+	// the ParameterStatus is kept between the result and ReadyForQuery
+	assert.Equal(t, `F {"Type":"Parse","Name":"","Query":"set local timezone = 'UTC'","ParameterOIDs":null}
+F {"Type":"Bind","DestinationPortal":"","PreparedStatement":"","ParameterFormatCodes":null,"Parameters":[],"ResultFormatCodes":null}
+F {"Type":"Execute","Portal":"","MaxRows":0}
+F {"Type":"Sync"}
+B {"Type":"ParseComplete"}
+B {"Type":"BindComplete"}
+B {"Type":"CommandComplete","CommandTag":"SET"}
+B {"Type":"ParameterStatus","Name":"TimeZone","Value":"UTC"}
+B {"Type":"ReadyForQuery","TxStatus":"T"}
+`, string(r.bytes()))
+}
+
+func Test_recordingParallel(t *testing.T) {
+	r := &recording{}
+	queries, answers := make(chan struct{}), make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 3; i++ {
+			r.write("F", &pgproto3.Query{String: fmt.Sprintf("select %d", i)})
+			queries <- struct{}{}
+			<-answers
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		// the message is reused like the one of Receive
+		row := &pgproto3.DataRow{}
+		for i := 0; i < 3; i++ {
+			<-queries
+			row.Values = [][]byte{[]byte(fmt.Sprint(i))}
+			r.write("B", row)
+			r.write("B", &pgproto3.ReadyForQuery{TxStatus: 'I'})
+			answers <- struct{}{}
+		}
+	}()
+	wg.Wait()
+
+	// every answer is written after its query, the rows as they were sent
+	var want strings.Builder
+	for i := 0; i < 3; i++ {
+		fmt.Fprintf(&want, "F {\"Type\":\"Query\",\"String\":\"select %d\"}\n", i)
+		fmt.Fprintf(&want, "B {\"Type\":\"DataRow\",\"Values\":[{\"text\":\"%d\"}]}\n", i)
+		want.WriteString("B {\"Type\":\"ReadyForQuery\",\"TxStatus\":\"I\"}\n")
+	}
+	assert.Equal(t, want.String(), string(r.bytes()))
+}
+
+func Test_marshalJSONDataRow(t *testing.T) {
+	row := &pgproto3.DataRow{Values: [][]byte{
+		{0xff, 0xff, 0xff, 0x85},
+		[]byte("héllo"),
+		nil,
+		{0, 1},
+	}}
+
+	b, err := marshalJSON(row)
+	require.NoError(t, err)
+	assert.Equal(t, `{"Type":"DataRow","Values":[{"binary":"ffffff85"},{"text":"héllo"},null,{"binary":"0001"}]}`, string(b))
+
+	s := &Snap{t: t, cfg: defaultConfig()}
+	msg, err := s.unmarshalB(b)
+	require.NoError(t, err)
+	assert.Equal(t, row, msg)
+}
+
+func TestSnap_emptyQuery(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	_, err = db.PgConn().Exec(context.TODO(), "begin").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, byte('T'), db.PgConn().TxStatus())
+
+	_, err = db.PgConn().Exec(context.TODO(), "").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, byte('T'), db.PgConn().TxStatus())
+
+	_, err = db.PgConn().Exec(context.TODO(), "commit").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, byte('I'), db.PgConn().TxStatus())
+}
+
+func TestSnap_errorTxStatus(t *testing.T) {
+	s := NewSnap(t, addr)
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	_, err = db.PgConn().Exec(context.TODO(), "begin").ReadAll()
+	require.NoError(t, err)
+
+	_, err = db.PgConn().Exec(context.TODO(), "select 2").ReadAll()
+	require.Error(t, err)
+	assert.Equal(t, byte('E'), db.PgConn().TxStatus())
+
+	require.Error(t, s.Wait())
+}
+
+func TestSnap_errorResponse(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	_, err = db.PgConn().Exec(context.TODO(), "begin").ReadAll()
+	require.NoError(t, err)
+
+	_, err = db.PgConn().Exec(context.TODO(), "insert into users (email) values ('joe@example.com')").ReadAll()
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "23505", pgErr.Code)
+	assert.Equal(t, "users_email_key", pgErr.ConstraintName)
+	assert.Equal(t, "Key (email)=(joe@example.com) already exists.", pgErr.Detail)
+	assert.Equal(t, byte('E'), db.PgConn().TxStatus())
+
+	_, err = db.PgConn().Exec(context.TODO(), "rollback").ReadAll()
+	require.NoError(t, err)
+
+	_, err = db.PgConn().Exec(context.TODO(), "update accounts set balance = balance - 1").ReadAll()
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "40001", pgErr.Code)
+	assert.Equal(t, byte('I'), db.PgConn().TxStatus())
+}
+
+func TestSnap_txStatus(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	exec := func(sql string) error {
+		_, err := db.PgConn().Exec(context.TODO(), sql).ReadAll()
+		return err
+	}
+
+	require.NoError(t, exec("begin"))
+	assert.Equal(t, byte('T'), db.PgConn().TxStatus())
+
+	require.NoError(t, exec("savepoint s1"))
+	assert.Equal(t, byte('T'), db.PgConn().TxStatus())
+
+	require.Error(t, exec("insert into users (email) values ('joe@example.com')"))
+	assert.Equal(t, byte('E'), db.PgConn().TxStatus())
+
+	// the transaction recovers from the error
+	require.NoError(t, exec("rollback to savepoint s1"))
+	assert.Equal(t, byte('T'), db.PgConn().TxStatus())
+
+	require.NoError(t, exec("commit"))
+	assert.Equal(t, byte('I'), db.PgConn().TxStatus())
+}
+
+func TestSnap_withIgnoreHealthChecks(t *testing.T) {
+	s := NewSnap(t, addr, WithIgnoreHealthChecks(), WithIgnoreHealthChecks("~set application_name = .*"))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	require.NoError(t, db.Ping(context.TODO()))
+
+	// answered by EmptyQueryResponse, which has no result
+	results, err := db.PgConn().Exec(context.TODO(), ";").ReadAll()
+	require.NoError(t, err)
+	assert.Empty(t, results)
+
+	results, err = db.PgConn().Exec(context.TODO(), "SELECT 1").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, [][][]byte{{[]byte("1")}}, results[0].Rows)
+
+	results, err = db.PgConn().Exec(context.TODO(), "set application_name = 'pool'").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "SET", results[0].CommandTag.String())
+
+	results, err = db.PgConn().Exec(context.TODO(), "select 2").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, [][][]byte{{[]byte("2")}}, results[0].Rows)
+}
+
+func TestSnap_withIgnoreResetQueries(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot), WithIgnoreResetQueries())
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	tags := map[string]string{
+		"DISCARD ALL":     "DISCARD ALL",
+		"reset all;":      "RESET",
+		"UNLISTEN *":      "UNLISTEN",
+		"deallocate  all": "DEALLOCATE ALL",
+	}
+	for sql, tag := range tags {
+		results, err := db.PgConn().Exec(context.TODO(), sql).ReadAll()
+		require.NoError(t, err)
+		require.Len(t, results, 1)
+		assert.Equal(t, tag, results[0].CommandTag.String(), sql)
+	}
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+}
+
+func TestSnap_withIgnoreHealthChecksRecorded(t *testing.T) {
+	s := NewSnap(t, addr, WithIgnoreHealthChecks())
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "one", string(results[0].FieldDescriptions[0].Name))
+}
+
+func Test_commandTag(t *testing.T) {
+	tests := map[string]string{
+		"select 2":              "SELECT 0",
+		"set search_path = foo": "SET",
+		"discard plans":         "DISCARD PLANS",
+		"DEALLOCATE ALL":        "DEALLOCATE ALL",
+		"deallocate stmt_1":     "DEALLOCATE",
+		"-- reset\nRESET ALL":   "RESET",
+	}
+	for sql, want := range tests {
+		assert.Equal(t, want, commandTag(sql), sql)
+	}
+}
+
+func Test_firstKeyword(t *testing.T) {
+	tests := map[string]string{
+		";":                    "",
+		"-- ping":              "",
+		" ; ;\n-- a\n":         "",
+		"SELECT 1":             "SELECT",
+		"-- ping\nselect 1":    "select",
+		"discard all; -- done": "discard",
+	}
+
+	for sql, want := range tests {
+		assert.Equal(t, want, firstKeyword(sql), sql)
+	}
+}
+
+func TestSnap_withAnyProtocol(t *testing.T) {
+	s := NewSnap(t, addr, WithAnyProtocol())
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	var n int
+	var name string
+	err = db.QueryRow(context.TODO(), "select 1 as n, 'foo' as name").Scan(&n, &name)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Equal(t, "foo", name)
+}
+
+func TestSnap_withAnyProtocolQuery(t *testing.T) {
+	s := NewSnap(t, addr, WithAnyProtocol())
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+	assert.Equal(t, int16(0), results[0].FieldDescriptions[0].Format)
+}
+
+func TestSnap_withAnyProtocolMaxRows(t *testing.T) {
+	s := NewSnap(t, addr, WithAnyProtocol())
+	defer s.Finish()
+
+	// the rows of Query are sent 2 at a time
+	types := rawSend(t, s.Addr(),
+		&pgproto3.Parse{Query: "select * from generate_series(1, 3)"},
+		&pgproto3.Bind{},
+		&pgproto3.Execute{MaxRows: 2},
+		&pgproto3.Execute{MaxRows: 2},
+		&pgproto3.Sync{},
+	)
+	assert.Equal(t, []string{
+		"ParseComplete", "BindComplete",
+		"DataRow", "DataRow", "PortalSuspended",
+		"DataRow", "CommandComplete",
+		"ReadyForQuery",
+	}, types)
+}
+
+func TestSnap_withAnyProtocolMismatch(t *testing.T) {
+	s := NewSnap(t, addr, WithAnyProtocol())
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	// only the SQL is compared with the Parse in the snapshot
+	_, err = db.PgConn().Exec(context.TODO(), "select 2").ReadAll()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TestSnap_withAnyProtocolMismatch.txt:2: want Parse, got Query")
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `{"Type":"Query","String":"select 2"}`)
+}
+
+func Test_binaryText(t *testing.T) {
+	tests := []struct {
+		oid  uint32
+		b    []byte
+		want string
+	}{
+		{16, []byte{1}, "t"},
+		{21, []byte{0xff, 0xfe}, "-2"},
+		{23, []byte{0, 0, 0, 42}, "42"},
+		{oidFloat8, []byte{0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, "1.5"},
+		{17, []byte{0xde, 0xad}, `\xdead`},
+		{2950, []byte{0x12, 0x34, 0x56, 0x78, 0x12, 0x34, 0x56, 0x78, 0x12, 0x34, 0x56, 0x78, 0x12, 0x34, 0x56, 0x78}, "12345678-1234-5678-1234-567812345678"},
+	}
+	for _, tt := range tests {
+		got, err := binaryText(tt.oid, tt.b)
+		require.NoError(t, err)
+		assert.Equal(t, tt.want, string(got))
+	}
+
+	_, err := binaryText(1700, []byte{0, 1})
+	require.Error(t, err)
+	assert.Equal(t, "binary value of type 1700 can't be sent as text", err.Error())
+}
+
+const selectOneSnapshot = `F {"Type":"Query","String":"select 1"}
+B {"Type":"RowDescription","Fields":[{"Name":"?column?","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+B {"Type":"DataRow","Values":[{"text":"1"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`
+
+func execSelectOne(t testing.TB, s *Snap) {
+	t.Helper()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+}
+
+func TestNewSnapFromReader(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot))
+	defer s.Finish()
+
+	execSelectOne(t, s)
+
+	// nothing is read from or written to the file of the test
+	_, err := os.Stat(t.Name() + ".txt")
+	assert.True(t, os.IsNotExist(err))
+}
+
+//go:embed TestSnap_yaml.yaml
+var yamlSnapshot []byte
+
+func TestNewSnapFromReader_embed(t *testing.T) {
+	s := NewSnapFromReader(t, bytes.NewReader(yamlSnapshot), WithFormat(FormatYAML))
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Ping())
+
+	rows, err := db.Query("select name\n  from products\n order by id")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	n := 0
+	for rows.Next() {
+		n++
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, 3, n)
+}
+
+func TestNewSnapFromReader_mismatch(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot))
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	_, err = db.PgConn().Exec(context.TODO(), "select 2").ReadAll()
+	require.Error(t, err)
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pgsnap: snapshot:1: Query doesn't match the snapshot")
+}
+
+func TestSnap_script(t *testing.T) {
+	src := selectOneSnapshot + "C\n" + selectOneSnapshot + "=== case:a ===\n" + selectOneSnapshot
+	s := NewSnapFromReader(t, strings.NewReader(src))
+	defer s.Finish()
+
+	script := s.Script()
+	require.Len(t, script.Conns, 2)
+	require.Len(t, script.Sections["a"], 1)
+	assert.Equal(t, []string{"select 1"}, script.Conns[1].Queries())
+	assert.Equal(t, []string{"select 1"}, script.Sections["a"][0].Queries())
+
+	conn := script.Conns[0]
+	require.Len(t, conn, 5)
+	assert.Equal(t, byte('F'), conn[0].Dir)
+	assert.Equal(t, &pgproto3.Query{String: "select 1"}, conn[0].Msg)
+	assert.Equal(t, byte('B'), conn[2].Dir)
+	assert.Equal(t, &pgproto3.DataRow{Values: [][]byte{[]byte("1")}}, conn[2].Msg)
+
+	// the messages are copies, the replay doesn't change
+	conn[0].Msg.(*pgproto3.Query).String = "select 2"
+	conn[2].Msg.(*pgproto3.DataRow).Values[0][0] = '2'
+	assert.Equal(t, []string{"select 1"}, s.Script().Conns[0].Queries())
+
+	execSelectOne(t, s)
+	execSelectOne(t, s)
+}
+
+// selectN run select n on s, and check its row
+func selectN(t *testing.T, s *Snap, n int) {
+	t.Helper()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	results, err := db.PgConn().Exec(context.TODO(), fmt.Sprintf("select %d", n)).ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprint(n), string(results[0].Rows[0][0]))
+}
+
+func TestSnap_load(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot))
+	execSelectOne(t, s)
+	require.NoError(t, s.Wait())
+
+	dsn := s.DSN()
+	for _, n := range []int{2, 3} {
+		require.NoError(t, s.Load(fmt.Sprintf("TestSnap_load/select_%d.txt", n)))
+		assert.Equal(t, dsn, s.DSN())
+
+		selectN(t, s, n)
+		require.NoError(t, s.Wait())
+		assert.Equal(t, 1, s.QueryCount())
+	}
+}
+
+func TestSnap_loadAfterMismatch(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot))
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+	_, err = db.PgConn().Exec(context.TODO(), "select 2").ReadAll()
+	require.Error(t, err)
+
+	// the mismatch isn't returned by Wait of the next snapshot
+	require.NoError(t, s.Load("TestSnap_load/select_2.txt"))
+	selectN(t, s, 2)
+	assert.NoError(t, s.Wait())
+}
+
+func TestSnap_loadBusy(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	err = s.Load("TestSnap_load/select_2.txt")
+	assert.EqualError(t, err, "pgsnap: can't load TestSnap_load/select_2.txt, snapshot is still replayed")
+
+	err = s.Load("TestSnap_load/missing.txt")
+	assert.Error(t, err)
+
+	_, err = db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+}
+
+func TestSnap_withAcceptTimeout(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot), WithAcceptTimeout(50*time.Millisecond))
+
+	// the client never connects
+	start := time.Now()
+	err := s.Wait()
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	require.True(t, errors.Is(err, ErrNoClient), err)
+	assert.EqualError(t, err, "pgsnap: no client connected in 50ms")
+}
+
+func TestSnap_withAcceptTimeoutConnected(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot), WithAcceptTimeout(50*time.Millisecond))
+
+	execSelectOne(t, s)
+	time.Sleep(100 * time.Millisecond)
+
+	assert.NoError(t, s.Wait())
+}
+
+func TestSnap_withSharedListener(t *testing.T) {
+	var addrs []string
+	for _, name := range []string{"first", "second"} {
+		t.Run(name, func(t *testing.T) {
+			s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot), WithSharedListener())
+			defer s.Finish()
+
+			execSelectOne(t, s)
+			addrs = append(addrs, s.Addr())
+		})
+	}
+	require.Len(t, addrs, 2)
+	assert.Equal(t, addrs[0], addrs[1])
+
+	// the next snap can use the listener after Close
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot), WithSharedListener())
+	execSelectOne(t, s)
+	s.Finish()
+	require.NoError(t, s.Close())
+
+	s = NewSnapFromReader(t, strings.NewReader(selectOneSnapshot), WithSharedListener())
+	defer s.Finish()
+	assert.Equal(t, addrs[0], s.Addr())
+	execSelectOne(t, s)
+}
+
+// BenchmarkSnap_listener replay a snapshot with a new listener for every
+// snap, and with the shared listener
+func BenchmarkSnap_listener(b *testing.B) {
+	for name, opts := range map[string][]Option{
+		"per snap": nil,
+		"shared":   {WithSharedListener()},
+	} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				s := NewSnapFromReader(b, strings.NewReader(selectOneSnapshot), opts...)
+				execSelectOne(b, s)
+				s.Finish()
+				s.Close()
+			}
+		})
+	}
+}
+
+func TestSnap_withSnapshotDir(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "TestSnap_withSnapshotDir.txt"), []byte(selectOneSnapshot), 0644))
+
+	s := NewSnap(t, addr, WithSnapshotDir(dir))
+	defer s.Finish()
+
+	execSelectOne(t, s)
+}
+
+func TestSnap_snapshotDirEnv(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "TestSnap_snapshotDirEnv"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "TestSnap_snapshotDirEnv", "select_one.txt"), []byte(selectOneSnapshot), 0644))
+
+	os.Setenv("PGSNAP_DIR", dir)
+	defer os.Unsetenv("PGSNAP_DIR")
+
+	t.Run("select one", func(t *testing.T) {
+		s := NewSnap(t, addr)
+		defer s.Finish()
+
+		execSelectOne(t, s)
+	})
+}
+
+func TestSnap_sameSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "TestSnap_sameSnapshot"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "TestSnap_sameSnapshot", "User.txt"), []byte(selectOneSnapshot), 0644))
+
+	t.Run("User", func(t *testing.T) {
+		s := NewSnap(t, addr, WithSnapshotDir(dir))
+		defer s.Finish()
+
+		execSelectOne(t, s)
+	})
+
+	// the same file on macOS and Windows
+	t.Run("user", func(t *testing.T) {
+		_, err := New(t, addr, WithSnapshotDir(dir))
+		require.Error(t, err)
+		assert.Equal(t, "pgsnap: TestSnap_sameSnapshot/User and TestSnap_sameSnapshot/user use the same snapshot "+filepath.Join(dir, "TestSnap_sameSnapshot/user.txt"), err.Error())
+	})
+}
+
+func Test_snapshotName(t *testing.T) {
+	assert.Equal(t, "TestDB", snapshotName("TestDB"))
+	assert.Equal(t, "TestDB/get_user", snapshotName("TestDB/get_user"))
+	assert.Equal(t, "TestDB/a:b_c?", snapshotName("TestDB/a:b c?"))
+	assert.Equal(t, "TestDB/_/_", snapshotName("TestDB/../."))
+}
+
+func TestSnap_closeConn(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+
+	var rows [][][]byte
+	result := db.PgConn().Exec(context.TODO(), "select generate_series(1, 3)")
+	for result.NextResult() {
+		rr := result.ResultReader()
+		for rr.NextRow() {
+			rows = append(rows, rr.Values())
+		}
+		_, err = rr.Close()
+	}
+	require.Error(t, err)
+	assert.True(t, db.PgConn().IsClosed())
+	assert.Len(t, rows, 2)
+
+	db, err = pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+
+	_, err = db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "connection reset by peer")
+}
+
+func Test_readScriptClose(t *testing.T) {
+	s := &Snap{t: t, cfg: defaultConfig()}
+	_, err := s.readScript(strings.NewReader(`F {"Type":"Query","String":"select 1"}
+B {"Type":"Close"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`))
+	require.Error(t, err)
+	assert.Equal(t, `Test_readScriptClose.txt:3: the connection is already closed by Close: B {"Type":"ReadyForQuery","TxStatus":"I"}`, err.Error())
+}
+
+func TestSnap_withDelay(t *testing.T) {
+	// the delay isn't counted in the timeout
+	s := NewSnap(t, addr, WithTimeout(200*time.Millisecond))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	start := time.Now()
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(300*time.Millisecond))
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+}
+
+func TestSnap_withDelayDeadline(t *testing.T) {
+	s := NewSnap(t, addr)
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = db.PgConn().Exec(ctx, "select 1").ReadAll()
+	require.Error(t, err)
+	assert.True(t, pgconn.Timeout(err))
+
+	// the rest of the script may fail to be sent to the closed connection
+	_ = s.Wait()
+}
+
+func TestSnap_openDB_pq(t *testing.T) {
+	db := NewSnap(t, addr).OpenDB("postgres")
+
+	var n int
+	require.NoError(t, db.QueryRow("select 1").Scan(&n))
+	assert.Equal(t, 1, n)
+	assert.Equal(t, 1, db.Stats().MaxOpenConnections)
+}
+
+func TestSnap_openDB_pgx(t *testing.T) {
+	db := NewSnap(t, addr).OpenDB("pgx")
+
+	var n int
+	require.NoError(t, db.QueryRow("select 1").Scan(&n))
+	assert.Equal(t, 1, n)
+}
+
+func TestSnap_connect(t *testing.T) {
+	s := NewSnap(t, addr, WithAuth(AuthSCRAM, "secret"))
+	db := s.Connect(context.TODO())
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+}
+
+func TestSnap_connectError(t *testing.T) {
+	tb := &fatalTB{TB: t}
+	s := NewSnap(tb, addr)
+	require.NoError(t, s.Close())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Connect(context.TODO())
+	}()
+	<-done
+
+	assert.Contains(t, tb.fatal, "pgsnap: can't connect to "+s.Addr())
+	assert.ErrorIs(t, s.Wait(), ErrClosed)
+}
+
+func TestSnap_withStartupDelay(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	s := NewSnap(t, addr, WithStartupDelay(time.Minute))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := pgx.Connect(ctx, s.DSN())
+	require.Error(t, err)
+	assert.True(t, pgconn.Timeout(err))
+
+	require.NoError(t, s.Close())
+	assert.ErrorIs(t, s.Wait(), ErrClosed)
+}
+
+func Test_parseDelay(t *testing.T) {
+	d, err := parseDelay([]byte(`{"Type":"DataRow","Values":[],"delayMs":250}`))
+	require.NoError(t, err)
+	assert.Equal(t, 250*time.Millisecond, d)
+
+	d, err = parseDelay([]byte(`{"Type":"DataRow","Values":[]}`))
+	require.NoError(t, err)
+	assert.Equal(t, time.Duration(0), d)
+
+	_, err = parseDelay([]byte(`{"Type":"DataRow","Values":[],"delayMs":-1}`))
+	assert.Error(t, err)
+}
+
+func TestSnap_textDelay(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(`>>> select 1
+B {"Type":"RowDescription","Fields":[{"Name":"?column?","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+| 1 | delayMs=100
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`))
+	defer s.Finish()
+
+	start := time.Now()
+	execSelectOne(t, s)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(100*time.Millisecond))
+}
+
+func TestSnap_terminate(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+
+	var one int
+	require.NoError(t, db.QueryRow("select 1").Scan(&one))
+	assert.Equal(t, 1, one)
+
+	// closing the pool send Terminate
+	require.NoError(t, db.Close())
+}
+
+func TestSnap_terminateWithoutMessage(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	fe, conn := connectFrontend(t, s)
+
+	require.NoError(t, fe.Send(&pgproto3.Query{String: "select 1"}))
+	receiveTypes(t, fe, &pgproto3.RowDescription{}, &pgproto3.DataRow{}, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{})
+
+	require.NoError(t, conn.Close())
+}
+
+func TestSnap_Addr(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	host, port, err := net.SplitHostPort(s.Addr())
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", host)
+	assert.NotEmpty(t, port)
+
+	assert.Equal(t, "postgres://user@"+s.Addr()+"/?sslmode=disable&statement_cache_mode=describe", s.DSN())
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	require.NoError(t, db.Ping(context.TODO()))
+}
+
+func TestSnap_withForceWrite(t *testing.T) {
+	upstream := NewSnap(t, addr)
+	defer upstream.Finish()
+
+	t.Run("record", func(t *testing.T) {
+		t.Cleanup(func() { os.RemoveAll("TestSnap_withForceWrite") })
+
+		var tb testing.TB = t
+		s := NewSnap(tb, upstream.DSN(), WithForceWrite(true))
+
+		db, err := sql.Open("postgres", s.DSN())
+		require.NoError(t, err)
+
+		var one int
+		require.NoError(t, db.Ping())
+		require.NoError(t, db.QueryRow("select 1").Scan(&one))
+		db.Close()
+
+		require.NoError(t, s.Wait())
+
+		recorded, err := os.ReadFile("TestSnap_withForceWrite/record.txt")
+		require.NoError(t, err)
+
+		expected, err := os.ReadFile("TestSnap_withForceWrite.txt")
+		require.NoError(t, err)
+
+		assert.Equal(t, string(expected), withoutStartup(t, recorded))
+	})
+}
+
+func TestSnap_withUnixSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	s := NewSnap(t, addr, WithUnixSocket(dir))
+
+	assert.Equal(t, dir+"/.s.PGSQL.5432", s.Addr())
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	_, ok := db.PgConn().Conn().(*net.UnixConn)
+	assert.True(t, ok, "connection should use unix socket")
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+
+	s.Finish()
+	require.NoError(t, s.Close())
+
+	_, err = os.Stat(s.Addr())
+	assert.True(t, os.IsNotExist(err), "socket file should be removed")
+}
+
+func TestSnap_withUnixSocket_pq(t *testing.T) {
+	s := NewSnap(t, addr, WithUnixSocket(""))
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var one int
+	require.NoError(t, db.QueryRow("select 1").Scan(&one))
+	assert.Equal(t, 1, one)
+}
+
+func TestSnap_withListenAddr(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	listenAddr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	s := NewSnap(t, addr, WithListenAddr(listenAddr))
+	defer s.Finish()
+
+	assert.Equal(t, listenAddr, s.Addr())
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var one int
+	require.NoError(t, db.QueryRow("select 1").Scan(&one))
+}
+
+// fatalTB record the message of Fatal instead of failing the test
+type fatalTB struct {
+	testing.TB
+	fatal string
+}
+
+func (f *fatalTB) Fatal(args ...interface{}) {
+	f.fatal = fmt.Sprint(args...)
+	runtime.Goexit()
+}
+
+func (f *fatalTB) Fatalf(format string, args ...interface{}) {
+	f.fatal = fmt.Sprintf(format, args...)
+	runtime.Goexit()
+}
+
+func TestSnap_withListenAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	defer l.Close()
+
+	tb := &fatalTB{TB: t}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		NewSnap(tb, addr, WithListenAddr(l.Addr().String()))
+	}()
+	<-done
+
+	assert.Contains(t, tb.fatal, "pgsnap: can't listen on "+l.Addr().String())
+}
+
+func TestSnap_noLeak(t *testing.T) {
+	defer goleak.VerifyNone(t, goleak.IgnoreCurrent())
+
+	t.Cleanup(func() { os.RemoveAll("TestSnap_noLeak") })
+	require.NoError(t, os.MkdirAll("TestSnap_noLeak", 0755))
+
+	script, err := os.ReadFile("TestSnap_withListenAddr.txt")
+	require.NoError(t, err)
+
+	for _, name := range []string{"replay", "not_connected"} {
+		require.NoError(t, os.WriteFile("TestSnap_noLeak/"+name+".txt", script, 0644))
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		s := NewSnap(t, addr)
+
+		db, err := pgx.Connect(context.TODO(), s.DSN())
+		require.NoError(t, err)
+		defer db.Close(context.TODO())
+
+		_, err = db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+		require.NoError(t, err)
+	})
+
+	t.Run("not_connected", func(t *testing.T) {
+		s := NewSnap(t, addr)
+		require.NoError(t, s.Close())
+		assert.ErrorIs(t, s.Wait(), ErrClosed)
+	})
+}
+
+func TestSnap_parallel(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll("TestSnap_parallel") })
+	require.NoError(t, os.MkdirAll("TestSnap_parallel", 0755))
+
+	script, err := os.ReadFile("TestSnap_withListenAddr.txt")
+	require.NoError(t, err)
+
+	for i := 0; i < 32; i++ {
+		name := fmt.Sprintf("snap_%02d", i)
+		require.NoError(t, os.WriteFile("TestSnap_parallel/"+name+".txt", script, 0644))
+
+		usePQ := i%2 == 0
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			s := NewSnap(t, addr)
+			defer s.Finish()
+
+			if usePQ {
+				db, err := sql.Open("postgres", s.DSN())
+				require.NoError(t, err)
+				defer db.Close()
+
+				var one int
+				require.NoError(t, db.QueryRow("select 1").Scan(&one))
+				return
+			}
+
+			db, err := pgx.Connect(context.TODO(), s.DSN())
+			require.NoError(t, err)
+			defer db.Close(context.TODO())
+
+			_, err = db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestNew_unreadableFile(t *testing.T) {
+	require.NoError(t, os.Mkdir("TestNew_unreadableFile.txt", 0755))
+	t.Cleanup(func() { os.Remove("TestNew_unreadableFile.txt") })
+
+	_, err := New(t, addr)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pgsnap: can't read TestNew_unreadableFile.txt: ")
+}
+
+func TestNew_missingFile(t *testing.T) {
+	_, err := New(t, "postgres://user@127.0.0.1:1/?sslmode=disable")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pgsnap: TestNew_missingFile.txt doesn't exist, can't record it: can't connect to db")
+
+	_, statErr := os.Stat("TestNew_missingFile.txt")
+	assert.True(t, os.IsNotExist(statErr))
+}
+
+func TestNew_listenAddrInUse(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:")
+	require.NoError(t, err)
+	defer l.Close()
+
+	_, err = New(t, addr, WithListenAddr(l.Addr().String()))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pgsnap: can't listen on "+l.Addr().String())
+}
+
+// messageLog keep the messages given to Logger, as lines of snapshot
+type messageLog struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *messageLog) log(dir byte, msg pgproto3.Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, fmt.Sprintf("%c %s", dir, marshalMessage(msg)))
+}
+
+func (l *messageLog) types() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var types []string
+	for _, line := range l.lines {
+		i := strings.Index(line, `"Type":"`) + len(`"Type":"`)
+		types = append(types, line[:2]+line[i:i+strings.Index(line[i:], `"`)])
+	}
+	return types
+}
+
+func TestSnap_withLogger(t *testing.T) {
+	var log messageLog
+
+	s := NewSnap(t, addr, WithLogger(log.log))
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+
+	_, err = db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	db.Close(context.TODO())
+
+	s.Finish()
+
+	script, err := os.ReadFile("TestSnap_withLogger.txt")
+	require.NoError(t, err)
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+
+	require.NotEmpty(t, log.lines)
+	assert.True(t, strings.HasPrefix(log.lines[0], `F {"Type":"StartupMessage"`), log.lines[0])
+	assert.Contains(t, strings.Join(log.lines, "\n")+"\n", string(script))
+}
+
+func TestSnap_withLoggerSCRAM(t *testing.T) {
+	var log messageLog
+
+	s := NewSnap(t, addr, WithAuth(AuthSCRAM, "secret"), WithLogger(log.log))
+	defer s.Finish()
+
+	db, err := connectWithPassword(s.DSN(), "secret")
+	require.NoError(t, err)
+	require.NoError(t, db.Ping(context.TODO()))
+
+	assert.Equal(t, []string{
+		"F StartupMessage",
+		"B AuthenticationSASL",
+		"F SASLInitialResponse",
+		"B AuthenticationSASLContinue",
+		"F SASLResponse",
+		"B AuthenticationSASLFinal",
+		"B AuthenticationOK",
+	}, log.types()[:7])
+}
+
+func TestSnap_withStepHook(t *testing.T) {
+	id := fmt.Sprintf("req-%d", time.Now().UnixNano())
+
+	var steps []int
+	hook := func(step int, msg pgproto3.Message) error {
+		steps = append(steps, step)
+
+		switch m := msg.(type) {
+		case *pgproto3.Query:
+			if m.String != "select '"+id+"'" {
+				return fmt.Errorf("unexpected query %q", m.String)
+			}
+			m.String = "select 'request-id'"
+		case *pgproto3.DataRow:
+			m.Values = [][]byte{[]byte(id)}
+		}
+		return nil
+	}
+
+	s := NewSnap(t, addr, WithStepHook(hook))
+	defer s.Finish()
+
+	fe, conn := connectFrontend(t, s)
+	defer conn.Close()
+
+	require.NoError(t, fe.Send(&pgproto3.Query{String: "select '" + id + "'"}))
+	receiveTypes(t, fe, &pgproto3.RowDescription{})
+
+	msg, err := fe.Receive()
+	require.NoError(t, err)
+	require.IsType(t, &pgproto3.DataRow{}, msg)
+	assert.Equal(t, id, string(msg.(*pgproto3.DataRow).Values[0]))
+
+	receiveTypes(t, fe, &pgproto3.CommandComplete{}, &pgproto3.ReadyForQuery{})
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, steps)
+}
+
+func TestSnap_withStepHookError(t *testing.T) {
+	hook := func(step int, msg pgproto3.Message) error {
+		if _, ok := msg.(*pgproto3.Query); ok {
+			return errors.New("request id is missing")
+		}
+		return nil
+	}
+
+	s := NewSnap(t, addr, WithStepHook(hook))
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	_, err = db.PgConn().Exec(context.TODO(), "select 'request-id'").ReadAll()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "request id is missing")
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Equal(t, "request id is missing", err.Error())
+}
+
+func TestSnap_withStepHookSendError(t *testing.T) {
+	hook := func(step int, msg pgproto3.Message) error {
+		if _, ok := msg.(*pgproto3.DataRow); ok {
+			return fmt.Errorf("no row at step %d", step)
+		}
+		return nil
+	}
+
+	s := NewSnap(t, addr, WithStepHook(hook))
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	var n int64
+	var f float64
+	err = db.QueryRow(context.TODO(), "select $1::int8, 1.5::numeric", int64(-123)).Scan(&n, &f)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no row at step 16")
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Equal(t, "no row at step 16", err.Error())
+}
+
+func TestSnap_stats(t *testing.T) {
+	s := NewSnap(t, addr)
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	var n int64
+	var f float64
+	err = db.QueryRow(context.TODO(), "select $1::int8, 1.5::numeric", int64(-123)).Scan(&n, &f)
+	require.NoError(t, err)
+
+	for _, sql := range []string{"begin", "", "commit"} {
+		_, err = db.PgConn().Exec(context.TODO(), sql).ReadAll()
+		require.NoError(t, err)
+	}
+
+	s.Finish()
+
+	st := s.Stats()
+	assert.Equal(t, 3, st.Queries)
+	assert.Equal(t, 2, st.Parses)
+	assert.Equal(t, 1, st.Binds)
+	assert.Equal(t, 1, st.Executes)
+	assert.Equal(t, 2, st.Syncs)
+	assert.Equal(t, 2, st.Messages["Describe"])
+	assert.Equal(t, 4, s.QueryCount())
+}
+
+func TestSnap_recordedStartup(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	// the startup is replayed from the snapshot, not from the options
+	assert.Equal(t, "14.5", db.PgConn().ParameterStatus("server_version"))
+	assert.Equal(t, "Asia/Jakarta", db.PgConn().ParameterStatus("TimeZone"))
+	assert.Equal(t, "", db.PgConn().ParameterStatus("DateStyle"))
+	assert.Equal(t, uint32(1), db.PgConn().PID())
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+}
+
+func TestSnap_startupParams(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	// the first connection is recorded with pgx, and replayed with lib/pq
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+
+	var n int
+	require.NoError(t, db.QueryRow("select 1").Scan(&n))
+	assert.Equal(t, 1, n)
+	require.NoError(t, db.Close())
+
+	// the second one the other way around
+	conn, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer conn.Close(context.TODO())
+
+	results, err := conn.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+}
+
+func TestSnap_withStrictStartup(t *testing.T) {
+	s := NewSnap(t, addr, WithStrictStartup(true))
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var n int
+	require.NoError(t, db.QueryRow("select 1").Scan(&n))
+	assert.Equal(t, 1, n)
+}
+
+func TestSnap_startupPQOptions(t *testing.T) {
+	s := NewSnap(t, addr, WithStrictStartup(true))
+	defer s.Finish()
+
+	// recorded with a driver sending _pq_. option, which lib/pq doesn't,
+	// so NegotiateProtocolVersion isn't sent either
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	var n int
+	require.NoError(t, db.QueryRow("select 1").Scan(&n))
+	assert.Equal(t, 1, n)
+}
+
+func TestSnap_startupPQOptionsSent(t *testing.T) {
+	s := NewSnap(t, addr, WithStrictStartup(true))
+	defer s.Finish()
+
+	// recorded without _pq_. option, the one sent is reported as
+	// unrecognized
+	msg := startupWithNegotiate(t, s, map[string]string{"application_name": "x", "_pq_.report_parameters": "search_path"})
+	assert.Equal(t, &negotiateProtocolVersion{UnrecognizedOptions: []string{"_pq_.report_parameters"}}, msg)
+}
+
+func TestSnap_withStrictStartupOptions(t *testing.T) {
+	s := NewSnap(t, addr, WithStrictStartup(true), WithStrictStartupOptions(true))
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.Error(t, db.Ping())
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TestSnap_withStrictStartupOptions.txt:2: StartupMessage doesn't match the snapshot")
+	assert.Contains(t, err.Error(), "_pq_.report_parameters")
+}
+
+func TestSnap_withStrictStartupMismatch(t *testing.T) {
+	s := NewSnap(t, addr, WithStrictStartup(true))
+
+	// recorded with lib/pq, pgx doesn't send its parameters
+	_, err := pgx.Connect(context.TODO(), s.DSN())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "TestSnap_withStrictStartupMismatch.txt:2: StartupMessage doesn't match the snapshot")
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Parameters.client_encoding:")
+}
+
+func TestSnap_withExpectedStartupParameters(t *testing.T) {
+	s := NewSnap(t, addr, WithExpectedStartupParameters(map[string]string{
+		"application_name": "myservice",
+		"options":          "-c search_path=app",
+	}))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN()+"&application_name=myservice&options=-c%20search_path%3Dapp")
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+}
+
+func TestSnap_withExpectedStartupParametersMismatch(t *testing.T) {
+	s := NewSnap(t, addr, WithExpectedStartupParameters(map[string]string{
+		"application_name": "myservice",
+		"options":          "-c search_path=app",
+	}))
+
+	_, err := pgx.Connect(context.TODO(), s.DSN()+"&application_name=other")
+	require.Error(t, err)
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Equal(t, `pgsnap: TestSnap_withExpectedStartupParametersMismatch.txt: StartupMessage doesn't match the snapshot
+--- want (snapshot)
++++ got (client)
+  Parameters.application_name:
+-   "myservice"
++   "other"
+  Parameters.options:
+-   "-c search_path=app"
++   <nil>`, err.(*MismatchError).format(false))
+}
+
+func Test_startupKey(t *testing.T) {
+	want := &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "user", "database": "app", "application_name": "pgx"},
+	}
+
+	assert.True(t, match(startupKey(want), startupKey(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "user", "database": "app", "client_encoding": "UTF8"},
+	})))
+	assert.False(t, match(startupKey(want), startupKey(&pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "user", "database": "other", "application_name": "pgx"},
+	})))
+
+	// with WithStrictStartup, every parameter is compared in any order
+	assert.True(t, match(want, &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"application_name": "pgx", "database": "app", "user": "user"},
+	}))
+	assert.False(t, match(want, &pgproto3.StartupMessage{
+		ProtocolVersion: pgproto3.ProtocolVersionNumber,
+		Parameters:      map[string]string{"user": "user", "database": "app"},
+	}))
+	assert.True(t, match(map[string]string{"user": Redacted}, map[string]string{"user": "user"}))
+}
+
+func Test_readScriptHeader(t *testing.T) {
+	script := `V1 auth=trust
+F {"Type":"StartupMessage","ProtocolVersion":196608,"Parameters":{"user":"user"}}
+B {"Type":"AuthenticationOK"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+F {"Type":"Query","String":";"}
+B {"Type":"EmptyQueryResponse"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+C
+F {"Type":"StartupMessage","ProtocolVersion":196608,"Parameters":{"user":"other"}}
+B {"Type":"AuthenticationOK"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`
+
+	s := &Snap{t: t, cfg: defaultConfig()}
+	scripts, err := s.readScript(strings.NewReader(script))
+	require.NoError(t, err)
+	require.Len(t, scripts, 2)
+
+	// the startup has NegotiateProtocolVersion, sent when the client asks
+	// for _pq_. options
+	assert.Equal(t, 4, s.startupLen(scripts[0]))
+	assert.Len(t, scripts[0].Steps, 7)
+	assert.Equal(t, 4, s.startupLen(scripts[1]))
+	assert.Len(t, scripts[1].Steps, 4)
+
+	step := scripts[1].Steps[0].(*startupStep)
+	assert.Equal(t, "other", step.want.Parameters["user"])
+	assert.Equal(t, 9, step.line)
+
+	// the authentication is done by WithAuth
+	s = &Snap{t: t, cfg: defaultConfig()}
+	WithAuth(AuthMD5, "secret")(&s.cfg)
+	_, err = s.readScript(strings.NewReader(strings.Replace(script, "auth=trust", "auth=md5", 1)))
+	require.NoError(t, err)
+
+	_, err = s.readScript(strings.NewReader(script))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "recorded with trust authentication, but WithAuth is set to md5")
+
+	s = &Snap{t: t, cfg: defaultConfig()}
+	_, err = s.readScript(strings.NewReader("# comment\n" + script))
+	assert.NoError(t, err)
+
+	_, err = s.readScript(strings.NewReader(`F {"Type":"Query","String":";"}` + "\n" + script))
+	assert.Error(t, err)
+
+	_, err = s.readScript(strings.NewReader("V1 auth=foo"))
+	assert.Error(t, err)
+
+	_, err = s.readScript(strings.NewReader("V1\n" + `F {"Type":"Query","String":";"}`))
+	assert.Error(t, err)
+
+	// the startup must end with ReadyForQuery
+	lines := strings.Split(script, "\n")
+	_, err = s.readScript(strings.NewReader(strings.Join(lines[:3], "\n")))
+	assert.Error(t, err)
+}
+
+func TestSnap_textFormat(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Ping())
+
+	var id int
+	var name string
+	var note sql.NullString
+	err = db.QueryRow("select id, name, note\n  from products\n where id = 1").Scan(&id, &name, &note)
+	require.NoError(t, err)
+	assert.Equal(t, 1, id)
+	assert.Equal(t, "a | b", name)
+	assert.False(t, note.Valid)
+}
+
+func TestSnap_withFormat(t *testing.T) {
+	upstream := NewSnap(t, addr)
+	defer upstream.Finish()
+
+	t.Cleanup(func() { os.RemoveAll("TestSnap_withFormat") })
+
+	t.Run("record", func(t *testing.T) {
+		s := NewSnap(t, upstream.DSN(), WithForceWrite(true), WithFormat(FormatText))
+		runPingAndSelect1InOneConn(t, s.DSN())
+		require.NoError(t, s.Wait())
+
+		recorded, err := os.ReadFile("TestSnap_withFormat/record.txt")
+		require.NoError(t, err)
+
+		assert.Contains(t, string(recorded), "\n>>> ;\n")
+		assert.Contains(t, string(recorded), "\n>>> select 1\n")
+		assert.Contains(t, string(recorded), "\n| 1 |\n")
+
+		require.NoError(t, os.WriteFile("TestSnap_withFormat/replay.txt", recorded, 0644))
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		s := NewSnap(t, addr, WithFormat(FormatText))
+		defer s.Finish()
+
+		runPingAndSelect1InOneConn(t, s.DSN())
+	})
+}
+
+func Test_parseTextRow(t *testing.T) {
+	row, err := parseTextRow([]byte(`| 1 |  | \N | a \| b \\ c |  padded  | \x00ff | \\x00 |`))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{
+		[]byte("1"), {}, nil, []byte(`a | b \ c`), []byte(" padded "), {0, 0xff}, []byte(`\x00`),
+	}, row.Values)
+
+	text, ok := toText(row)
+	require.True(t, ok)
+	assert.Equal(t, `| 1 |  | \N | a \| b \\ c |  padded  | \x00ff | \\x00 |`, text)
+
+	for _, invalid := range []string{`|`, `| 1`, `| 1 \|`, `| \q |`, `| \xzz |`} {
+		_, err := parseTextRow([]byte(invalid))
+		assert.Error(t, err, invalid)
+	}
+}
+
+func Test_Convert(t *testing.T) {
+	src, err := os.ReadFile("TestSnap_record.txt")
+	require.NoError(t, err)
+
+	var text bytes.Buffer
+	require.NoError(t, Convert(&text, bytes.NewReader(src), FormatText))
+	assert.Equal(t, `>>> ;
+B {"Type":"EmptyQueryResponse"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+>>> select 1
+B {"Type":"RowDescription","Fields":[{"Name":"?column?","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+| 1 |
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`, text.String())
+
+	var back bytes.Buffer
+	require.NoError(t, Convert(&back, &text, FormatJSON))
+	assert.Equal(t, string(src), back.String())
+
+	// compressed snapshot is written uncompressed
+	gz, err := gzipBytes(src)
+	require.NoError(t, err)
+	var unzipped bytes.Buffer
+	require.NoError(t, Convert(&unzipped, bytes.NewReader(gz), FormatJSON))
+	assert.Equal(t, string(src), unzipped.String())
+
+	// SQL on more than one line
+	var query bytes.Buffer
+	require.NoError(t, Convert(&query, strings.NewReader(`F {"Type":"Query","String":"select 1\n  from t"}`), FormatText))
+	assert.Equal(t, ">>> select 1\n...   from t\n", query.String())
+
+	err = Convert(&query, strings.NewReader("F {}\n... from t"), FormatJSON)
+	require.Error(t, err)
+	assert.Equal(t, "pgsnap: line 2: ... without >>> before it: ... from t", err.Error())
+}
+
+func Test_ConvertExtraKeys(t *testing.T) {
+	src := `>>> select id, created_at from t
+B {"Type":"DataRow","Values":[{"text":"1"},{"text":"2024-01-01","match":"*"}]}
+| 2 | 2024-01-02 | delayMs=50
+| 3 | 2024-01-03 |
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`
+	var json bytes.Buffer
+	require.NoError(t, Convert(&json, strings.NewReader(src), FormatJSON))
+	assert.Equal(t, `F {"Type":"Query","String":"select id, created_at from t"}
+B {"Type":"DataRow","Values":[{"text":"1"},{"text":"2024-01-01","match":"*"}]}
+B {"Type":"DataRow","Values":[{"text":"2"},{"text":"2024-01-02"}],"delayMs":50}
+B {"Type":"DataRow","Values":[{"text":"3"},{"text":"2024-01-03"}]}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`, json.String())
+
+	// the row with match has no text format, it's kept as JSON
+	var text bytes.Buffer
+	require.NoError(t, Convert(&text, bytes.NewReader(json.Bytes()), FormatText))
+	assert.Equal(t, src, text.String())
+
+	var back bytes.Buffer
+	require.NoError(t, Convert(&back, &text, FormatJSON))
+	assert.Equal(t, json.String(), back.String())
+}
+
+func TestSnap_yaml(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	db, err := sql.Open("postgres", s.DSN())
+	require.NoError(t, err)
+	defer db.Close()
+
+	require.NoError(t, db.Ping())
+
+	rows, err := db.Query("select name\n  from products\n order by id")
+	require.NoError(t, err)
+	defer rows.Close()
+
+	var names []sql.NullString
+	for rows.Next() {
+		var name sql.NullString
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []sql.NullString{{String: "coffee", Valid: true}, {String: "42", Valid: true}, {}}, names)
+}
+
+func TestSnap_withFormatYAML(t *testing.T) {
+	upstream := NewSnap(t, addr, WithMaxConns(2))
+	defer upstream.Finish()
+
+	t.Cleanup(func() { os.RemoveAll("TestSnap_withFormatYAML") })
+
+	t.Run("record", func(t *testing.T) {
+		s := NewSnap(t, upstream.DSN(), WithForceWrite(true), WithFormat(FormatYAML))
+		runPingAndSelect1InOneConn(t, s.DSN())
+		require.NoError(t, s.Wait())
+
+		recorded, err := os.ReadFile("TestSnap_withFormatYAML/record.yaml")
+		require.NoError(t, err)
+
+		assert.Contains(t, string(recorded), "header: V1 auth=trust\n")
+		assert.Contains(t, string(recorded), `
+  - front:
+      Type: Query
+      String: select 1
+  - back:
+      Type: RowDescription
+      Fields:
+      - Name: ?column?
+`)
+		assert.Contains(t, string(recorded), `
+  - back:
+      Type: DataRow
+      Values:
+      - text: "1"
+`)
+
+		require.NoError(t, os.WriteFile("TestSnap_withFormatYAML/replay.yaml", recorded, 0644))
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		// the format is detected by the extension
+		s := NewSnap(t, addr)
+		defer s.Finish()
+
+		runPingAndSelect1InOneConn(t, s.DSN())
+	})
+
+	t.Run("update", func(t *testing.T) {
+		// the same messages are not written again
+		os.Setenv("PGSNAP_UPDATE", "1")
+		defer os.Unsetenv("PGSNAP_UPDATE")
+
+		before, err := os.ReadFile("TestSnap_withFormatYAML/replay.yaml")
+		require.NoError(t, err)
+		before = append([]byte("# kept\n"), before...)
+		require.NoError(t, os.WriteFile("TestSnap_withFormatYAML/update.yaml", before, 0644))
+
+		s := NewSnap(t, upstream.DSN())
+		runPingAndSelect1InOneConn(t, s.DSN())
+		require.NoError(t, s.Wait())
+
+		_, err = os.Stat("TestSnap_withFormatYAML/update.txt")
+		assert.True(t, os.IsNotExist(err))
+
+		after, err := os.ReadFile("TestSnap_withFormatYAML/update.yaml")
+		require.NoError(t, err)
+		assert.Equal(t, string(before), string(after))
+	})
+}
+
+func Test_toYAML(t *testing.T) {
+	lines := recordingLines([]byte(`V1 auth=md5
+F {"Type":"StartupMessage","ProtocolVersion":196608,"Parameters":{"user":"user"}}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+F {"Type":"Bind","DestinationPortal":"","PreparedStatement":"s","ParameterFormatCodes":[1],"Parameters":[{"binary":"0001"}],"ResultFormatCodes":[]}
+B {"Type":"DataRow","Values":[{"text":"true"},{"text":"1.5"},null,{"text":"null"}]}
+C
+F {"Type":"Query","String":"select 'a: b'"}
+`))
+
+	doc, err := toYAML(lines)
+	require.NoError(t, err)
+
+	yamlLines, err := fromYAML(doc)
+	require.NoError(t, err)
+	require.Len(t, yamlLines, len(lines), string(doc))
+
+	for i, line := range yamlLines {
+		assert.True(t, sameLine(lines[i], line.b), "%s\n%s", lines[i], line.b)
+	}
+	assert.Equal(t, 1, yamlLines[0].line)
+
+	_, err = fromYAML([]byte("connections:\n  - - front: {Type: Query}\n      back: {Type: EmptyQueryResponse}\n"))
+	require.Error(t, err)
+	assert.Equal(t, "2: message must have either front or back: ", err.Error())
+}
+
+func TestSnap_withGzip(t *testing.T) {
+	t.Cleanup(func() { os.RemoveAll("TestSnap_withGzip") })
+	require.NoError(t, os.MkdirAll("TestSnap_withGzip", 0755))
+
+	query := "select n from generate_series(1, 10000) n"
+
+	var script strings.Builder
+	script.WriteString(`F {"Type":"Query","String":"` + query + `"}` + "\n")
+	script.WriteString(`B {"Type":"RowDescription","Fields":[{"Name":"n","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}` + "\n")
+	for i := 1; i <= 10000; i++ {
+		fmt.Fprintf(&script, `B {"Type":"DataRow","Values":[{"text":"%d"}]}`+"\n", i)
+	}
+	script.WriteString(`B {"Type":"CommandComplete","CommandTag":"SELECT 10000"}` + "\n")
+	script.WriteString(`B {"Type":"ReadyForQuery","TxStatus":"I"}` + "\n")
+	require.NoError(t, os.WriteFile("TestSnap_withGzip/upstream.txt", []byte(script.String()), 0644))
+
+	sum := func(t *testing.T, dsn string) int {
+		db, err := sql.Open("postgres", dsn)
+		require.NoError(t, err)
+		defer db.Close()
+
+		rows, err := db.Query(query)
+		require.NoError(t, err)
+		defer rows.Close()
+
+		total := 0
+		for rows.Next() {
+			var n int
+			require.NoError(t, rows.Scan(&n))
+			total += n
+		}
+		require.NoError(t, rows.Err())
+		return total
+	}
+
+	t.Run("upstream", func(t *testing.T) {
+		// proxying the rows takes longer than the default timeout with
+		// -race
+		upstream := NewSnap(t, addr, WithMaxConns(2), WithTimeout(10*time.Second))
+		defer upstream.Finish()
+
+		t.Run("compressed", func(t *testing.T) {
+			s := NewSnap(t, upstream.DSN(), WithForceWrite(true), WithGzip(), WithTimeout(10*time.Second))
+			assert.Equal(t, 50005000, sum(t, s.DSN()))
+			require.NoError(t, s.Wait())
+		})
+
+		t.Run("uncompressed", func(t *testing.T) {
+			s := NewSnap(t, upstream.DSN(), WithForceWrite(true), WithTimeout(10*time.Second))
+			assert.Equal(t, 50005000, sum(t, s.DSN()))
+			require.NoError(t, s.Wait())
+		})
+	})
+
+	compressed, err := os.ReadFile("TestSnap_withGzip/upstream/compressed.pgsnap.gz")
+	require.NoError(t, err)
+	uncompressed, err := os.ReadFile("TestSnap_withGzip/upstream/uncompressed.txt")
+	require.NoError(t, err)
+
+	assert.Equal(t, gzipMagic, compressed[:2])
+	assert.Less(t, len(compressed)*10, len(uncompressed))
+
+	decompressed, err := gunzip(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, string(uncompressed), string(decompressed))
+
+	require.NoError(t, os.WriteFile("TestSnap_withGzip/replay.pgsnap.gz", compressed, 0644))
+
+	t.Run("replay", func(t *testing.T) {
+		s := NewSnap(t, addr, WithTimeout(10*time.Second))
+		defer s.Finish()
+
+		assert.Equal(t, 50005000, sum(t, s.DSN()))
+	})
+}
+
+func TestSnap_use(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	cases := []struct {
+		name string
+		want string
+		err  error
+	}{
+		{name: "found", want: "coffee"},
+		{name: "not_found", err: sql.ErrNoRows},
+		{name: "found", want: "coffee"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			require.NoError(t, s.Use(tc.name))
+
+			db, err := sql.Open("postgres", s.DSN())
+			require.NoError(t, err)
+			defer db.Close()
+
+			var name string
+			err = db.QueryRow("select name from products where id = 1").Scan(&name)
+			assert.Equal(t, tc.err, err)
+			assert.Equal(t, tc.want, name)
+		})
+	}
+
+	err := s.Use("unknown")
+	require.Error(t, err)
+	assert.Equal(t, `pgsnap: TestSnap_use.txt has no section "unknown"`, err.Error())
+}
+
+func TestSnap_useRecord(t *testing.T) {
+	upstream := NewSnap(t, addr)
+	defer upstream.Finish()
+
+	t.Cleanup(func() { os.RemoveAll("TestSnap_useRecord") })
+
+	t.Run("record", func(t *testing.T) {
+		// the recorder connects to the upstream right away
+		require.NoError(t, upstream.Use("one"))
+		s := NewSnap(t, upstream.DSN(), WithForceWrite(true))
+
+		for _, name := range []string{"one", "two"} {
+			if name != "one" {
+				require.NoError(t, upstream.Use(name))
+			}
+			require.NoError(t, s.Use(name))
+			assert.Equal(t, name, runSelectText(t, s.DSN(), name))
+		}
+		require.NoError(t, s.Wait())
+
+		recorded, err := os.ReadFile("TestSnap_useRecord/record.txt")
+		require.NoError(t, err)
+
+		assert.Regexp(t, "^V1 auth=trust\n=== case:one ===\nF {\"Type\":\"StartupMessage\"", string(recorded))
+		assert.Contains(t, string(recorded), "\n=== case:two ===\nF {\"Type\":\"StartupMessage\"")
+		assert.NotContains(t, string(recorded), "\nC\n")
+
+		require.NoError(t, os.WriteFile("TestSnap_useRecord/replay.txt", recorded, 0644))
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		s := NewSnap(t, addr)
+		defer s.Finish()
+
+		require.NoError(t, s.Use("two"))
+		assert.Equal(t, "two", runSelectText(t, s.DSN(), "two"))
+	})
+}
+
+func Test_readScriptSections(t *testing.T) {
+	query := `F {"Type":"Query","String":";"}
+B {"Type":"EmptyQueryResponse"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`
+
+	s := &Snap{t: t, cfg: defaultConfig()}
+	scripts, err := s.readScript(strings.NewReader(query + "=== case:a ===\n" + query + "C\n" + query + "=== case:b ===\n" + query))
+	require.NoError(t, err)
+	assert.Len(t, scripts, 1)
+	assert.Len(t, s.sections["a"], 2)
+	assert.Len(t, s.sections["b"], 1)
+
+	scripts, err = s.readScript(strings.NewReader("=== case:a ===\n" + query))
+	require.NoError(t, err)
+	assert.Len(t, scripts, 0)
+
+	_, err = s.readScript(strings.NewReader("=== case:a ===\n=== case:b ===\n" + query))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `section "a" is empty`)
+
+	_, err = s.readScript(strings.NewReader("=== case:a ===\n" + query + "=== case:a ===\n" + query))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `section "a" is repeated`)
+}
+
+func TestLint(t *testing.T) {
+	src := `F {"Type":"Query","String":"select 1"}
+B {"Type":"DataRow","Values":[{"text":"1"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+>>> select 1, 2
+B {"Type":"RowDescription","Fields":[{"Name":"a","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+| 1 | 2 |
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+C
+F {"Type":"Parse","Name":"","Query":"select 1","ParameterOIDs":null}
+F {"Type":"Flush"}
+B {"Type":"ParseComplete"}
+C
+F {"Type":"Query","String":"select 1"}
+C
+F {"Type":"Parse","Name":"","Query":"select 1","ParameterOIDs":null}
+F {"Type":"Bind","DestinationPortal":"","PreparedStatement":"","ParameterFormatCodes":null,"Parameters":null,"ResultFormatCodes":null}
+F {"Type":"Execute","Portal":"","MaxRows":1}
+F {"Type":"Execute","Portal":"","MaxRows":0}
+F {"Type":"Sync"}
+B {"Type":"DataRow","Values":[{"text":"1"}]}
+B {"Type":"DataRow","Values":[{"text":"1"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 2"}
+B {"Type":"PortalSuspended"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`
+	errs := Lint(strings.NewReader(src))
+
+	var got []string
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	assert.Equal(t, []string{
+		"line 2: DataRow without RowDescription before it",
+		"line 7: DataRow has 2 values, but RowDescription has 1 fields",
+		"line 10: ReadyForQuery without Query or Sync before it",
+		"line 12: Parse is never followed by Sync",
+		"line 16: Query is never answered by ReadyForQuery",
+		"line 24: Execute of line 20 has MaxRows 1, but it's answered with more DataRow",
+		"line 26: PortalSuspended without Execute with MaxRows before it",
+	}, got)
+
+	// the order isn't checked when some lines can't be read
+	errs = Lint(strings.NewReader("F {\"Type\":\"Query\",\"String\":\"select 1\"}\nB {\"Type\":\"Foo\"}\nX\n"))
+	got = nil
+	for _, err := range errs {
+		got = append(got, err.Error())
+	}
+	assert.Equal(t, []string{
+		"line 2: B: unknown type `Foo`: B {\"Type\":\"Foo\"}",
+		"line 3: unknown line: X",
+	}, got)
+}
+
+func TestLint_fixtures(t *testing.T) {
+	files, err := filepath.Glob("*.txt")
+	require.NoError(t, err)
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		require.NoError(t, err)
+		assert.Empty(t, Lint(f), file)
+		f.Close()
+	}
+}
+
+func TestVerifyRoundTrip(t *testing.T) {
+	src := `F {"Type":"Query","String":"select 1","Timeout":5}
+B {"Type":"RowDescription","Fields":[{"Name":"a","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+B {"Type":"DataRow","Values":[{"text":"1"},{"binary":"31"}]}
+>>> select 2
+| 2 |
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`
+	var got []string
+	for _, err := range VerifyRoundTrip(strings.NewReader(src)) {
+		got = append(got, err.Error())
+	}
+	assert.Equal(t, []string{
+		"line 1: Query: Timeout is missing after the round trip",
+		`line 3: DataRow: Values[1].binary is null after the round trip, want "31"`,
+	}, got)
+}
+
+func TestVerifyRoundTrip_fixtures(t *testing.T) {
+	files, err := filepath.Glob("*.txt")
+	require.NoError(t, err)
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		require.NoError(t, err)
+		assert.Empty(t, VerifyRoundTrip(f), file)
+		f.Close()
+	}
+}
+
+// writeRows write snapshot of select returning n rows to dir, with the
+// rows in both JSON and text format
+func writeRows(t testing.TB, dir, name string, n int) {
+	t.Helper()
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "F {\"Type\":\"Query\",\"String\":\"select * from generate_series(1, %d)\"}\n", n)
+	b.WriteString(`B {"Type":"RowDescription","Fields":[{"Name":"generate_series","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}` + "\n")
+	for i := 1; i <= n; i++ {
+		if i%2 == 0 {
+			fmt.Fprintf(&b, "| %d |\n", i)
+		} else {
+			fmt.Fprintf(&b, "B {\"Type\":\"DataRow\",\"Values\":[{\"text\":\"%d\"}]}\n", i)
+		}
+	}
+	fmt.Fprintf(&b, "B {\"Type\":\"CommandComplete\",\"CommandTag\":\"SELECT %d\"}\n", n)
+	b.WriteString(`B {"Type":"ReadyForQuery","TxStatus":"I"}` + "\n")
+
+	path := filepath.Join(dir, name+".txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(b.String()), 0644))
+}
+
+// selectRows replay the snapshot written by writeRows, and return the rows
+func selectRows(t testing.TB, dsn string, n int) [][][]byte {
+	t.Helper()
+
+	db, err := pgx.Connect(context.TODO(), dsn)
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	results, err := db.PgConn().Exec(context.TODO(), fmt.Sprintf("select * from generate_series(1, %d)", n)).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	return results[0].Rows
+}
+
+func TestSnap_streamRows(t *testing.T) {
+	dir := t.TempDir()
+	n := streamRows*2 + 1
+	writeRows(t, dir, t.Name(), n)
+
+	s := NewSnap(t, addr, WithSnapshotDir(dir))
+	defer s.Finish()
+
+	rows := selectRows(t, s.DSN(), n)
+	require.Len(t, rows, n)
+	for i, row := range rows {
+		assert.Equal(t, fmt.Sprint(i+1), string(row[0]))
+	}
+}
+
+func Test_readScriptRows(t *testing.T) {
+	dir := t.TempDir()
+	n := streamRows + 1
+	writeRows(t, dir, "rows", n)
+
+	f, err := os.Open(filepath.Join(dir, "rows.txt"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	s := &Snap{cfg: defaultConfig(), file: f.Name()}
+	scripts, err := s.readScript(f)
+	require.NoError(t, err)
+	require.Len(t, scripts, 1)
+
+	// the rows are read again when they are sent
+	steps := scripts[0].Steps[s.startupLen(scripts[0]):]
+	require.Len(t, steps, 5)
+	rows, ok := steps[2].(*rowsStep)
+	require.True(t, ok)
+	assert.Equal(t, 3, rows.line)
+	assert.Equal(t, n, rows.n)
+
+	// and not when the snapshot isn't a file
+	b, err := os.ReadFile(f.Name())
+	require.NoError(t, err)
+	scripts, err = s.readScript(bytes.NewReader(b))
+	require.NoError(t, err)
+	assert.Len(t, scripts[0].Steps[s.startupLen(scripts[0]):], n+4)
+}
+
+// BenchmarkSnap_streamRows replay a select with many rows. The memory kept
+// for the script, script-B, doesn't grow with the number of rows.
+func BenchmarkSnap_streamRows(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			dir := b.TempDir()
+			writeRows(b, dir, b.Name(), n)
+
+			s := &Snap{cfg: defaultConfig(), file: filepath.Join(dir, b.Name()+".txt")}
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			scripts, err := s.getScript()
+			require.NoError(b, err)
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			runtime.KeepAlive(scripts)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				s := NewSnap(b, addr, WithSnapshotDir(dir), WithTimeout(time.Minute))
+				if rows := selectRows(b, s.DSN(), n); len(rows) != n {
+					b.Fatalf("got %d rows, want %d", len(rows), n)
+				}
+				s.Finish()
+			}
+			b.ReportMetric(float64(after.HeapAlloc)-float64(before.HeapAlloc), "script-B")
+		})
+	}
+}
+
+// BenchmarkRowsStep read the rows of a snapshot with 100k rows again, with
+// the decoder of the pool, and decoded by readStep like the other steps
+func BenchmarkRowsStep(b *testing.B) {
+	dir := b.TempDir()
+	writeRows(b, dir, "rows", 100000)
+
+	s := &Snap{cfg: defaultConfig(), file: filepath.Join(dir, "rows.txt")}
+	scripts, err := s.getScript()
+	require.NoError(b, err)
+	rows := scripts[0].Steps[s.startupLen(scripts[0])+2].(*rowsStep)
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			require.NoError(b, rows.each(func(*sendStep) error { return nil }))
+		}
+	})
+
+	b.Run("readStep", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			f, err := os.Open(s.file)
+			require.NoError(b, err)
+			sc := newTextScanner(f, 0)
+			for {
+				l, err := sc.scan()
+				if err == io.EOF {
+					break
+				}
+				require.NoError(b, err)
+				if l.line >= rows.line && l.line < rows.line+rows.n {
+					_, err := s.readStep(l.b, l.line)
+					require.NoError(b, err)
+				}
+			}
+			f.Close()
+		}
+	})
+}
+
+func Test_dataRowDecoder(t *testing.T) {
+	s := &Snap{cfg: defaultConfig()}
+	dec := &dataRowDecoder{}
+
+	for _, line := range []string{
+		`{"Type":"DataRow","Values":[{"binary":""}]}`,
+		`{"Type":"DataRow","Values":[{"text":"12345"},{"binary":"00ff"},{"text":"joe"}]}`,
+		// the values of the row before are reused
+		`{"Type":"DataRow","Values":[{"text":""},null]}`,
+		`{"Type":"DataRow","Values":[{"text":"a\"b\u00e9"},{"text":"2f1c","match":"*"},{"binary":""}]}`,
+		`{"Type":"DataRow","Values":[]}`,
+	} {
+		want, err := s.unmarshalB([]byte(line))
+		require.NoError(t, err)
+
+		got, err := dec.decode([]byte(line))
+		require.NoError(t, err, line)
+		assert.Equal(t, want, got, line)
+	}
+
+	_, err := dec.decode([]byte(`{"Type":"CommandComplete","CommandTag":"SELECT 1"}`))
+	assert.Equal(t, errRowsChanged, err)
+	_, err = dec.decode([]byte(`{"Type":"DataRow","Values":[{"match":"*"}]}`))
+	assert.Error(t, err)
+	_, err = dec.decode([]byte(`{"Type":"DataRow","Values":[{"text":1}]}`))
+	assert.Error(t, err)
+}
+
+// BenchmarkDataRowDecoder decode the DataRow lines of a snapshot with 100k
+// rows, with the decoder of the pool and with unmarshalB
+func BenchmarkDataRowDecoder(b *testing.B) {
+	s := &Snap{cfg: defaultConfig()}
+
+	lines := make([][]byte, 100000)
+	for i := range lines {
+		lines[i] = []byte(fmt.Sprintf(`{"Type":"DataRow","Values":[{"text":"%d"},{"text":"user %d"},null]}`, i, i))
+	}
+
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			dec := dataRowPool.Get().(*dataRowDecoder)
+			for _, l := range lines {
+				if _, err := dec.decode(l); err != nil {
+					b.Fatal(err)
+				}
+			}
+			dataRowPool.Put(dec)
+		}
+	})
+
+	b.Run("unmarshalB", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for _, l := range lines {
+				if _, err := s.unmarshalB(l); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
+
+func TestSnap_replay(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot))
+
+	go execSelectOne(t, s)
+
+	assert.NoError(t, s.Replay(context.Background()))
+}
+
+func TestSnap_replayMismatch(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot))
+
+	go func() {
+		db, err := pgx.Connect(context.TODO(), s.DSN())
+		if err != nil {
+			return
+		}
+		defer db.Close(context.TODO())
+		db.PgConn().Exec(context.TODO(), "select 2").ReadAll()
+	}()
+
+	var mismatch *MismatchError
+	err := s.Replay(context.Background())
+	assert.True(t, errors.As(err, &mismatch), err)
+}
+
+func TestSnap_replayContext(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(selectOneSnapshot))
+
+	// the client never connects
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, s.Replay(ctx))
+
+	// the snap is still replaying
+	execSelectOne(t, s)
+	assert.NoError(t, s.Replay(context.Background()))
+}
+
+func Test_recordingWarmup(t *testing.T) {
+	s := &Snap{t: t, cfg: defaultConfig(), writeMode: true}
+	r := s.newRecording()
+
+	r.write("F", &pgproto3.StartupMessage{ProtocolVersion: pgproto3.ProtocolVersionNumber, Parameters: map[string]string{"user": "user"}})
+	r.write("B", &pgproto3.ReadyForQuery{TxStatus: 'I'})
+	r.endStartup()
+
+	r.write("F", &pgproto3.Query{String: "SET search_path TO app"})
+	r.write("B", &pgproto3.CommandComplete{CommandTag: []byte("SET")})
+	r.write("B", &pgproto3.ReadyForQuery{TxStatus: 'I'})
+	// the batch isn't ended when the warm-up is over
+	r.write("F", &pgproto3.Parse{Query: "select 2"})
+	r.write("B", &pgproto3.ParseComplete{})
+
+	// the connection that isn't started yet has no warm-up
+	other := s.newRecording()
+
+	s.StartRecording()
+	r.write("F", &pgproto3.Query{String: "select 1"})
+	r.write("B", &pgproto3.ReadyForQuery{TxStatus: 'I'})
+
+	assert.Equal(t, `F {"Type":"StartupMessage","ProtocolVersion":196608,"Parameters":{"user":"user"}}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+=== warm-up ===
+F {"Type":"Query","String":"select 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+`, string(r.bytes()))
+	assert.Empty(t, other.bytes())
+}
+
+const warmupSnapshot = `=== warm-up ===
+` + selectOneSnapshot
+
+func TestSnap_startRecording(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(warmupSnapshot))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	// the warm-up isn't in the snapshot
+	_, err = db.Exec(context.TODO(), "SET search_path TO app")
+	require.NoError(t, err)
+	tag, err := db.Exec(context.TODO(), "select set_config($1, $2, false)", "app.tenant", "42")
+	require.NoError(t, err)
+	assert.Equal(t, "SELECT 0", tag.String())
+
+	s.StartRecording()
+
+	results, err := db.PgConn().Exec(context.TODO(), "select 1").ReadAll()
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(results[0].Rows[0][0]))
+}
+
+func TestSnap_startRecordingYAML(t *testing.T) {
+	lines := recordingLines([]byte(warmupSnapshot))
+	b, err := toYAML(lines)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), "- warm-up\n")
+
+	back, err := fromYAML(b)
+	require.NoError(t, err)
+	require.Len(t, back, len(lines))
+	assert.Equal(t, string(warmupLine), string(back[0].b))
+}
+
+func Test_readScriptWarmup(t *testing.T) {
+	s := &Snap{t: t, cfg: defaultConfig(), file: "snapshot"}
+
+	scripts, err := s.readScript(strings.NewReader(warmupSnapshot))
+	require.NoError(t, err)
+	require.Len(t, scripts, 1)
+	assert.IsType(t, &warmupStep{}, scripts[0].Steps[len(s.startupSteps())])
+
+	_, err = s.readScript(strings.NewReader(selectOneSnapshot + "=== warm-up ===\n"))
+	assert.EqualError(t, err, "snapshot:6: warm-up must follow the startup: === warm-up ===")
+}
+
+const unorderedSnapshot = `=== unordered ===
+F {"Type":"Query","String":"select 1"}
+B {"Type":"RowDescription","Fields":[{"Name":"?column?","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+B {"Type":"DataRow","Values":[{"text":"1"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+F {"Type":"Query","String":"select 2"}
+B {"Type":"RowDescription","Fields":[{"Name":"?column?","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+B {"Type":"DataRow","Values":[{"text":"2"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+F {"Type":"Query","String":"select 3"}
+B {"Type":"RowDescription","Fields":[{"Name":"?column?","TableOID":0,"TableAttributeNumber":0,"DataTypeOID":23,"DataTypeSize":4,"TypeModifier":-1,"Format":0}]}
+B {"Type":"DataRow","Values":[{"text":"3"}]}
+B {"Type":"CommandComplete","CommandTag":"SELECT 1"}
+B {"Type":"ReadyForQuery","TxStatus":"I"}
+=== end ===
+`
+
+func TestSnap_unordered(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(unorderedSnapshot), WithMaxConns(1))
+	defer s.Finish()
+
+	// the goroutines share the connection of the pool, in any order
+	db := s.OpenDB("postgres")
+	var wg sync.WaitGroup
+	for i := 1; i <= 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var n int
+			assert.NoError(t, db.QueryRow(fmt.Sprintf("select %d", i)).Scan(&n))
+			assert.Equal(t, i, n)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestSnap_unorderedReversed(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(unorderedSnapshot))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	for _, sql := range []string{"select 3", "select 1", "select 2"} {
+		results, err := db.PgConn().Exec(context.TODO(), sql).ReadAll()
+		require.NoError(t, err)
+		assert.Equal(t, sql[len(sql)-1:], string(results[0].Rows[0][0]))
+	}
+}
+
+func TestSnap_unorderedMismatch(t *testing.T) {
+	s := NewSnapFromReader(t, strings.NewReader(unorderedSnapshot))
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+	defer db.Close(context.TODO())
+
+	_, err = db.PgConn().Exec(context.TODO(), "select 2").ReadAll()
+	require.NoError(t, err)
+	// each exchange is replayed once
+	_, err = db.PgConn().Exec(context.TODO(), "select 2").ReadAll()
+	require.Error(t, err)
+
+	var me *MismatchError
+	err = s.Wait()
+	require.ErrorAs(t, err, &me)
+	assert.Equal(t, 2, me.Line)
+	assert.Equal(t, &pgproto3.Query{String: "select 2"}, me.Got)
+}
+
+func Test_readScriptUnordered(t *testing.T) {
+	s := &Snap{t: t, cfg: defaultConfig(), file: "snapshot"}
+
+	scripts, err := s.readScript(strings.NewReader(unorderedSnapshot))
+	require.NoError(t, err)
+	require.Len(t, scripts, 1)
+	steps := scripts[0].Steps[len(s.startupSteps()):]
+	require.Len(t, steps, 1)
+	require.IsType(t, &unorderedStep{}, steps[0])
+	assert.Len(t, steps[0].(*unorderedStep).exchanges, 3)
+
+	tests := map[string]string{
+		"=== unordered ===\n=== end ===\n":                                                      "snapshot:2: unordered group of line 1 is empty: === end ===",
+		"=== unordered ===\n" + selectOneSnapshot:                                               "snapshot:1: unordered group isn't ended in the connection",
+		"=== unordered ===\n" + selectOneSnapshot + "C\n":                                       "snapshot:1: unordered group isn't ended in the connection",
+		selectOneSnapshot + "=== end ===\n":                                                     "snapshot:6: === end === without === unordered === before it: === end ===",
+		"=== unordered ===\n=== unordered ===\n":                                                "snapshot:2: unordered group of line 1 isn't ended: === unordered ===",
+		"=== unordered ===\n" + `B {"Type":"ReadyForQuery","TxStatus":"I"}` + "\n=== end ===\n": "snapshot:3: unordered group of line 1 has an exchange that doesn't start with a message of the client: === end ===",
+		"=== unordered ===\n" + `F {"Type":"Query","String":"select 1"}` + "\n=== end ===\n":    "snapshot:3: unordered group of line 1 doesn't end with ReadyForQuery: === end ===",
+	}
+	for src, want := range tests {
+		_, err := s.readScript(strings.NewReader(src))
+		assert.EqualError(t, err, want, src)
+	}
+}
@@ -0,0 +1,123 @@
+package pgsnap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// sslRequest is the whole SSLRequest message: the length (8) followed by
+// the SSL request code 80877103
+var sslRequest = []byte{0, 0, 0, 8, 0x04, 0xd2, 0x16, 0x2f}
+
+// bufferedConn is net.Conn that read through the bufio.Reader used to peek
+// the first message
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// setLinger make closing conn reset the connection, so the client doesn't
+// wait for more messages
+func setLinger(conn net.Conn) {
+	if b, ok := conn.(*bufferedConn); ok {
+		conn = b.Conn
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		_ = tcp.SetLinger(0)
+	}
+}
+
+// accept wait for the client to connect and return the raw connection
+// together with the connection to talk postgres protocol with (i.e. after
+// SSL negotiation). Client that drop the connection after its SSLRequest
+// is declined (e.g. pgx with sslmode=prefer) will be waited to connect again.
+func (s *Snap) accept() (net.Conn, net.Conn, error) {
+	for {
+		raw, err := s.l.Accept()
+		if err != nil {
+			return nil, nil, err
+		}
+		s.track(raw)
+
+		if s.acceptTimer != nil {
+			s.acceptTimer.Stop()
+		}
+
+		if s.cfg.timeout > 0 {
+			err = raw.SetDeadline(time.Now().Add(s.cfg.timeout))
+			if err != nil {
+				s.untrack(raw)
+				return nil, nil, err
+			}
+		}
+
+		conn, err := s.negotiateSSL(raw)
+		if errors.Is(err, io.EOF) {
+			s.untrack(raw)
+			continue
+		}
+		if err != nil {
+			s.untrack(raw)
+			return nil, nil, err
+		}
+
+		return raw, conn, nil
+	}
+}
+
+// negotiateSSL peek the first message sent by the client, and when it is
+// an SSLRequest, either upgrade the connection to TLS (WithTLS) or decline
+// it by answering 'N' so the client continue with StartupMessage in plain text
+func (s *Snap) negotiateSSL(conn net.Conn) (net.Conn, error) {
+	if !s.cfg.ssl && s.cfg.tls == nil {
+		return conn, nil
+	}
+
+	r := bufio.NewReader(conn)
+	buffered := &bufferedConn{Conn: conn, r: r}
+
+	b, err := r.Peek(len(sslRequest))
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(b, sslRequest) {
+		if s.cfg.tls != nil {
+			return nil, errors.New("pgsnap: client doesn't negotiate TLS")
+		}
+		return buffered, nil
+	}
+
+	_, _ = r.Discard(len(sslRequest))
+
+	if s.cfg.tls != nil {
+		_, err = conn.Write([]byte{'S'})
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConn := tls.Server(buffered, s.cfg.tls)
+		return tlsConn, tlsConn.Handshake()
+	}
+
+	_, err = conn.Write([]byte{'N'})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	return buffered, nil
+}
@@ -0,0 +1,52 @@
+package pgsnap
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnap_sslPrefer(t *testing.T) {
+	s := NewSnap(t, addr)
+	defer s.Finish()
+
+	dsn := strings.Replace(s.DSN(), "sslmode=disable", "sslmode=prefer", 1)
+
+	db, err := pgx.Connect(context.TODO(), dsn)
+	require.NoError(t, err)
+
+	err = db.Ping(context.TODO())
+	require.NoError(t, err)
+}
+
+func TestSnap_withTLS(t *testing.T) {
+	s := NewSnap(t, addr, WithTLS(nil))
+	defer s.Finish()
+
+	db, err := pgx.Connect(context.TODO(), s.DSN())
+	require.NoError(t, err)
+
+	_, ok := db.PgConn().Conn().(*tls.Conn)
+	assert.True(t, ok, "connection should use TLS")
+
+	err = db.Ping(context.TODO())
+	require.NoError(t, err)
+}
+
+func TestSnap_withTLSWithoutSSL(t *testing.T) {
+	s := NewSnap(t, addr, WithTLS(nil))
+
+	dsn := strings.Replace(s.DSN(), "sslmode=require", "sslmode=disable", 1)
+
+	_, err := pgx.Connect(context.TODO(), dsn)
+	assert.Error(t, err)
+
+	err = s.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "doesn't negotiate TLS")
+}
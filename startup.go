@@ -0,0 +1,264 @@
+package pgsnap
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// startupSteps is the startup of every connection in snapshot without
+// header, which is done by pgsnap as configured by the options
+func (s *Snap) startupSteps() []pgmock.Step {
+	startup := &startupStep{file: s.getFilename(), delay: s.cfg.startupDelay, expect: s.cfg.expectedStartupParameters}
+	steps := []pgmock.Step{startup, &negotiateStep{startup: startup, msg: s.cfg.negotiate}}
+
+	steps = append(steps, s.authSteps(startup)...)
+	steps = append(steps, &sendStep{msg: &pgproto3.AuthenticationOk{}})
+	steps = append(steps, s.parameterStatusSteps()...)
+
+	return append(steps,
+		&sendStep{msg: &pgproto3.BackendKeyData{ProcessID: s.cfg.backendPID, SecretKey: s.cfg.backendSecret}},
+		&sendStep{msg: &pgproto3.ReadyForQuery{TxStatus: 'I'}},
+	)
+}
+
+// authSteps ask the client to authenticate as set by WithAuth
+func (s *Snap) authSteps(startup *startupStep) []pgmock.Step {
+	switch s.cfg.auth {
+	case AuthSCRAM:
+		return []pgmock.Step{&scramAuthStep{password: s.cfg.password, params: s.cfg.scram}}
+	case AuthMD5:
+		return []pgmock.Step{&md5AuthStep{startup: startup, password: s.cfg.password, salt: s.cfg.md5Salt}}
+	case AuthCleartext:
+		return []pgmock.Step{&cleartextAuthStep{startup: startup, password: s.cfg.password}}
+	}
+	return nil
+}
+
+// recordedStartup is the startup of one connection in V1 snapshot: the
+// StartupMessage and the messages sent until the first ReadyForQuery,
+// without the authentication
+type recordedStartup struct {
+	want     *pgproto3.StartupMessage
+	line     int
+	messages []pgproto3.BackendMessage
+}
+
+// done tell whether the startup is read until ReadyForQuery
+func (r *recordedStartup) done() bool {
+	if len(r.messages) == 0 {
+		return false
+	}
+	_, ok := r.messages[len(r.messages)-1].(*pgproto3.ReadyForQuery)
+	return ok
+}
+
+// recordedStartupSteps replay r, with the authentication set by WithAuth
+// done right before AuthenticationOk
+func (s *Snap) recordedStartupSteps(r *recordedStartup) []pgmock.Step {
+	startup := &startupStep{
+		want:   r.want,
+		file:   s.getFilename(),
+		line:   r.line,
+		delay:  s.cfg.startupDelay,
+		strict: s.cfg.strictStartup,
+		expect: s.cfg.expectedStartupParameters,
+
+		strictOptions: s.cfg.strictStartupOptions,
+	}
+	steps := []pgmock.Step{startup}
+
+	// the _pq_. options reported as unrecognized are the ones sent by the
+	// client, not the ones recorded
+	negotiate := &negotiateStep{startup: startup, msg: s.cfg.negotiate}
+	if !s.cfg.strictStartupOptions {
+		steps = append(steps, negotiate)
+	}
+
+	for _, msg := range r.messages {
+		if _, ok := msg.(*pgproto3.AuthenticationOk); ok {
+			steps = append(steps, s.authSteps(startup)...)
+		}
+		if m, ok := msg.(*negotiateProtocolVersion); ok && !s.cfg.strictStartupOptions {
+			negotiate.recorded = m
+			continue
+		}
+		steps = append(steps, &sendStep{msg: msg})
+	}
+
+	return steps
+}
+
+// startupLen return the number of steps of the startup in script
+func (s *Snap) startupLen(script *pgmock.Script) int {
+	if r, ok := s.startups[script]; ok {
+		return len(s.recordedStartupSteps(r))
+	}
+	return len(s.startupSteps())
+}
+
+// writeStartup write the messages of startup done by steps in the V1
+// format, leaving out the authentication
+func writeStartup(out *recording, steps []pgmock.Step) {
+	for _, step := range steps {
+		switch st := step.(type) {
+		case *startupStep:
+			out.write("F", st.msg)
+		case *negotiateStep:
+			if st.sent != nil {
+				out.write("B", st.sent)
+			}
+		case *sendStep:
+			out.write("B", st.msg)
+		}
+	}
+}
+
+// parameterStatusSteps send the server parameters sorted by name, so the
+// startup is the same on every run
+func (s *Snap) parameterStatusSteps() []pgmock.Step {
+	names := make([]string, 0, len(s.cfg.serverParameters))
+	for name := range s.cfg.serverParameters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	steps := make([]pgmock.Step, 0, len(names))
+	for _, name := range names {
+		steps = append(steps, &sendStep{msg: &pgproto3.ParameterStatus{
+			Name:  name,
+			Value: s.cfg.serverParameters[name],
+		}})
+	}
+
+	return steps
+}
+
+// startupStep receive the StartupMessage and keep it, so the next steps
+// can use parameters sent by the client. In V1 snapshot, the message is
+// compared with want.
+type startupStep struct {
+	msg *pgproto3.StartupMessage
+
+	want *pgproto3.StartupMessage
+	file string
+	line int
+
+	// delay is set by WithStartupDelay
+	delay time.Duration
+
+	// strict compare every parameter of want, see WithStrictStartup, and
+	// strictOptions its _pq_. options too, see WithStrictStartupOptions
+	strict        bool
+	strictOptions bool
+
+	// expect is the parameters set by WithExpectedStartupParameters
+	expect map[string]string
+}
+
+func (st *startupStep) Step(be *pgproto3.Backend) error {
+	msg, err := be.ReceiveStartupMessage()
+	if err != nil {
+		return err
+	}
+
+	startup, ok := msg.(*pgproto3.StartupMessage)
+	if !ok {
+		return fmt.Errorf("expect StartupMessage got %#v", msg)
+	}
+
+	st.msg = startup
+
+	if st.want != nil {
+		// the drivers send different parameters, e.g. lib/pq sends
+		// client_encoding, so only the user and the database are compared
+		want, got := startupKey(st.want), startupKey(startup)
+		if st.strict {
+			want, got = st.want, startup
+			if !st.strictOptions {
+				want, got = withoutPQOptions(want), withoutPQOptions(got)
+			}
+		}
+		if !match(want, got) {
+			return &MismatchError{File: st.file, Line: st.line, Want: want, Got: got}
+		}
+	}
+
+	if len(st.expect) > 0 {
+		want, got := expectedStartup(st.expect, startup)
+		if !match(want, got) {
+			return &MismatchError{File: st.file, Line: st.line, Want: want, Got: got}
+		}
+	}
+
+	return nil
+}
+
+// startupKey return msg with only the parameters that must be the same as
+// in the snapshot
+func startupKey(msg *pgproto3.StartupMessage) *pgproto3.StartupMessage {
+	key := &pgproto3.StartupMessage{
+		ProtocolVersion: msg.ProtocolVersion,
+		Parameters:      map[string]string{},
+	}
+	for _, name := range []string{"user", "database"} {
+		if v, ok := msg.Parameters[name]; ok && v != "" {
+			key.Parameters[name] = v
+		}
+	}
+	return key
+}
+
+// withoutPQOptions return msg without the _pq_. options, which depend on
+// the version of the driver
+func withoutPQOptions(msg *pgproto3.StartupMessage) *pgproto3.StartupMessage {
+	c := &pgproto3.StartupMessage{
+		ProtocolVersion: msg.ProtocolVersion,
+		Parameters:      map[string]string{},
+	}
+	for name, v := range msg.Parameters {
+		if !strings.HasPrefix(name, pqOptionPrefix) {
+			c.Parameters[name] = v
+		}
+	}
+	return c
+}
+
+// expectedStartup return StartupMessage with the expected parameters, and
+// msg with only those parameters
+func expectedStartup(expect map[string]string, msg *pgproto3.StartupMessage) (*pgproto3.StartupMessage, *pgproto3.StartupMessage) {
+	want := &pgproto3.StartupMessage{ProtocolVersion: msg.ProtocolVersion, Parameters: expect}
+	got := &pgproto3.StartupMessage{ProtocolVersion: msg.ProtocolVersion, Parameters: map[string]string{}}
+	for name := range expect {
+		if v, ok := msg.Parameters[name]; ok {
+			got.Parameters[name] = v
+		}
+	}
+	return want, got
+}
+
+func (st *startupStep) stepSession(sess *session) error {
+	err := st.Step(sess.be)
+
+	// the client wait for the authentication, so the error is sent right
+	// away
+	sess.waiting = st.msg != nil
+	if err != nil {
+		return err
+	}
+	if st.delay > 0 {
+		return sess.sleep(st.delay)
+	}
+	return nil
+}
+
+func (st *startupStep) user() string {
+	if st.msg == nil {
+		return ""
+	}
+	return st.msg.Parameters["user"]
+}
@@ -0,0 +1,78 @@
+package pgsnap
+
+import (
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Stats is the number of messages sent by the clients to the fake
+// postgres (or to the real postgres while recording), see Snap.Stats
+type Stats struct {
+	// Queries is the number of Query (simple protocol). A Query with
+	// several statements is counted once.
+	Queries  int
+	Parses   int
+	Binds    int
+	Executes int
+	Syncs    int
+
+	// Messages is the number of every message type, e.g. "Describe"
+	Messages map[string]int
+}
+
+// stats count the messages received from every connection
+type stats struct {
+	mu       sync.Mutex
+	messages map[string]int
+}
+
+func (st *stats) add(msg pgproto3.FrontendMessage) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.messages == nil {
+		st.messages = map[string]int{}
+	}
+	st.messages[messageType(msg)]++
+}
+
+// reset forget the messages counted so far
+func (st *stats) reset() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.messages = nil
+}
+
+func (st *stats) get() Stats {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	messages := make(map[string]int, len(st.messages))
+	for name, n := range st.messages {
+		messages[name] = n
+	}
+
+	return Stats{
+		Queries:  messages["Query"],
+		Parses:   messages["Parse"],
+		Binds:    messages["Bind"],
+		Executes: messages["Execute"],
+		Syncs:    messages["Sync"],
+		Messages: messages,
+	}
+}
+
+// Stats return the number of messages sent by the clients so far. Call it
+// after Wait to get the numbers for the whole test.
+func (s *Snap) Stats() Stats {
+	return s.stats.get()
+}
+
+// QueryCount return the number of queries run by the clients, which is
+// the number of Query and Execute messages
+func (s *Snap) QueryCount() int {
+	st := s.stats.get()
+	return st.Queries + st.Executes
+}
@@ -0,0 +1,303 @@
+package pgsnap
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// expectStep wait for the client to send want. It works like
+// pgmock.ExpectMessage, but keep want so it can be reported.
+type expectStep struct {
+	want pgproto3.FrontendMessage
+
+	// pattern match the SQL instead of comparing it, see QueryPatternPrefix
+	pattern *regexp.Regexp
+
+	// normalizeSQL compare the SQL ignoring whitespace, see WithNormalizeSQL
+	normalizeSQL bool
+
+	// params is the typed parameters of Bind, see bindParam
+	params []bindParam
+
+	// file and line of want in the snapshot, for reporting mismatch
+	file string
+	line int
+}
+
+func (s *Snap) newExpectStep(want pgproto3.FrontendMessage, line int) (*expectStep, error) {
+	pattern, err := queryPattern(want)
+	if err != nil {
+		return nil, err
+	}
+
+	return &expectStep{
+		want:         want,
+		pattern:      pattern,
+		normalizeSQL: s.cfg.normalizeSQL,
+		file:         s.getFilename(),
+		line:         line,
+	}, nil
+}
+
+func (e *expectStep) Step(be *pgproto3.Backend) error {
+	return e.stepSession(newSession(be))
+}
+
+func (e *expectStep) stepSession(sess *session) error {
+	msg, err := sess.receive()
+	for err == nil && isHealthCheck(sess.healthChecks, msg) && !e.expects(msg) {
+		if err = sess.answerHealthCheck(msg.(*pgproto3.Query)); err == nil {
+			msg, err = sess.be.Receive()
+		}
+	}
+	if err != nil {
+		// closing the connection without Terminate is as good as
+		// Terminate when the script has nothing else to do
+		if _, ok := e.want.(*pgproto3.Terminate); ok && isClosed(err) {
+			return nil
+		}
+		return err
+	}
+
+	sess.received(msg)
+
+	if err := sess.runHook(msg); err != nil {
+		return err
+	}
+
+	if want, got, ok := e.compare(sess, msg); !ok {
+		return &MismatchError{File: e.file, Line: e.line, Want: want, Got: cloneMessage(got), params: e.params}
+	}
+
+	return nil
+}
+
+// compare return want and msg as they're compared, with the names of the
+// statements and the SQL normalized, and whether they match
+func (e *expectStep) compare(sess *session, msg pgproto3.FrontendMessage) (pgproto3.FrontendMessage, pgproto3.FrontendMessage, bool) {
+	want, got := sess.normalize(e.want, msg), msg
+	if e.normalizeSQL {
+		got = normalizeQuery(got)
+		if e.pattern == nil {
+			want = normalizeQuery(want)
+		}
+	}
+
+	if e.pattern != nil {
+		if q, ok := queryOf(got); ok && e.pattern.MatchString(q) {
+			want = withQuery(want, q)
+		}
+	}
+
+	return want, got, match(want, got)
+}
+
+// sendStep send msg to the client, like pgmock.SendMessage, but give it
+// to the hook set by WithStepHook first
+type sendStep struct {
+	msg pgproto3.BackendMessage
+}
+
+func (st *sendStep) Step(be *pgproto3.Backend) error {
+	return be.Send(st.msg)
+}
+
+func (st *sendStep) stepSession(sess *session) error {
+	msg := st.msg
+	if sess.hook != nil {
+		msg = copyMessage(msg).(pgproto3.BackendMessage)
+		if err := sess.runHook(msg); err != nil {
+			return err
+		}
+	}
+
+	sess.sent(msg)
+	return sess.be.Send(msg)
+}
+
+// closeStep close the connection in the middle of the script, like
+// postgres that goes away while the query is running. It's written in the
+// snapshot as B {"Type":"Close"}, which must be the last line of the
+// connection. With "Reset":true, the connection is reset, so the client
+// get "connection reset by peer" instead of EOF.
+type closeStep struct {
+	Reset bool
+}
+
+// parseCloseStep return the closeStep in B line b
+func parseCloseStep(b []byte) (*closeStep, bool) {
+	var c struct {
+		Type  string
+		Reset bool
+	}
+	if json.Unmarshal(b, &c) != nil || c.Type != "Close" {
+		return nil, false
+	}
+	return &closeStep{Reset: c.Reset}, true
+}
+
+// parseDelay return the delay set by "delayMs" in B line b, e.g.
+// B {"Type":"DataRow","Values":[{"text":"1"}],"delayMs":500}
+func parseDelay(b []byte) (time.Duration, error) {
+	var d struct {
+		DelayMs int64 `json:"delayMs"`
+	}
+	if err := json.Unmarshal(b, &d); err != nil {
+		return 0, err
+	}
+	if d.DelayMs < 0 {
+		return 0, errors.New("delayMs must not be negative")
+	}
+	return time.Duration(d.DelayMs) * time.Millisecond, nil
+}
+
+// isCloseStep tell whether step close the connection, after its delay
+func isCloseStep(step pgmock.Step) bool {
+	if d, ok := step.(*delayStep); ok {
+		step = d.step
+	}
+	_, ok := step.(*closeStep)
+	return ok
+}
+
+// Step return the step itself as the error, so the connection is closed
+// by acceptConnForScrpt
+func (c *closeStep) Step(be *pgproto3.Backend) error {
+	return c
+}
+
+func (c *closeStep) Error() string {
+	return "pgsnap: the connection is closed by the snapshot"
+}
+
+// copyMessage return shallow copy of msg, so the hook can change the
+// fields of the message sent without changing the script
+func copyMessage(msg pgproto3.Message) pgproto3.Message {
+	v := reflect.ValueOf(msg).Elem()
+	c := reflect.New(v.Type())
+	c.Elem().Set(v)
+	return c.Interface().(pgproto3.Message)
+}
+
+// cloneMessage return deep copy of msg received from the client, which is
+// kept after the next Receive, as Backend reuses the message and its buffer
+func cloneMessage(msg pgproto3.FrontendMessage) pgproto3.FrontendMessage {
+	return deepCopyMessage(msg).(pgproto3.FrontendMessage)
+}
+
+// deepCopyMessage return copy of msg that shares no memory with it
+func deepCopyMessage(msg pgproto3.Message) pgproto3.Message {
+	b := msg.Encode(nil)
+	if _, ok := msg.(*pgproto3.StartupMessage); ok {
+		b = b[4:]
+	} else {
+		b = b[5:]
+	}
+
+	c := reflect.New(reflect.ValueOf(msg).Elem().Type()).Interface().(pgproto3.Message)
+	if err := c.Decode(b); err != nil {
+		return msg
+	}
+	return c
+}
+
+// isClosed tell whether err is returned by Receive because the client
+// closed the connection
+func isClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// progress keep which step is running for every script
+type progress struct {
+	mu         sync.Mutex
+	scripts    []*pgmock.Script
+	startupLen func(*pgmock.Script) int
+	pos        map[*pgmock.Script]int
+
+	// startups is the number of steps of the startup of every script,
+	// counted once when it's added
+	startups map[*pgmock.Script]int
+}
+
+func (p *progress) start(scripts []*pgmock.Script, startupLen func(*pgmock.Script) int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.scripts = nil
+	p.startupLen = startupLen
+	p.pos = make(map[*pgmock.Script]int, len(scripts))
+	p.startups = make(map[*pgmock.Script]int, len(scripts))
+	p.addLocked(scripts)
+}
+
+// add keep track of scripts replayed after Use
+func (p *progress) add(scripts []*pgmock.Script) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.addLocked(scripts)
+}
+
+func (p *progress) addLocked(scripts []*pgmock.Script) {
+	p.scripts = append(p.scripts, scripts...)
+	for _, script := range scripts {
+		p.startups[script] = p.startupLen(script)
+	}
+}
+
+// startup return the number of steps of the startup of script
+func (p *progress) startup(script *pgmock.Script) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n, ok := p.startups[script]; ok {
+		return n
+	}
+	return p.startupLen(script)
+}
+
+func (p *progress) set(script *pgmock.Script, pos int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.pos[script] = pos
+}
+
+// unconsumed list the expected messages that are not received yet, with
+// the connection and step number (counted from 1, startup excluded)
+func (p *progress) unconsumed() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var result []string
+	for i, script := range p.scripts {
+		for j := p.pos[script]; j < len(script.Steps); j++ {
+			var name string
+			switch st := script.Steps[j].(type) {
+			case *expectStep:
+				name = messageType(st.want)
+			case *unorderedStep:
+				name = fmt.Sprintf("unordered group of %d exchanges", len(st.exchanges))
+			default:
+				continue
+			}
+
+			result = append(result, fmt.Sprintf("  connection %d step %d: %s", i+1, j-p.startups[script]+1, name))
+		}
+	}
+
+	return result
+}
+
+func messageType(msg pgproto3.Message) string {
+	return reflect.TypeOf(msg).Elem().Name()
+}
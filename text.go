@@ -0,0 +1,443 @@
+package pgsnap
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Format is the format of the snapshot file, see WithFormat and Convert
+type Format int
+
+const (
+	// FormatJSON write every message as JSON
+	FormatJSON Format = iota
+
+	// FormatText write Query as ">>> SQL" and DataRow as "| a | b |",
+	// other messages are written as JSON
+	FormatText
+
+	// FormatYAML write the snapshot as YAML document, in .yaml file
+	FormatYAML
+)
+
+var (
+	textQuery    = []byte(">>>")
+	textContinue = []byte("...")
+	textRow      = []byte("|")
+)
+
+// textLine is one line of the snapshot, with text lines written as JSON,
+// and offset of its first byte in the snapshot
+type textLine struct {
+	line   int
+	offset int64
+	b      []byte
+}
+
+// textError is error in a line written in the text format
+type textError struct {
+	line int
+	err  error
+	b    []byte
+}
+
+func (e *textError) Error() string {
+	return fmt.Sprintf("%d: %v: %s", e.line, e.err, e.b)
+}
+
+// fromText split src into lines, with Query and DataRow written in the
+// text format replaced by their JSON line. The format of each line is told
+// by its first byte, so both formats can be used in the same snapshot.
+// The "..." lines continuing SQL are joined to their query.
+func fromText(src []byte) ([]textLine, error) {
+	sc := newTextScanner(bytes.NewReader(src), 0)
+
+	var lines []textLine
+	for {
+		line, err := sc.scan()
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, line)
+	}
+}
+
+// lineScanner return the lines of the snapshot one at a time, and io.EOF
+// after the last one
+type lineScanner interface {
+	scan() (textLine, error)
+}
+
+// sliceScanner return lines read before, like the lines of YAML
+type sliceScanner []textLine
+
+func (sc *sliceScanner) scan() (textLine, error) {
+	if len(*sc) == 0 {
+		return textLine{}, io.EOF
+	}
+	l := (*sc)[0]
+	*sc = (*sc)[1:]
+	return l, nil
+}
+
+// scanLines return the lines of snapshot f, which can be compressed with
+// gzip
+func (s *Snap) scanLines(f io.Reader) (lineScanner, error) {
+	r, err := gunzipReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if !s.isYAML() {
+		return newTextScanner(r, 0), nil
+	}
+
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	lines, err := fromYAML(src)
+	if err != nil {
+		return nil, err
+	}
+	sc := sliceScanner(lines)
+	return &sc, nil
+}
+
+// textScanner read the lines of the snapshot one at a time, like fromText,
+// so the snapshot isn't kept in memory. The line has its offset in the
+// snapshot, to be read again later, see rowsStep.
+type textScanner struct {
+	r *bufio.Reader
+
+	// line and offset of the next line
+	line   int
+	offset int64
+
+	// the line read ahead to find the "..." lines, and whether the end
+	// is reached
+	ahead   []byte
+	hasNext bool
+	eof     bool
+}
+
+// newTextScanner return scanner reading r, which start at line after line
+func newTextScanner(r io.Reader, line int) *textScanner {
+	return &textScanner{r: bufio.NewReader(r), line: line}
+}
+
+// readLine return the next line as it is. Like bytes.Split, there is one
+// more line after the last "\n".
+func (sc *textScanner) readLine() ([]byte, error) {
+	if sc.hasNext {
+		sc.hasNext = false
+		return sc.ahead, nil
+	}
+	if sc.eof {
+		return nil, io.EOF
+	}
+
+	b, err := sc.r.ReadBytes('\n')
+	switch {
+	case err == io.EOF:
+		sc.eof = true
+	case err != nil:
+		return nil, err
+	default:
+		b = b[:len(b)-1]
+	}
+	return b, nil
+}
+
+// peekLine return the next line without reading it
+func (sc *textScanner) peekLine() ([]byte, bool) {
+	if !sc.hasNext {
+		b, err := sc.readLine()
+		if err != nil {
+			return nil, false
+		}
+		sc.ahead, sc.hasNext = b, true
+	}
+	return sc.ahead, true
+}
+
+// scan return the next line, or io.EOF after the last one
+func (sc *textScanner) scan() (textLine, error) {
+	raw, err := sc.readLine()
+	if err != nil {
+		return textLine{}, err
+	}
+
+	sc.line++
+	line := textLine{line: sc.line, offset: sc.offset, b: bytes.TrimSpace(raw)}
+	sc.offset += int64(len(raw)) + 1
+	b := line.b
+
+	switch {
+	case bytes.HasPrefix(b, textQuery):
+		sql := trimOneSpace(b[len(textQuery):])
+		for {
+			next, ok := sc.peekLine()
+			if !ok {
+				break
+			}
+			next = bytes.TrimRight(bytes.TrimLeft(next, " \t"), "\r")
+			if !bytes.HasPrefix(next, textContinue) {
+				break
+			}
+			sql = append(append(sql, '\n'), trimOneSpace(next[len(textContinue):])...)
+			sc.hasNext = false
+			sc.line++
+			sc.offset += int64(len(sc.ahead)) + 1
+		}
+
+		line.b = textJSON("F", &pgproto3.Query{String: string(sql)})
+	case bytes.HasPrefix(b, textContinue):
+		return textLine{}, &textError{line: line.line, err: errors.New("... without >>> before it"), b: b}
+	case bytes.HasPrefix(b, textRow):
+		b, delay := splitTextDelay(b)
+		row, err := parseTextRow(b)
+		if err != nil {
+			return textLine{}, &textError{line: line.line, err: err, b: b}
+		}
+
+		line.b = textJSON("B", row)
+		if delay != "" {
+			line.b = append(line.b[:len(line.b)-1], `,"delayMs":`+delay+`}`...)
+		}
+	}
+
+	return line, nil
+}
+
+// textDelay is the delayMs of the row, written after it like
+// "| 1 | foo | delayMs=500"
+var textDelay = regexp.MustCompile(`\| delayMs=(\d+)$`)
+
+// splitTextDelay return row b without its delayMs, and the delay
+func splitTextDelay(b []byte) ([]byte, string) {
+	m := textDelay.FindSubmatchIndex(b)
+	if m == nil {
+		return b, ""
+	}
+	return b[:m[0]+1], string(b[m[2]:m[3]])
+}
+
+func textJSON(prefix string, msg pgproto3.Message) []byte {
+	b, _ := marshalJSON(msg)
+	return append([]byte(prefix+" "), b...)
+}
+
+func trimOneSpace(b []byte) []byte {
+	b = bytes.TrimPrefix(b, []byte(" "))
+	return append([]byte(nil), b...)
+}
+
+// parseTextRow read DataRow written like "| 1 | foo |". Every value is
+// padded by one space, "\N" is NULL, "\x" starts a value written in hex,
+// and "\\" and "\|" are backslash and pipe.
+func parseTextRow(b []byte) (*pgproto3.DataRow, error) {
+	row := &pgproto3.DataRow{}
+
+	var cell []byte
+	escaped := false
+	for _, c := range b[1:] {
+		switch {
+		case escaped:
+			cell = append(cell, '\\', c)
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '|':
+			v, err := parseTextValue(trimOneSpace(bytes.TrimSuffix(cell, []byte(" "))))
+			if err != nil {
+				return nil, err
+			}
+			row.Values = append(row.Values, v)
+			cell = cell[:0]
+		default:
+			cell = append(cell, c)
+		}
+	}
+
+	if len(cell) > 0 || escaped || len(row.Values) == 0 {
+		return nil, errors.New("row must end with |")
+	}
+
+	return row, nil
+}
+
+func parseTextValue(cell []byte) ([]byte, error) {
+	if string(cell) == `\N` {
+		return nil, nil
+	}
+
+	if bytes.HasPrefix(cell, []byte(`\x`)) {
+		return hex.DecodeString(string(cell[2:]))
+	}
+
+	v := []byte{}
+	for i := 0; i < len(cell); i++ {
+		if cell[i] != '\\' {
+			v = append(v, cell[i])
+			continue
+		}
+
+		i++
+		if i == len(cell) || (cell[i] != '\\' && cell[i] != '|') {
+			return nil, fmt.Errorf("invalid escape in %q", cell)
+		}
+		v = append(v, cell[i])
+	}
+
+	return v, nil
+}
+
+// toText write msg in the text format, ok is false when msg has no text
+// format
+func toText(msg pgproto3.Message) (string, bool) {
+	switch m := msg.(type) {
+	case *pgproto3.Query:
+		// trailing whitespace isn't kept in the text format
+		for _, line := range strings.Split(m.String, "\n") {
+			if strings.TrimRight(line, " \t\r") != line {
+				return "", false
+			}
+		}
+		return ">>> " + strings.ReplaceAll(m.String, "\n", "\n... "), true
+	case *pgproto3.DataRow:
+		if len(m.Values) == 0 {
+			return "", false
+		}
+
+		var b strings.Builder
+		b.WriteString("|")
+		for _, v := range m.Values {
+			b.WriteString(" ")
+			b.WriteString(textValue(v))
+			b.WriteString(" |")
+		}
+		return b.String(), true
+	}
+
+	return "", false
+}
+
+func textValue(v []byte) string {
+	if v == nil {
+		return `\N`
+	}
+
+	if _, binary := valueToJSON(v)["binary"]; binary {
+		return `\x` + hex.EncodeToString(v)
+	}
+
+	return strings.NewReplacer(`\`, `\\`, `|`, `\|`).Replace(string(v))
+}
+
+// Convert write the snapshot read from src to dst in the given format.
+// Comments, blank lines and the messages without text format, or with keys
+// it doesn't have, are kept as they are. The snapshot compressed with gzip
+// is written uncompressed.
+func Convert(dst io.Writer, src io.Reader, to Format) error {
+	b, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+
+	b, err = gunzip(b)
+	if err != nil {
+		return err
+	}
+
+	lines, err := fromText(b)
+	if err != nil {
+		return fmt.Errorf("pgsnap: line %w", err)
+	}
+
+	// the last newline doesn't start another line
+	if n := len(lines); n > 0 && len(lines[n-1].b) == 0 {
+		lines = lines[:n-1]
+	}
+
+	for _, line := range lines {
+		out := string(line.b)
+		if to == FormatText {
+			if msg := decodeTextLine(line.b); msg != nil {
+				if text, ok := toText(msg); ok {
+					out = text
+					if d, err := parseDelay(line.b[1:]); err == nil && d > 0 {
+						out += " delayMs=" + strconv.FormatInt(d.Milliseconds(), 10)
+					}
+				}
+			}
+		}
+
+		if _, err := io.WriteString(dst, out+"\n"); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// decodeTextLine return the Query or DataRow in JSON line b, or nil when
+// the line has keys that the text format doesn't have, like the "match" of
+// a value, so it's kept as JSON
+func decodeTextLine(b []byte) pgproto3.Message {
+	if len(b) < 2 || (b[0] != 'F' && b[0] != 'B') {
+		return nil
+	}
+
+	var keys map[string]json.RawMessage
+	if json.Unmarshal(b[1:], &keys) != nil {
+		return nil
+	}
+	for key := range keys {
+		// the delay of a row is written after it
+		if key != "Type" && key != "String" && key != "Values" && !(key == "delayMs" && b[0] == 'B') {
+			return nil
+		}
+	}
+
+	var msg struct {
+		Type   string
+		String string
+		Values []map[string]string
+	}
+	if json.Unmarshal(b[1:], &msg) != nil {
+		return nil
+	}
+
+	switch {
+	case b[0] == 'F' && msg.Type == "Query":
+		return &pgproto3.Query{String: msg.String}
+	case b[0] == 'B' && msg.Type == "DataRow":
+		row := &pgproto3.DataRow{}
+		for _, v := range msg.Values {
+			if len(v) > 1 {
+				return nil
+			}
+			value, err := valueFromJSON(v)
+			if err != nil {
+				return nil
+			}
+			row.Values = append(row.Values, value)
+		}
+		return row
+	}
+
+	return nil
+}
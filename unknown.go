@@ -0,0 +1,185 @@
+package pgsnap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// UnknownMessagePolicy tell what the recording does with the message of
+// postgres that pgsnap can't replay, see WithUnknownMessagePolicy
+type UnknownMessagePolicy int
+
+const (
+	// UnknownMessageFail stops the connection when pgproto3 can't read the
+	// message, and records the message it reads even when it can't be
+	// replayed
+	UnknownMessageFail UnknownMessagePolicy = iota
+	// UnknownMessageSkip leaves the message out of the snapshot, and logs
+	// it. The message is still sent to the client.
+	UnknownMessageSkip
+	// UnknownMessageRaw records the message as UnknownMessage, with its
+	// bytes in base64, which are replayed as they are
+	UnknownMessageRaw
+)
+
+// unknownMessage is message of postgres kept as its bytes, written in the
+// snapshot as B {"Type":"UnknownMessage","MsgType":"W","Data":"AAA="}
+type unknownMessage struct {
+	MsgType byte
+	Data    []byte
+}
+
+// Backend identifies this message as sendable by the PostgreSQL backend.
+func (*unknownMessage) Backend() {}
+
+func (dst *unknownMessage) Decode(src []byte) error {
+	dst.Data = append([]byte(nil), src...)
+	return nil
+}
+
+func (src *unknownMessage) Encode(dst []byte) []byte {
+	dst = append(dst, src.MsgType)
+	dst = appendUint32(dst, uint32(4+len(src.Data)))
+	return append(dst, src.Data...)
+}
+
+func (src unknownMessage) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Type    string
+		MsgType string
+		Data    []byte
+	}{
+		Type:    "UnknownMessage",
+		MsgType: string(rune(src.MsgType)),
+		Data:    src.Data,
+	})
+}
+
+func unmarshalUnknownMessage(src []byte) (*unknownMessage, error) {
+	var m struct {
+		MsgType string
+		Data    []byte
+	}
+	if err := json.Unmarshal(src, &m); err != nil {
+		return nil, err
+	}
+	if len(m.MsgType) != 1 {
+		return nil, errors.New("MsgType of UnknownMessage must be one character")
+	}
+
+	return &unknownMessage{MsgType: m.MsgType[0], Data: m.Data}, nil
+}
+
+// unmarshalRaw return the bytes of RAW line, which are one whole message
+// with its type and length, e.g. CommandComplete "SELECT 1" is
+// B {"Type":"RAW","Data":"QwAAAA1TRUxFQ1QgMQA="}
+func unmarshalRaw(src []byte) ([]byte, error) {
+	var m struct {
+		Data []byte
+	}
+	if err := json.Unmarshal(src, &m); err != nil {
+		return nil, err
+	}
+
+	b := m.Data
+	if len(b) < 5 || int(binary.BigEndian.Uint32(b[1:])) != len(b)-1 {
+		return nil, errors.New("Data of RAW must be one message, with its type and length")
+	}
+	return b, nil
+}
+
+// unmarshalRawB return the message in B RAW line, which is sent as it is
+func unmarshalRawB(src []byte) (*unknownMessage, error) {
+	b, err := unmarshalRaw(src)
+	if err != nil {
+		return nil, err
+	}
+	return &unknownMessage{MsgType: b[0], Data: b[5:]}, nil
+}
+
+// unmarshalRawF return the message in F RAW line, read like it's sent by
+// the client, so it's compared like the other messages
+func unmarshalRawF(src []byte) (pgproto3.FrontendMessage, error) {
+	b, err := unmarshalRaw(src)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := pgproto3.NewBackend(pgproto3.NewChunkReader(bytes.NewReader(b)), nil).Receive()
+	if err != nil {
+		return nil, fmt.Errorf("RAW: %w", err)
+	}
+	return msg, nil
+}
+
+// isRaw tell whether line b has RAW message
+func isRaw(b []byte) bool {
+	var t struct {
+		Type string
+	}
+	return json.Unmarshal(b, &t) == nil && t.Type == "RAW"
+}
+
+// rawReader keep the last header and body read by Frontend, so the
+// message that pgproto3 can't read is still available as its bytes
+type rawReader struct {
+	cr   pgproto3.ChunkReader
+	last [2][]byte
+}
+
+func (r *rawReader) Next(n int) ([]byte, error) {
+	b, err := r.cr.Next(n)
+	if err == nil {
+		r.last[0], r.last[1] = r.last[1], b
+	}
+	return b, err
+}
+
+// unknown return the message read last when err is returned by Receive
+// because pgproto3 doesn't know the type of the message
+func (r *rawReader) unknown(err error) (*unknownMessage, bool) {
+	if err == nil || !strings.HasPrefix(err.Error(), "unknown ") {
+		return nil, false
+	}
+	return r.message()
+}
+
+// message return the message read last as its bytes. They are kept as
+// they are, as pgproto3 doesn't encode every message back the same, e.g.
+// CopyBothResponse loses its format.
+func (r *rawReader) message() (*unknownMessage, bool) {
+	header, body := r.last[0], r.last[1]
+	if len(header) != 5 || int(binary.BigEndian.Uint32(header[1:]))-4 != len(body) {
+		return nil, false
+	}
+
+	return &unknownMessage{MsgType: header[0], Data: append([]byte(nil), body...)}, true
+}
+
+// replayableTypes cache whether the messages of every type read from
+// postgres can be read back from the snapshot
+var replayableTypes sync.Map
+
+// replayable tell whether msg can be read back from the snapshot by
+// unmarshalB
+func (s *Snap) replayable(msg pgproto3.BackendMessage) bool {
+	t := reflect.TypeOf(msg)
+	if ok, found := replayableTypes.Load(t); found {
+		return ok.(bool)
+	}
+
+	b, err := marshalJSON(msg)
+	if err == nil {
+		_, err = s.unmarshalB(b)
+	}
+	replayableTypes.Store(t, err == nil)
+	return err == nil
+}
@@ -0,0 +1,158 @@
+package pgsnap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+)
+
+var (
+	unorderedLine    = []byte("=== unordered ===")
+	unorderedEndLine = []byte("=== end ===")
+)
+
+// unorderedStep run the exchanges of the group written between
+// "=== unordered ===" and "=== end ===" in the order the client sends
+// them, e.g. the queries of goroutines sharing one connection. An exchange
+// is the messages until ReadyForQuery, so it ends with Sync or Query.
+type unorderedStep struct {
+	exchanges [][]pgmock.Step
+}
+
+func (u *unorderedStep) Step(be *pgproto3.Backend) error {
+	return u.stepSession(newSession(be))
+}
+
+func (u *unorderedStep) stepSession(sess *session) error {
+	left := append([][]pgmock.Step(nil), u.exchanges...)
+
+	for len(left) > 0 {
+		msg, err := sess.receive()
+		if err != nil {
+			return err
+		}
+
+		i := 0
+		for i < len(left) && !firstExpect(left[i]).accepts(sess, msg) {
+			i++
+		}
+		if i == len(left) {
+			if isHealthCheck(sess.healthChecks, msg) {
+				if err := sess.answerHealthCheck(msg.(*pgproto3.Query)); err != nil {
+					return err
+				}
+				continue
+			}
+
+			// the mismatch is shown with the first exchange left
+			i = 0
+		}
+
+		sess.pending = msg
+		for _, step := range left[i] {
+			if err := runStep(sess, step); err != nil {
+				return err
+			}
+		}
+		left = append(left[:i], left[i+1:]...)
+	}
+
+	return nil
+}
+
+// accepts tell whether msg is the message of e, without mapping the names
+// of the statements of sess
+func (e *expectStep) accepts(sess *session, msg pgproto3.FrontendMessage) bool {
+	statements, names := copyNames(sess.statements), copyNames(sess.names)
+	defer func() {
+		sess.statements, sess.names = statements, names
+	}()
+
+	_, _, ok := e.compare(sess, msg)
+	return ok
+}
+
+func copyNames(m map[string]string) map[string]string {
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+// firstExpect return the step receiving the first message of exchange
+func firstExpect(exchange []pgmock.Step) *expectStep {
+	return unwrapDelay(exchange[0]).(*expectStep)
+}
+
+// unorderedGroup is the group of the snapshot being read, from the step
+// start of the script
+type unorderedGroup struct {
+	line  int
+	start int
+}
+
+// readUnordered start or end the group of line b, and return false when
+// b isn't a line of the group
+func (s *Snap) readUnordered(script *pgmock.Script, group **unorderedGroup, b []byte, line int) (bool, error) {
+	switch {
+	case bytes.Equal(b, unorderedLine):
+		if *group != nil {
+			return true, fmt.Errorf("unordered group of line %d isn't ended", (*group).line)
+		}
+		*group = &unorderedGroup{line: line, start: len(script.Steps)}
+		return true, nil
+
+	case bytes.Equal(b, unorderedEndLine):
+		if *group == nil {
+			return true, errors.New("=== end === without === unordered === before it")
+		}
+		step, err := newUnorderedStep(script.Steps[(*group).start:])
+		if err != nil {
+			return true, fmt.Errorf("unordered group of line %d %w", (*group).line, err)
+		}
+		script.Steps = append(script.Steps[:(*group).start], step)
+		*group = nil
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// newUnorderedStep split steps into exchanges ending with ReadyForQuery
+func newUnorderedStep(steps []pgmock.Step) (*unorderedStep, error) {
+	if len(steps) == 0 {
+		return nil, errors.New("is empty")
+	}
+
+	u := &unorderedStep{}
+	var exchange []pgmock.Step
+	for _, step := range steps {
+		if len(exchange) == 0 {
+			if _, ok := unwrapDelay(step).(*expectStep); !ok {
+				return nil, errors.New("has an exchange that doesn't start with a message of the client")
+			}
+		}
+
+		exchange = append(exchange, step)
+		if _, ok := unwrapDelay(step).(*readyForQueryStep); ok {
+			u.exchanges = append(u.exchanges, exchange)
+			exchange = nil
+		}
+	}
+	if len(exchange) > 0 {
+		return nil, errors.New("doesn't end with ReadyForQuery")
+	}
+
+	return u, nil
+}
+
+func unwrapDelay(step pgmock.Step) pgmock.Step {
+	if d, ok := step.(*delayStep); ok {
+		return d.step
+	}
+	return step
+}
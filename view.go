@@ -0,0 +1,123 @@
+package pgsnap
+
+import (
+	"github.com/jackc/pgmock"
+	"github.com/jackc/pgproto3/v2"
+)
+
+// Script is the snapshot replayed by the snap, decoded, see Snap.Script
+type Script struct {
+	// Conns is the connections replayed without Use, in the order of the
+	// snapshot
+	Conns []ScriptConn
+
+	// Sections is the connections of every named section, see Use
+	Sections map[string][]ScriptConn
+}
+
+// ScriptConn is the messages of one connection of the snapshot, after its
+// startup
+type ScriptConn []ScriptMessage
+
+// ScriptMessage is message of the snapshot, sent by the client (Dir is 'F')
+// or by postgres ('B'), like the message given to Logger
+type ScriptMessage struct {
+	Dir byte
+	Msg pgproto3.Message
+}
+
+// Queries return the SQL of every Query and Parse sent by the client
+func (c ScriptConn) Queries() []string {
+	var queries []string
+	for _, m := range c {
+		switch msg := m.Msg.(type) {
+		case *pgproto3.Query:
+			queries = append(queries, msg.String)
+		case *pgproto3.Parse:
+			queries = append(queries, msg.Query)
+		}
+	}
+	return queries
+}
+
+// Script return the snapshot replayed by s, e.g. to check the fixture
+// itself in the test. The messages are copies, so changing them doesn't
+// change the replay. The script is empty while recording.
+func (s *Snap) Script() Script {
+	s.t.Helper()
+
+	var script Script
+	if s.writeMode {
+		return script
+	}
+
+	var err error
+	if script.Conns, err = s.scriptConns(s.scripts); err != nil {
+		s.t.Fatal(err)
+	}
+
+	script.Sections = map[string][]ScriptConn{}
+	for name, scripts := range s.sections {
+		if script.Sections[name], err = s.scriptConns(scripts); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+
+	return script
+}
+
+func (s *Snap) scriptConns(scripts []*pgmock.Script) ([]ScriptConn, error) {
+	var conns []ScriptConn
+	for _, script := range scripts {
+		var conn ScriptConn
+		for _, step := range script.Steps[s.startupLen(script):] {
+			msgs, err := stepMessages(step)
+			if err != nil {
+				return nil, err
+			}
+			conn = append(conn, msgs...)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// stepMessages return copy of the messages of step, none for the steps
+// that aren't message, like closing the connection
+func stepMessages(step pgmock.Step) ([]ScriptMessage, error) {
+	switch st := step.(type) {
+	case *delayStep:
+		return stepMessages(st.step)
+	case *expectStep:
+		return []ScriptMessage{{Dir: 'F', Msg: deepCopyMessage(st.want)}}, nil
+	case *copyDataStep:
+		return []ScriptMessage{{Dir: 'F', Msg: &pgproto3.CopyData{Data: append([]byte(nil), st.want...)}}}, nil
+	case *sendStep:
+		return []ScriptMessage{{Dir: 'B', Msg: deepCopyMessage(st.msg)}}, nil
+	case *readyForQueryStep:
+		return []ScriptMessage{{Dir: 'B', Msg: deepCopyMessage(st.msg)}}, nil
+	case *cancelStep:
+		return []ScriptMessage{{Dir: 'B', Msg: deepCopyMessage(st.msg)}}, nil
+	case *unorderedStep:
+		// the exchanges are in the order of the snapshot
+		var msgs []ScriptMessage
+		for _, exchange := range st.exchanges {
+			for _, step := range exchange {
+				m, err := stepMessages(step)
+				if err != nil {
+					return nil, err
+				}
+				msgs = append(msgs, m...)
+			}
+		}
+		return msgs, nil
+	case *rowsStep:
+		var msgs []ScriptMessage
+		err := st.each(func(row *sendStep) error {
+			msgs = append(msgs, ScriptMessage{Dir: 'B', Msg: deepCopyMessage(row.msg)})
+			return nil
+		})
+		return msgs, err
+	}
+	return nil, nil
+}
@@ -0,0 +1,179 @@
+package pgsnap
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync/atomic"
+
+	"github.com/jackc/pgproto3/v2"
+)
+
+// warmupLine is written after the startup of the connections recorded
+// before StartRecording, in place of their warm-up
+var warmupLine = []byte("=== warm-up ===")
+
+func isWarmup(b []byte) bool {
+	return bytes.Equal(b, warmupLine)
+}
+
+// StartRecording mark the end of the warm-up of the test, e.g. the schema
+// introspection and SET done by the app when it starts. While recording,
+// the messages sent before on the open connections are proxied but left
+// out of the snapshot, only their startup is written. While replaying,
+// those connections answer the warm-up on their own until StartRecording
+// is called: without rows for the queries, and with the command tag of
+// postgres. It's called once, after the warm-up.
+func (s *Snap) StartRecording() {
+	atomic.StoreInt32(&s.warmedUp, 1)
+
+	if !s.writeMode {
+		return
+	}
+
+	s.recordingsMu.Lock()
+	defer s.recordingsMu.Unlock()
+
+	for _, r := range s.recordings {
+		if r.section == "" {
+			r.skipWarmup()
+		}
+	}
+}
+
+func (s *Snap) isWarmedUp() bool {
+	return atomic.LoadInt32(&s.warmedUp) == 1
+}
+
+// endStartup mark the lines written so far as the startup
+func (r *recording) endStartup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.startup = r.seq
+	r.started = true
+}
+
+// skipWarmup drop the lines written after the startup, and write
+// warmupLine in their place. The connection that isn't started yet has
+// no warm-up.
+func (r *recording) skipWarmup() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.started {
+		return
+	}
+
+	// the batch sent while warming up is dropped too
+	r.release()
+	r.pipeline = false
+
+	r.frontend = linesUntil(r.frontend, r.startup)
+	r.backend = linesUntil(r.backend, r.startup)
+	r.frontend = append(r.frontend, &recordedLine{seq: r.next(), b: append(append([]byte(nil), warmupLine...), '\n')})
+}
+
+// linesUntil return the lines of lines with sequence number up to seq
+func linesUntil(lines []*recordedLine, seq uint64) []*recordedLine {
+	for i, l := range lines {
+		if l.seq > seq {
+			return lines[:i]
+		}
+	}
+	return lines
+}
+
+// warmupStep answer the warm-up of the connection, until StartRecording is
+// called
+type warmupStep struct {
+	s *Snap
+}
+
+func (w *warmupStep) Step(be *pgproto3.Backend) error {
+	return w.stepSession(newSession(be))
+}
+
+func (w *warmupStep) stepSession(sess *session) error {
+	// the statements and portals of the warm-up, for answering Describe
+	// and Execute
+	statements := map[string]*pgproto3.Parse{}
+	portals := map[string]string{}
+
+	for {
+		msg, err := sess.receive()
+		if err != nil {
+			if isClosed(err) {
+				return nil
+			}
+			return err
+		}
+
+		// the message after the warm-up is the one of the next step
+		if _, ok := msg.(*pgproto3.Terminate); ok || w.s.isWarmedUp() {
+			sess.pending = msg
+			return nil
+		}
+
+		var msgs []pgproto3.BackendMessage
+		switch m := msg.(type) {
+		case *pgproto3.Query:
+			if err := sess.answerHealthCheck(m); err != nil {
+				return err
+			}
+		case *pgproto3.Parse:
+			// m is reused by the next Parse received
+			statements[m.Name] = cloneMessage(m).(*pgproto3.Parse)
+			msgs = append(msgs, &pgproto3.ParseComplete{})
+		case *pgproto3.Bind:
+			if parse, ok := statements[m.PreparedStatement]; ok {
+				portals[m.DestinationPortal] = parse.Query
+			}
+			msgs = append(msgs, &pgproto3.BindComplete{})
+		case *pgproto3.Describe:
+			if parse, ok := statements[m.Name]; ok && m.ObjectType == 'S' {
+				msgs = append(msgs, &pgproto3.ParameterDescription{ParameterOIDs: parameterOIDs(parse)})
+			}
+			msgs = append(msgs, &pgproto3.NoData{})
+		case *pgproto3.Execute:
+			msgs = append(msgs, &pgproto3.CommandComplete{CommandTag: []byte(commandTag(portals[m.Portal]))})
+		case *pgproto3.Close:
+			msgs = append(msgs, &pgproto3.CloseComplete{})
+		case *pgproto3.Sync:
+			msgs = append(msgs, &pgproto3.ReadyForQuery{TxStatus: sess.txStatus})
+		case *pgproto3.Flush:
+		default:
+			return fmt.Errorf("pgsnap: can't answer %s of the warm-up", messageType(msg))
+		}
+
+		for _, msg := range msgs {
+			if err := sess.be.Send(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// placeholder match the parameters of SQL, like $1
+var placeholder = regexp.MustCompile(`\$(\d+)`)
+
+// parameterOIDs return the types of the parameters of parse, given by the
+// client or text for every placeholder of the SQL
+func parameterOIDs(parse *pgproto3.Parse) []uint32 {
+	n := len(parse.ParameterOIDs)
+	for _, m := range placeholder.FindAllStringSubmatch(parse.Query, -1) {
+		if i, err := strconv.Atoi(m[1]); err == nil && i > n {
+			n = i
+		}
+	}
+
+	oids := make([]uint32, n)
+	for i := range oids {
+		oids[i] = 25 // text
+		if i < len(parse.ParameterOIDs) && parse.ParameterOIDs[i] != 0 {
+			oids[i] = parse.ParameterOIDs[i]
+		}
+	}
+	return oids
+}
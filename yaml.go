@@ -0,0 +1,222 @@
+package pgsnap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlExt is the extension of snapshot in YAML, see WithFormat
+const yamlExt = ".yaml"
+
+// The YAML document of the snapshot has the header and the connections.
+// Every connection is a list of messages, each with the fields of the JSON
+// line under "front" (sent by the client) or "back" (sent by postgres):
+//
+//	header: V1 auth=trust
+//	connections:
+//	  - - front:
+//	        Type: Query
+//	        String: select 1
+//	    - back:
+//	        Type: DataRow
+//	        Values:
+//	          - text: "1"
+
+// isYAML tell whether the snapshot is in YAML
+func (s *Snap) isYAML() bool {
+	// the snapshot given to NewSnapFromReader has no extension
+	if s.src != nil {
+		return s.cfg.format == FormatYAML
+	}
+	return strings.HasSuffix(s.getFilename(), yamlExt)
+}
+
+// fromYAML return the lines of the snapshot in YAML, with the line of the
+// message in the YAML document
+func fromYAML(src []byte) ([]textLine, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(src, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, &textError{line: root.Line, err: errors.New("snapshot must be a mapping")}
+	}
+
+	var lines []textLine
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], root.Content[i+1]
+
+		switch key.Value {
+		case "header":
+			lines = append(lines, textLine{line: value.Line, b: []byte(value.Value)})
+		case "connections":
+			conns, err := yamlConnections(value)
+			if err != nil {
+				return nil, err
+			}
+			lines = append(lines, conns...)
+		default:
+			return nil, &textError{line: key.Line, err: errors.New("unknown field"), b: []byte(key.Value)}
+		}
+	}
+
+	return lines, nil
+}
+
+func yamlConnections(node *yaml.Node) ([]textLine, error) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, &textError{line: node.Line, err: errors.New("connections must be a list")}
+	}
+
+	var lines []textLine
+	for i, conn := range node.Content {
+		if i > 0 {
+			lines = append(lines, textLine{line: conn.Line, b: []byte("C")})
+		}
+
+		if conn.Kind != yaml.SequenceNode {
+			return nil, &textError{line: conn.Line, err: errors.New("connection must be a list of messages")}
+		}
+
+		for _, msg := range conn.Content {
+			b, err := yamlLine(msg)
+			if err != nil {
+				return nil, &textError{line: msg.Line, err: err}
+			}
+			lines = append(lines, textLine{line: msg.Line, b: b})
+		}
+	}
+
+	return lines, nil
+}
+
+// yamlWarmup is warmupLine in the messages of a connection
+const yamlWarmup = "warm-up"
+
+// yamlLine return the JSON line of message in node
+func yamlLine(node *yaml.Node) ([]byte, error) {
+	if node.Kind == yaml.ScalarNode && node.Value == yamlWarmup {
+		return warmupLine, nil
+	}
+
+	if node.Kind != yaml.MappingNode || len(node.Content) != 2 {
+		return nil, errors.New("message must have either front or back")
+	}
+
+	var prefix string
+	switch node.Content[0].Value {
+	case "front":
+		prefix = "F"
+	case "back":
+		prefix = "B"
+	default:
+		return nil, errors.New("message must have either front or back")
+	}
+
+	var v interface{}
+	if err := node.Content[1].Decode(&v); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(prefix+" "), b...), nil
+}
+
+// toYAML write the lines of snapshot as YAML document. The fields of every
+// message are kept in the order of the JSON line.
+func toYAML(lines [][]byte) ([]byte, error) {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	conns := &yaml.Node{Kind: yaml.SequenceNode}
+	conn := &yaml.Node{Kind: yaml.SequenceNode}
+	conns.Content = append(conns.Content, conn)
+
+	for _, line := range lines {
+		switch {
+		case isHeader(line):
+			root.Content = append(root.Content, yamlScalar("header"), yamlScalar(string(line)))
+		case line[0] == 'C':
+			conn = &yaml.Node{Kind: yaml.SequenceNode}
+			conns.Content = append(conns.Content, conn)
+		case isWarmup(line):
+			conn.Content = append(conn.Content, yamlScalar(yamlWarmup))
+		case line[0] == 'F' || line[0] == 'B':
+			// JSON is YAML, so the fields keep their order
+			var fields yaml.Node
+			if err := yaml.Unmarshal(line[1:], &fields); err != nil {
+				return nil, err
+			}
+			blockStyle(&fields)
+
+			key := "front"
+			if line[0] == 'B' {
+				key = "back"
+			}
+
+			conn.Content = append(conn.Content, &yaml.Node{
+				Kind:    yaml.MappingNode,
+				Content: []*yaml.Node{yamlScalar(key), fields.Content[0]},
+			})
+		default:
+			return nil, fmt.Errorf("unknown line: %s", line)
+		}
+	}
+
+	root.Content = append(root.Content, yamlScalar("connections"), conns)
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func yamlScalar(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// blockStyle remove the JSON style of node, so it's written like YAML that
+// is written by hand. Empty list and object are kept in the flow style.
+func blockStyle(node *yaml.Node) {
+	if len(node.Content) > 0 || node.Kind == yaml.ScalarNode {
+		node.Style = 0
+	}
+	for _, n := range node.Content {
+		blockStyle(n)
+	}
+}
+
+// yamlLines return the lines of YAML snapshot src, for comparing it with
+// the recording
+func yamlLines(src []byte) []byte {
+	lines, err := fromYAML(src)
+	if err != nil {
+		return src
+	}
+
+	var b strings.Builder
+	for _, line := range lines {
+		b.Write(line.b)
+		b.WriteString("\n")
+	}
+	return []byte(b.String())
+}